@@ -1,19 +1,95 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/goverclock/gopolar/internal/core"
 )
 
 func main() {
-	logPtr := flag.Bool("log", false, "enable logging for debugging, disable for better performance")
-	nosavePtr := flag.Bool("nosave", false, "ignore saved tunnels in ~/.gopolar/tunnels.toml")
+	log.SetFlags(0)
+	def := core.DefaultConfig
+	instancePtr := flag.String("instance", os.Getenv("GOPOLAR_INSTANCE"), "name of this instance, each one has its own socket, HTTP port and data directory")
+	configPtr := flag.String("config", "", "config file, default gpcore.toml in data directory, e.g. "+core.ConfigPath(""))
+	logPtr := flag.Bool("log", def.DoLogs, "enable logging for debugging, disable for better performance")
+	nosavePtr := flag.Bool("nosave", !def.ReadSaved, "ignore saved tunnels in tunnels.toml")
+	drainPtr := flag.Duration("drain", def.DrainTimeout, "grace period for existing connections when a tunnel is disabled, edited or deleted")
+	listenPtr := flag.String("listen", def.HTTPListen, "address to serve API and web UI, empty to disable")
+	socketPtr := flag.String("socket", def.SocketPath, "unix domain socket to serve API")
+	dataDirPtr := flag.String("datadir", def.DataDir, "directory of tunnels.toml")
+	logDirPtr := flag.String("logdir", "", "directory of logs, default logs/ in data directory")
+	webuiPtr := flag.String("webui", def.WebUIPath, "directory of built web UI")
 	flag.Parse()
 
-	cfg := core.DefaultConfig
-	cfg.DoLogs = *logPtr
-	cfg.ReadSaved = !*nosavePtr
+	// flags > environment variables > config file > defaults
+	cfg, err := core.LoadInstanceConfig(*instancePtr, *configPtr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "log":
+			cfg.DoLogs = *logPtr
+		case "nosave":
+			cfg.ReadSaved = !*nosavePtr
+		case "drain":
+			cfg.DrainTimeout = *drainPtr
+		case "listen":
+			cfg.HTTPListen = *listenPtr
+		case "socket":
+			cfg.SocketPath = *socketPtr
+		case "datadir":
+			cfg.DataDir = *dataDirPtr
+		case "logdir":
+			cfg.LogDir = *logDirPtr
+		case "webui":
+			cfg.WebUIPath = *webuiPtr
+		}
+	})
 	tm := core.NewTunnelManager(cfg)
-	tm.Run()
+	if cfg.Instance != "" {
+		log.Printf("instance %v: serving API on %v and %v, data directory %v\n", cfg.Instance, cfg.HTTPListen, cfg.SocketPath, cfg.DataDir)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tm.Run()
+	}()
+
+	// reload tunnels.toml on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := tm.Reload(); err != nil {
+				log.Println("fail to reload tunnels:", err)
+			} else {
+				log.Println("reloaded tunnels")
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		log.Fatalln("fail to run gpcore:", err)
+	case <-ctx.Done():
+	}
+
+	stop() // a second signal kills gpcore immediately
+	log.Printf("shutting down, waiting at most %v for existing connections\n", cfg.DrainTimeout)
+	// leave a little more time than DrainTimeout for connections to close
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout+time.Second)
+	defer cancel()
+	if err := tm.Shutdown(sctx); err != nil {
+		log.Println("shutdown:", err)
+	}
+	<-errc
 }
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+	"github.com/goverclock/gopolar/pkg/client"
+
+	"gopkg.in/yaml.v3"
+)
+
+func tunnelRows(tunnels []client.Tunnel) [][]string {
+	rows := [][]string{{"ID", "NAME", "ENABLE", "SOURCE", "DEST", "ERROR"}}
+	for _, t := range tunnels {
+		rows = append(rows, []string{fmt.Sprint(t.ID), t.Name, fmt.Sprint(t.Enable), t.Source, t.Dest, t.Error})
+	}
+	return rows
+}
+
+func runList(ctx context.Context, o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("list takes no arguments")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	tunnels, err := c.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+	return printOutput(o, map[string]interface{}{"tunnels": tunnels}, tunnelRows(tunnels))
+}
+
+func createFlags(fs *flag.FlagSet, o *options) {
+	fs.BoolVar(&o.disabled, "disabled", false, "create the tunnel disabled, default tunnel_defaults.enable of gpcore")
+}
+
+func runCreate(ctx context.Context, o *options, args []string) error {
+	if len(args) != 3 {
+		return usageError("create takes NAME SOURCE DEST")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	request := client.CreateTunnelRequest{Name: args[0], Source: args[1], Dest: args[2]}
+	if o.disabled {
+		enable := false
+		request.Enable = &enable
+	}
+	t, err := c.CreateTunnel(ctx, request)
+	if err != nil {
+		return err
+	}
+	return printOutput(o, t, tunnelRows([]client.Tunnel{t}))
+}
+
+func editFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.name, "name", "", "new name")
+	fs.StringVar(&o.source, "source", "", "new source, e.g. localhost:3300")
+	fs.StringVar(&o.dest, "dest", "", "new dest, e.g. 192.168.10.1:80")
+}
+
+func runEdit(ctx context.Context, o *options, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return usageError("edit takes one tunnel ID")
+	}
+	patch := client.TunnelPatch{}
+	if o.set["name"] {
+		patch.Name = &o.name
+	}
+	if o.set["source"] {
+		patch.Source = &o.source
+	}
+	if o.set["dest"] {
+		patch.Dest = &o.dest
+	}
+	if patch.Name == nil && patch.Source == nil && patch.Dest == nil {
+		return usageError("at least one of -name, -source and -dest must be specified")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	t, err := c.UpdateTunnel(ctx, ids[0], patch)
+	if err != nil {
+		return err
+	}
+	return printOutput(o, t, tunnelRows([]client.Tunnel{t}))
+}
+
+// run op on each tunnel in args, print the tunnels it returns,
+// stops at the first error
+func forEachTunnel(ctx context.Context, o *options, args []string, op func(c *client.Client, id uint64) (client.Tunnel, error)) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	tunnels := []client.Tunnel{}
+	for _, id := range ids {
+		t, err := op(c, id)
+		if err != nil {
+			return fmt.Errorf("tunnel %v: %w", id, err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return printOutput(o, map[string]interface{}{"tunnels": tunnels}, tunnelRows(tunnels))
+}
+
+func runEnable(ctx context.Context, o *options, args []string) error {
+	return forEachTunnel(ctx, o, args, func(c *client.Client, id uint64) (client.Tunnel, error) {
+		return c.EnableTunnel(ctx, id)
+	})
+}
+
+func runDisable(ctx context.Context, o *options, args []string) error {
+	return forEachTunnel(ctx, o, args, func(c *client.Client, id uint64) (client.Tunnel, error) {
+		return c.DisableTunnel(ctx, id)
+	})
+}
+
+func runDelete(ctx context.Context, o *options, args []string) error {
+	return forEachTunnel(ctx, o, args, func(c *client.Client, id uint64) (client.Tunnel, error) {
+		t, err := c.GetTunnel(ctx, id)
+		if err != nil {
+			return t, err
+		}
+		return t, c.DeleteTunnel(ctx, id)
+	})
+}
+
+func runConnections(ctx context.Context, o *options, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return usageError("connections takes one tunnel ID")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	conns, err := c.ListConnections(ctx, ids[0])
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"ID", "CLIENT", "DESTS", "STARTED", "SENT", "RECEIVED"}}
+	for _, ci := range conns {
+		rows = append(rows, []string{fmt.Sprint(ci.ID), ci.Client, strings.Join(ci.Dests, ","), formatTime(ci.Started), fmt.Sprint(ci.BytesSent), fmt.Sprint(ci.BytesReceived)})
+	}
+	return printOutput(o, map[string]interface{}{"connections": conns}, rows)
+}
+
+func runKill(ctx context.Context, o *options, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := c.CloseConnection(ctx, id); err != nil {
+			return fmt.Errorf("connection %v: %w", id, err)
+		}
+	}
+	return nil
+}
+
+type stats struct {
+	Tunnels  int                `json:"tunnels"`
+	Enabled  int                `json:"enabled"`
+	Failed   int                `json:"failed"` // with error
+	Traffic  []tunnelTraffic    `json:"traffic"`
+	Draining []client.DrainInfo `json:"draining"`
+}
+
+type tunnelTraffic struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	client.TunnelStats
+}
+
+func runStats(ctx context.Context, o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("stats takes no arguments")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	tunnels, err := c.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+	s := stats{Tunnels: len(tunnels), Traffic: []tunnelTraffic{}}
+	for _, t := range tunnels {
+		if t.Enable {
+			s.Enabled++
+		}
+		if t.Error != "" {
+			s.Failed++
+		}
+		tt := tunnelTraffic{ID: t.ID, Name: t.Name}
+		if t.Stats != nil {
+			tt.TunnelStats = *t.Stats
+		}
+		s.Traffic = append(s.Traffic, tt)
+	}
+	if s.Draining, err = c.ListDraining(ctx); err != nil {
+		return err
+	}
+
+	draining := 0
+	for _, d := range s.Draining {
+		draining += d.Connections
+	}
+	rows := [][]string{
+		{"TUNNELS", "ENABLED", "FAILED", "DRAINING CONNECTIONS"},
+		{fmt.Sprint(s.Tunnels), fmt.Sprint(s.Enabled), fmt.Sprint(s.Failed), fmt.Sprint(draining)},
+	}
+	if len(s.Traffic) != 0 {
+		rows = append(rows, nil, []string{"ID", "NAME", "ACTIVE", "TOTAL", "SENT", "RECEIVED", "SEND RATE", "RECEIVE RATE", "LAST ACTIVITY"})
+		for _, t := range s.Traffic {
+			last := "-"
+			if t.LastActivity != nil {
+				last = formatTime(*t.LastActivity)
+			}
+			rows = append(rows, []string{fmt.Sprint(t.ID), t.Name, fmt.Sprint(t.ActiveConnections), fmt.Sprint(t.TotalConnections),
+				fmt.Sprint(t.BytesSent), fmt.Sprint(t.BytesReceived), fmt.Sprintf("%.0f/s", t.SendRate), fmt.Sprintf("%.0f/s", t.ReceiveRate), last})
+		}
+	}
+	if len(s.Draining) != 0 {
+		rows = append(rows, nil, []string{"SOURCE", "DEST", "CONNECTIONS", "DEADLINE"})
+		for _, d := range s.Draining {
+			rows = append(rows, []string{d.Source, d.Dest, fmt.Sprint(d.Connections), formatTime(d.Deadline)})
+		}
+	}
+	return printOutput(o, s, rows)
+}
+
+func logsFlags(fs *flag.FlagSet, o *options) {
+	fs.Uint64Var(&o.tunnel, "tunnel", 0, "only list logs of the source of tunnel with this ID")
+	fs.BoolVar(&o.raw, "raw", false, "print the capture at PATH as is, instead of converting it")
+}
+
+func runLogs(ctx context.Context, o *options, args []string) error {
+	if len(args) > 1 {
+		return usageError("logs takes at most one PATH")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		r, err := c.OpenLog(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if o.raw {
+			_, err = io.Copy(o.stdout, r)
+			return err
+		}
+		return printCapture(o, r)
+	}
+
+	logs, err := c.ListLogs(ctx)
+	if err != nil {
+		return err
+	}
+	if o.set["tunnel"] {
+		t, err := c.GetTunnel(ctx, o.tunnel)
+		if err != nil {
+			return err
+		}
+		logs = logsOf(logs, t)
+	}
+	rows := [][]string{{"PATH", "CONNECTION", "SIZE", "MODIFIED"}}
+	for _, l := range logs {
+		rows = append(rows, []string{l.Path, fmt.Sprint(l.Connection), fmt.Sprint(l.Size), formatTime(l.Modified)})
+	}
+	return printOutput(o, map[string]interface{}{"logs": logs}, rows)
+}
+
+// logs of the source of tunnel t, with traffic of all its dests, logs are
+// named by listening address(e.g. [::]:3300) instead of source(e.g.
+// localhost:3300)
+func logsOf(logs []client.LogFile, t client.Tunnel) []client.LogFile {
+	_, port, _ := net.SplitHostPort(t.Source)
+	ret := []client.LogFile{}
+	for _, l := range logs {
+		_, lport, _ := net.SplitHostPort(l.Source)
+		if lport == port {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+func captureFlags(fs *flag.FlagSet, o *options) {
+	fs.BoolVar(&o.off, "off", false, "stop capturing the tunnel, even if gpcore runs with -log")
+	fs.BoolVar(&o.reset, "reset", false, "capture the tunnel as configured by logs of gpcore again")
+	fs.StringVar(&o.clients, "clients", "", "only capture these clients, comma separated CIDRs or IPs, e.g. 10.0.0.0/8,192.168.1.2")
+	fs.StringVar(&o.direct, "direction", "", "only capture send(client to dest) or recv")
+	fs.Uint64Var(&o.maxBytes, "max-bytes", 0, "bytes of data to capture per connection, 0 for no limit")
+}
+
+func runCapture(ctx context.Context, o *options, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return usageError("capture takes one tunnel ID")
+	}
+	if o.off && o.reset {
+		return usageError("-off and -reset can not be used together")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	var t client.Tunnel
+	if o.reset {
+		t, err = c.ResetCapture(ctx, ids[0])
+	} else {
+		request := client.CaptureConfig{Enable: !o.off, Direction: o.direct, MaxBytes: o.maxBytes}
+		if o.clients != "" {
+			request.Clients = strings.Split(o.clients, ",")
+		}
+		t, err = c.SetCapture(ctx, ids[0], request)
+	}
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"ID", "NAME", "CAPTURE", "CLIENTS", "DIRECTION", "MAX BYTES"}}
+	if t.Capture == nil {
+		rows = append(rows, []string{fmt.Sprint(t.ID), t.Name, "default", "", "", ""})
+	} else {
+		rows = append(rows, []string{fmt.Sprint(t.ID), t.Name, fmt.Sprint(t.Capture.Enable), strings.Join(t.Capture.Clients, ","), t.Capture.Direction, fmt.Sprint(t.Capture.MaxBytes)})
+	}
+	return printOutput(o, t, rows)
+}
+
+func pcapFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.write, "w", "", "write to this file instead of stdout")
+}
+
+func runPcap(ctx context.Context, o *options, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 2 {
+		return usageError("pcap takes one ID and one CONNECTION_ID")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	r, err := c.ExportPcapng(ctx, ids[0], ids[1])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeOutput(o, r)
+}
+
+// copy r to the file of -w, or stdout
+func writeOutput(o *options, r io.Reader) error {
+	if o.write == "" {
+		_, err := io.Copy(o.stdout, r)
+		return err
+	}
+	f, err := os.Create(o.write)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func convertFlags(fs *flag.FlagSet, o *options) {
+	fs.BoolVar(&o.pcapng, "pcapng", false, "convert to pcapng, e.g. for Wireshark")
+	fs.StringVar(&o.write, "w", "", "with -pcapng, write to this file instead of stdout")
+}
+
+func runConvert(ctx context.Context, o *options, args []string) error {
+	if len(args) != 1 {
+		return usageError("convert takes one FILE")
+	}
+	var r io.Reader = o.stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if !o.pcapng {
+		return printCapture(o, r)
+	}
+
+	cr, err := capture.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		w, err := capture.NewPcapngWriter(pw)
+		if err == nil {
+			err = w.WriteCapture(cr)
+		}
+		pw.CloseWithError(err)
+	}()
+	return writeOutput(o, pr)
+}
+
+// print capture in r as a transcript, or its header and frames in JSON or YAML
+func printCapture(o *options, r io.Reader) error {
+	cr, err := capture.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if o.output == "table" {
+		return capture.WriteText(o.stdout, cr)
+	}
+	frames, err := capture.ReadAll(cr)
+	if err != nil {
+		return err
+	}
+	return printOutput(o, map[string]interface{}{"header": cr.Header(), "frames": frames}, nil)
+}
+
+// a tunnel in export
+type exported struct {
+	Name   string `json:"name" yaml:"name"`
+	Source string `json:"source" yaml:"source"`
+	Dest   string `json:"dest" yaml:"dest"`
+	Enable bool   `json:"enable" yaml:"enable"`
+}
+
+func runExport(ctx context.Context, o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("export takes no arguments")
+	}
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	tunnels, err := c.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+	ret := []exported{}
+	for _, t := range tunnels {
+		ret = append(ret, exported{Name: t.Name, Source: t.Source, Dest: t.Dest, Enable: t.Enable})
+	}
+	if o.output == "table" { // not importable
+		o.output = "yaml"
+	}
+	return printOutput(o, ret, nil)
+}
+
+func runImport(ctx context.Context, o *options, args []string) error {
+	if len(args) != 1 {
+		return usageError("import takes one FILE")
+	}
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = io.ReadAll(o.stdin)
+	} else {
+		b, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	tunnels := []exported{}
+	if err := yaml.Unmarshal(b, &tunnels); err != nil { // JSON is YAML
+		return usageError(fmt.Sprintf("invalid export in %v: %v", args[0], err))
+	}
+
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	type result struct {
+		exported `yaml:",inline"`
+		ID       uint64 `json:"id,omitempty" yaml:"id,omitempty"`
+		Result   string `json:"result" yaml:"result"` // created, exists, or error
+	}
+	results := []result{}
+	rows := [][]string{{"ID", "NAME", "SOURCE", "DEST", "RESULT"}}
+	var firstErr error
+	failed := 0
+	for _, e := range tunnels {
+		enable := e.Enable
+		t, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: e.Name, Source: e.Source, Dest: e.Dest, Enable: &enable})
+		r := result{exported: e, ID: t.ID, Result: "created"}
+		if client.ErrorCode(err) == client.CodeAlreadyExists {
+			r.Result = "exists"
+		} else if err != nil {
+			r.Result = err.Error()
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		results = append(results, r)
+		id := ""
+		if r.ID != 0 {
+			id = fmt.Sprint(r.ID)
+		}
+		rows = append(rows, []string{id, e.Name, e.Source, e.Dest, r.Result})
+	}
+	if err := printOutput(o, map[string]interface{}{"results": results}, rows); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%v of %v tunnels failed to import: %w", failed, len(tunnels), firstErr)
+	}
+	return nil
+}
+
+func runCompletion(ctx context.Context, o *options, args []string) error {
+	if len(args) != 1 {
+		return usageError("completion takes one of bash, zsh and fish")
+	}
+	if _, ok := completionScripts[args[0]]; !ok {
+		return usageError(fmt.Sprintf("unsupported shell %q", args[0]))
+	}
+	_, err := io.WriteString(o.stdout, completionScript(args[0]))
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// %[1]v is command names, %[2]v is a case clause per command
+// listing its flags, see completionScript()
+var completionScripts = map[string]string{
+	"bash": `# bash completion for gpctl, e.g. source <(gpctl completion bash)
+_gpctl() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" words
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "%[1]v help" -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+%[2]v    esac
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "$words" -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+    edit|enable|disable|delete|connections|capture|pcap)
+        COMPREPLY=($(compgen -W "$(gpctl __ids 2>/dev/null)" -- "$cur")) ;;
+    completion)
+        COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")) ;;
+    import|convert)
+        COMPREPLY=($(compgen -f -- "$cur")) ;;
+    esac
+}
+complete -F _gpctl gpctl
+`,
+	"zsh": `#compdef gpctl
+# zsh completion for gpctl, e.g. gpctl completion zsh > "${fpath[1]}/_gpctl"
+_gpctl() {
+    local -a words_
+    if (( CURRENT == 2 )); then
+        compadd -- %[1]v help
+        return
+    fi
+    case "${words[2]}" in
+%[2]v    esac
+    if [[ "${words[CURRENT]}" == -* ]]; then
+        compadd -- ${=words_}
+        return
+    fi
+    case "${words[2]}" in
+    edit|enable|disable|delete|connections|capture|pcap)
+        compadd -- $(gpctl __ids 2>/dev/null) ;;
+    completion)
+        compadd -- bash zsh fish ;;
+    import|convert)
+        _files ;;
+    esac
+}
+compdef _gpctl gpctl
+`,
+	"fish": `# fish completion for gpctl, e.g. gpctl completion fish > ~/.config/fish/completions/gpctl.fish
+complete -c gpctl -f
+complete -c gpctl -n __fish_use_subcommand -a "%[1]v help"
+%[2]vcomplete -c gpctl -n "__fish_seen_subcommand_from edit enable disable delete connections capture pcap" -a "(gpctl __ids 2>/dev/null)"
+complete -c gpctl -n "__fish_seen_subcommand_from completion" -a "bash zsh fish"
+complete -c gpctl -n "__fish_seen_subcommand_from import convert" -F
+`,
+}
+
+// names of flags of cmd, with a leading -
+func commandFlags(cmd command) []string {
+	o := &options{}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	commonFlags(fs, o)
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	ret := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		ret = append(ret, "-"+f.Name)
+	})
+	return ret
+}
+
+// completion script of shell, which must be in completionScripts
+func completionScript(shell string) string {
+	names := []string{}
+	clauses := ""
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+		flags := commandFlags(cmd)
+		switch shell {
+		case "bash":
+			clauses += fmt.Sprintf("    %v) words=%q ;;\n", cmd.name, strings.Join(flags, " "))
+		case "zsh":
+			clauses += fmt.Sprintf("    %v) words_=%q ;;\n", cmd.name, strings.Join(flags, " "))
+		case "fish":
+			for _, f := range flags {
+				clauses += fmt.Sprintf("complete -c gpctl -n \"__fish_seen_subcommand_from %v\" -o %v\n", cmd.name, f[1:])
+			}
+		}
+	}
+	return fmt.Sprintf(completionScripts[shell], strings.Join(names, " "), clauses)
+}
+
+// tunnel IDs for completion scripts
+func runIDs(ctx context.Context, o *options, args []string) error {
+	c, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	tunnels, err := c.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		fmt.Fprintln(o.stdout, t.ID)
+	}
+	return nil
+}
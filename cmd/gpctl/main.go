@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/capture"
+	"github.com/goverclock/gopolar/pkg/client"
+)
+
+// exit codes
+const (
+	exitOK           = 0
+	exitFailure      = 1 // e.g. gpcore is not running
+	exitUsage        = 2
+	exitDenied       = 3 // unauthenticated or permission denied
+	exitNotFound     = 4
+	exitConflict     = 5 // already exists, or failed precondition
+	exitInvalidInput = 6
+)
+
+// usage error, exits with exitUsage
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+type command struct {
+	name    string
+	args    string // e.g. ID...
+	summary string
+	flags   func(fs *flag.FlagSet, o *options) // extra flags, may be nil
+	run     func(ctx context.Context, o *options, args []string) error
+}
+
+var commands []command
+
+// for completion scripts, not listed in usage
+var idsCommand = command{name: "__ids", summary: "print tunnel IDs", run: runIDs}
+
+func init() {
+	commands = []command{
+		{"list", "", "list tunnels", nil, runList},
+		{"create", "NAME SOURCE DEST", "create a tunnel", createFlags, runCreate},
+		{"edit", "ID", "change name, source or dest of a tunnel", editFlags, runEdit},
+		{"enable", "ID...", "start tunnels", nil, runEnable},
+		{"disable", "ID...", "stop tunnels", nil, runDisable},
+		{"delete", "ID...", "delete tunnels", nil, runDelete},
+		{"connections", "ID", "list client connections of a tunnel", nil, runConnections},
+		{"kill", "CONNECTION_ID...", "close client connections", nil, runKill},
+		{"stats", "", "show number of tunnels, their traffic and draining connections", nil, runStats},
+		{"logs", "[PATH]", "list captures of connections, or print the one at PATH", logsFlags, runLogs},
+		{"capture", "ID", "capture traffic of a tunnel, or stop with -off", captureFlags, runCapture},
+		{"pcap", "ID CONNECTION_ID", "export the capture of a client connection of a tunnel as pcapng, one TCP connection per dest", pcapFlags, runPcap},
+		{"convert", "FILE", "print a capture file as text, JSON, YAML or pcapng, - for stdin", convertFlags, runConvert},
+		{"export", "", "print tunnels for import, in JSON or YAML", nil, runExport},
+		{"import", "FILE", "create tunnels from export in FILE, - for stdin", nil, runImport},
+		{"completion", "bash|zsh|fish", "print shell completion script", nil, runCompletion},
+	}
+}
+
+// flags of all commands
+type options struct {
+	instance string
+	config   string
+	socket   string
+	addr     string
+	token    string
+	output   string
+	timeout  time.Duration
+
+	// of some commands
+	disabled bool
+	name     string
+	source   string
+	dest     string
+	tunnel   uint64
+	raw      bool
+	pcapng   bool
+	write    string
+	off      bool
+	reset    bool
+	clients  string
+	direct   string
+	maxBytes uint64
+	set      map[string]bool // flags set on command line
+
+	stdout io.Writer
+	stdin  io.Reader
+}
+
+func commonFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.instance, "instance", os.Getenv("GOPOLAR_INSTANCE"), "name of gpcore instance to connect to")
+	fs.StringVar(&o.config, "config", "", "gpcore config file to find its socket and token, default gpcore.toml in data directory of the instance")
+	fs.StringVar(&o.socket, "socket", "", "gpcore unix domain socket, overrides config file")
+	fs.StringVar(&o.addr, "addr", os.Getenv("GOPOLAR_ADDR"), "connect to gpcore on TCP instead, e.g. http://localhost:7070")
+	fs.StringVar(&o.token, "token", os.Getenv("GOPOLAR_TOKEN"), "API token, default the token file of gpcore")
+	fs.StringVar(&o.output, "o", "table", "output format: table, json or yaml")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "timeout of the command")
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "gpctl controls tunnels of gpcore.")
+	fmt.Fprintln(w, "\nUsage:\n  gpctl COMMAND [flags] [args]\n\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-28v %v\n", strings.TrimSpace(c.name+" "+c.args), c.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'gpctl COMMAND -h' for flags of a command.")
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// returns exit code
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stdout)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	var cmd *command
+	if args[0] == idsCommand.name {
+		cmd = &idsCommand
+	}
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "gpctl: unknown command %q\n\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+
+	o := &options{stdout: stdout, stdin: stdin, set: make(map[string]bool)}
+	fs := flag.NewFlagSet("gpctl "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: gpctl %v [flags] %v\n\n%v\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	commonFlags(fs, o)
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	if err := fs.Parse(interspersed(fs, args[1:])); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	fs.Visit(func(f *flag.Flag) { o.set[f.Name] = true })
+	if o.output != "table" && o.output != "json" && o.output != "yaml" {
+		fmt.Fprintf(stderr, "gpctl: invalid output format %q\n", o.output)
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	err := cmd.run(ctx, o, fs.Args())
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(stderr, "gpctl:", err)
+	return exitCode(err)
+}
+
+// move flags after positional arguments to the front, as flag stops at
+// the first positional argument
+func interspersed(fs *flag.FlagSet, args []string) []string {
+	flags, positional := []string{}, []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if len(a) < 2 || a[0] != '-' {
+			positional = append(positional, a)
+			continue
+		}
+		flags = append(flags, a)
+		name := strings.TrimLeft(a, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		// the next argument is the value, unless it's a bool flag
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			continue
+		}
+		if i+1 < len(args) {
+			flags = append(flags, args[i+1])
+			i++
+		}
+	}
+	return append(flags, positional...)
+}
+
+func exitCode(err error) int {
+	var ue usageError
+	if errors.As(err, &ue) {
+		return exitUsage
+	}
+	if errors.Is(err, capture.ErrFormat) {
+		return exitInvalidInput
+	}
+	switch client.ErrorCode(err) {
+	case client.CodeUnauthenticated, client.CodePermissionDenied:
+		return exitDenied
+	case client.CodeNotFound:
+		return exitNotFound
+	case client.CodeAlreadyExists, client.CodeFailedPrecondition:
+		return exitConflict
+	case client.CodeInvalidArgument:
+		return exitInvalidInput
+	}
+	return exitFailure
+}
+
+func newClient(o *options) (*client.Client, error) {
+	var c *client.Client
+	if o.addr != "" {
+		c = client.NewHTTP(o.addr)
+		// the token file is still found by config
+		if o.token == "" {
+			cfg, err := core.LoadInstanceConfig(o.instance, o.config)
+			if err != nil {
+				return nil, err
+			}
+			c.SetToken(cfg.Token())
+		}
+	} else {
+		cfg, err := core.LoadInstanceConfig(o.instance, o.config)
+		if err != nil {
+			return nil, err
+		}
+		if o.socket != "" {
+			cfg.SocketPath = o.socket
+		}
+		c = client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	}
+	if o.token != "" {
+		c.SetToken(o.token)
+	}
+	return c, nil
+}
+
+func parseIDs(args []string) ([]uint64, error) {
+	if len(args) == 0 {
+		return nil, usageError("ID must be specified")
+	}
+	ret := []uint64{}
+	for _, a := range args {
+		id, err := strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			return nil, usageError(fmt.Sprintf("invalid ID %q", a))
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
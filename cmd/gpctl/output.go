@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// print v in JSON or YAML with the same keys, or rows as a table,
+// whose first row is the header, a nil row separates tables
+func printOutput(o *options, v interface{}, rows [][]string) error {
+	switch o.output {
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(o.stdout, string(b))
+		return err
+	case "yaml":
+		b, err := toYAML(v)
+		if err != nil {
+			return err
+		}
+		_, err = o.stdout.Write(b)
+		return err
+	}
+
+	w := tabwriter.NewWriter(o.stdout, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// YAML of v with keys in its JSON, in the same order
+func toYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	node := yaml.Node{}
+	if err := yaml.Unmarshal(b, &node); err != nil { // JSON is YAML
+		return nil, err
+	}
+	blockStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+// use block style instead of flow style of JSON, strings are still quoted
+// when needed, as they are tagged !!str
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(time.RFC3339)
+}
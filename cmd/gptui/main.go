@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 
+	"github.com/goverclock/gopolar/internal/core"
 	"github.com/goverclock/gopolar/internal/tui"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -16,7 +18,19 @@ func setup() {
 
 func main() {
 	setup()
-	end := tui.NewCLIEnd()
+	instancePtr := flag.String("instance", os.Getenv("GOPOLAR_INSTANCE"), "name of gpcore instance to connect to")
+	configPtr := flag.String("config", "", "gpcore config file to find its socket, default gpcore.toml in data directory of the instance")
+	socketPtr := flag.String("socket", "", "gpcore unix domain socket, overrides config file")
+	flag.Parse()
+
+	cfg, err := core.LoadInstanceConfig(*instancePtr, *configPtr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *socketPtr != "" {
+		cfg.SocketPath = *socketPtr
+	}
+	end := tui.NewCLIEndWithConfig(cfg)
 	m := tui.NewUIModel(end)
 	if _, err := tea.NewProgram(m).Run(); err != nil {
 		log.Println("fail to setup UI model", err)
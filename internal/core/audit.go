@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// who made a change to tunnels, recorded in audit log
+type Caller struct {
+	Source  string  `json:"source"`             // api, reload, or local for calls in gpcore itself
+	Token   string  `json:"token,omitempty"`    // name of API token, "default" for the token file
+	TokenID uint64  `json:"token_id,omitempty"` // 0 for the token file
+	UID     *uint32 `json:"uid,omitempty"`      // caller on unix domain socket
+	Remote  string  `json:"remote,omitempty"`   // caller on TCP
+}
+
+var (
+	localCaller  = Caller{Source: "local"}
+	reloadCaller = Caller{Source: "reload"}
+)
+
+// one line in audit.jsonl
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"` // add, change, toggle, enable, disable, remove or capture
+	Caller   Caller    `json:"caller"`
+	TunnelID uint64    `json:"tunnel_id"` // 0 if add fails
+	Before   *Tunnel   `json:"before"`    // null for add
+	After    *Tunnel   `json:"after"`     // null for remove
+	Error    string    `json:"error,omitempty"`
+}
+
+// open audit.jsonl for appending, nil if audit is disabled or it fails
+func openAudit(cfg Config) *os.File {
+	if !cfg.Audit {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		log.Println("fail to create data dir, audit log disabled:", err)
+		return nil
+	}
+	f, err := os.OpenFile(cfg.auditPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("fail to open audit log, audit log disabled:", err)
+		return nil
+	}
+	return f
+}
+
+// tm.mu must be held,
+// copy of tunnel id, nil if not exist
+func (tm *TunnelManager) snapshotL(id uint64) *Tunnel {
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return nil
+	}
+	ret := *t
+	return &ret
+}
+
+// tm.mu must be held,
+// defer it when an operation on tunnel *id starts, with the tunnel before
+// the operation, and the error returned by the operation,
+// the operation is published as an event, and written to audit log
+func (tm *TunnelManager) recordL(c Caller, op string, id *uint64, before *Tunnel, err *error) {
+	after := tm.snapshotL(*id)
+	tm.events.Publish(tunnelEvent(op, before, after, *err))
+	if tm.audit == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Op:       op,
+		Caller:   c,
+		TunnelID: *id,
+		Before:   before,
+		After:    after,
+	}
+	if *err != nil {
+		entry.Error = (*err).Error()
+	}
+	b, merr := json.Marshal(entry)
+	if merr != nil {
+		log.Println("fail to encode audit entry:", merr)
+		return
+	}
+	if _, werr := tm.audit.Write(append(b, '\n')); werr != nil {
+		log.Println("fail to write audit log:", werr)
+	}
+}
+
+// audit entries in [since, until), zero time means no limit,
+// in the order they are recorded
+func (tm *TunnelManager) GetAudit(since time.Time, until time.Time) ([]AuditEntry, error) {
+	ret := []AuditEntry{}
+	if !tm.config.Audit {
+		return ret, errorf(CodeFailedPrecondition, "audit log is disabled")
+	}
+	f, err := os.Open(tm.config.auditPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return ret, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// e.g. the last line being written
+			Debugf("[audit] skip invalid line: %v\n", err)
+			continue
+		}
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !entry.Time.Before(until) {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret, scanner.Err()
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// read API token from path, generate a random one if not exist
+func loadOrCreateToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("token file %v is empty", path)
+		}
+		return token, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	token, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("fail to save token: %w", err)
+	}
+	return token, nil
+}
+
+// token sent in "Authorization: Bearer <token>" header, empty if missing
+func bearerToken(ctx *gin.Context) string {
+	h := ctx.GetHeader("Authorization")
+	token, ok := strings.CutPrefix(h, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// scope required by routes, keyed by method and route path,
+// routes not listed here require ScopeAdmin
+var routeScopes = map[string]Scope{
+	"GET /tunnels/list":        ScopeRead,
+	"GET /about":               ScopeRead,
+	"GET /events":              ScopeRead,
+	"GET /metrics":             ScopeRead,
+	"POST /tunnels/toggle/:id": ScopeOperate,
+
+	"GET /api/v2/tunnels":                 ScopeRead,
+	"GET /api/v2/tunnels/:id":             ScopeRead,
+	"GET /api/v2/tunnels/:id/connections": ScopeRead,
+	"GET /api/v2/draining":                ScopeRead,
+	"GET /api/v2/about":                   ScopeRead,
+	"POST /api/v2/tunnels/:id/enable":     ScopeOperate,
+	"POST /api/v2/tunnels/:id/disable":    ScopeOperate,
+	"DELETE /api/v2/connections/:id":      ScopeOperate,
+}
+
+func requiredScope(method string, route string) Scope {
+	if s, ok := routeScopes[method+" "+route]; ok {
+		return s
+	}
+	return ScopeAdmin
+}
+
+// reject requests without valid token, or whose token's scope is not
+// enough for the route, when config.Auth is set,
+// tm.token must be set before serving
+func (tm *TunnelManager) authMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !tm.config.Auth || publicRoutes[ctx.Request.Method+" "+ctx.FullPath()] {
+			ctx.Next()
+			return
+		}
+		token := bearerToken(ctx)
+		tm.mu.Lock()
+		t, ok := tm.lookupTokenL(token)
+		tm.mu.Unlock()
+		if token == "" || !ok {
+			abortWithError(ctx, http.StatusUnauthorized, "missing or invalid API token, see "+tm.config.TokenPath())
+			return
+		}
+		required := requiredScope(ctx.Request.Method, ctx.FullPath())
+		if !t.Scope.Allows(required) {
+			abortWithError(ctx, http.StatusForbidden, fmt.Sprintf("token of scope %v is not allowed, requires %v", t.Scope, required))
+			return
+		}
+		ctx.Set(tokenKey, t)
+		ctx.Next()
+	}
+}
+
+// key in gin.Context of the APIToken used by the request
+const tokenKey = "gopolar.token"
+
+// who sent the request, for audit log
+func callerOf(ctx *gin.Context) Caller {
+	c := Caller{Source: "api"}
+	if v, ok := ctx.Get(tokenKey); ok {
+		t := v.(APIToken)
+		c.Token = t.Name
+		c.TokenID = t.ID
+	}
+	if r, ok := ctx.Request.Context().Value(peerCredKey{}).(peerCredResult); ok {
+		if r.err == nil {
+			c.UID = &r.cred.UID
+		}
+	} else {
+		c.Remote = ctx.Request.RemoteAddr
+	}
+	return c
+}
+
+// reject requests from non-loopback addresses on TCP,
+// requests on unix domain socket are always local
+func loopbackMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+		if err != nil { // not an ip:port, from unix domain socket
+			ctx.Next()
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			abortWithError(ctx, http.StatusForbidden, "only loopback clients are allowed")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// address for HTTPListen with loopback host,
+// an empty host is bound to 127.0.0.1, others must be loopback
+func loopbackListen(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("http_listen %v is not a loopback address, while loopback_only is set", listen)
+	}
+	return listen, nil
+}
+
+// stop handling the request, respond in the same shape as other API
+func abortWithError(ctx *gin.Context, code int, msg string) {
+	if isV2(ctx) {
+		abortMiddlewareV2(ctx, code, msg)
+		return
+	}
+	var response struct {
+		Success bool   `json:"success"`
+		ErrMsg  string `json:"err_msg"`
+		Data    struct {
+		} `json:"data"`
+	}
+	response.ErrMsg = msg
+	ctx.AbortWithStatusJSON(code, response)
+}
@@ -1,61 +1,435 @@
 package core
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gin-contrib/cors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
+// configuration of gpcore, see LoadConfig() for where it comes from,
+// keys in config file are in mapstructure tags
 type Config struct {
-	DoLogs    bool
-	ReadSaved bool
+	Instance string `mapstructure:"-"` // see InstanceConfig()
+
+	// capture all tunnels, unless overridden by Tunnel.Capture
+	DoLogs    bool `mapstructure:"logs"`
+	ReadSaved bool `mapstructure:"read_saved"`
+	// how long existing connections may keep running after their tunnel
+	// is disabled, edited or deleted, 0 to close them immediately
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+	HTTPListen string `mapstructure:"http_listen"` // e.g. :7070, empty to disable
+	SocketPath string `mapstructure:"socket_path"` // unix domain socket for gptui
+	DataDir    string `mapstructure:"data_dir"`    // tunnels.toml is saved here
+	LogDir     string `mapstructure:"log_dir"`     // default to logs/ in DataDir
+	WebUIPath  string `mapstructure:"webui_path"`  // built web UI, served at /
+
+	// require API token(see TokenPath()) for all API requests
+	Auth bool `mapstructure:"auth"`
+	// origins allowed to call API from browser, "*" for any, empty for none
+	CORSOrigins []string `mapstructure:"cors_origins"`
+	// only accept API requests from loopback addresses on HTTPListen
+	LoopbackOnly bool `mapstructure:"loopback_only"`
+
+	// permission bits of SocketPath, 0 to keep the default(depends on umask)
+	SocketMode fs.FileMode `mapstructure:"socket_mode"`
+	// group name or gid owning SocketPath, empty to keep the default
+	SocketGroup string `mapstructure:"socket_group"`
+	// besides the user running gpcore, callers on SocketPath with these
+	// uids or primary gids are allowed, checked with SO_PEERCRED on linux
+	SocketAllowUIDs []uint32 `mapstructure:"socket_allow_uids"`
+	SocketAllowGIDs []uint32 `mapstructure:"socket_allow_gids"`
+
+	// record changes to tunnels in audit.jsonl in DataDir
+	Audit bool `mapstructure:"audit"`
+
+	TunnelDefaults TunnelDefaults `mapstructure:"tunnel_defaults"`
+	LogRetention   LogRetention   `mapstructure:"log_retention"`
+}
+
+// applied to tunnels created via API
+type TunnelDefaults struct {
+	Enable bool `mapstructure:"enable"`
+}
+
+// limits of captures in log dir, enforced every Interval and when gpcore
+// starts, oldest captures are removed first, captures being written are
+// never removed, 0 means no limit
+type LogRetention struct {
+	MaxAge        time.Duration `mapstructure:"max_age"`         // by modification time
+	MaxTotalSize  ByteSize      `mapstructure:"max_total_size"`  // of all captures
+	MaxTunnelSize ByteSize      `mapstructure:"max_tunnel_size"` // of captures of each tunnel source
+	// a capture is continued in a new file(see LogFile.Part) beyond this
+	MaxFileSize ByteSize `mapstructure:"max_file_size"`
+	// gzip captures once they are closed or rotated
+	Compress bool          `mapstructure:"compress"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// size in bytes, parsed from a number of bytes, or with unit K, M, G or T
+// in powers of 1024, optionally followed by B or iB, e.g. 64MB
+type ByteSize int64
+
+var byteSizeRegexp = regexp.MustCompile(`^([0-9]+)\s*([KMGT](?:IB|B)?)?$`)
+
+func (s *ByteSize) UnmarshalText(text []byte) error {
+	m := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(string(text))))
+	if m == nil {
+		return fmt.Errorf("invalid size %q, expect e.g. 1024, 512KB or 64MB", text)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", text, err)
+	}
+	if m[2] != "" {
+		n <<= 10 * (strings.IndexByte("KMGT", m[2][0]) + 1)
+	}
+	*s = ByteSize(n)
+	return nil
 }
 
 var DefaultConfig Config = Config{
-	DoLogs:    false,
-	ReadSaved: true,
-}
-
-// read tunnels from $HOME/.gopolar/tunnels.toml
-// create it if not exist
-func readTunnels() []Tunnel {
-	cfgDir := homeDir + "/.gopolar/"
-	cfgPath := cfgDir + "tunnels.toml"
-	viper.SetConfigName("tunnels")
-	viper.AddConfigPath(cfgDir)
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok { // config file not found, create it and try again
-			err = os.MkdirAll(cfgDir, 0700)
-			if err != nil {
-				log.Fatalln("fail to create config directory: " + cfgDir)
-			}
-			f, err := os.Create(cfgPath)
-			f.Close()
-			if err != nil {
-				log.Fatalln("fail to create config file:", err)
-			}
-			return nil
-		} else {
-			log.Fatalln("fail to read config file:", err)
+	DoLogs:       false,
+	ReadSaved:    true,
+	DrainTimeout: 30 * time.Second,
+	// in 1991, "Gopher" protocol uses 70 as its port
+	// see https://zh.wikipedia.org/wiki/Gopher_(%E7%BD%91%E7%BB%9C%E5%8D%8F%E8%AE%AE)
+	HTTPListen: ":7070",
+	SocketPath: "/tmp/gopolar.sock",
+	DataDir:    defaultDataDir(),
+	LogDir:     "", // follows DataDir
+	WebUIPath:  os.Getenv("GOPATH") + "/bin/gpwebui",
+
+	Auth:         true,
+	CORSOrigins:  []string{"*"},
+	LoopbackOnly: false,
+
+	SocketMode:      0600,
+	SocketGroup:     "",
+	SocketAllowUIDs: []uint32{},
+	SocketAllowGIDs: []uint32{},
+
+	Audit: true,
+
+	TunnelDefaults: TunnelDefaults{
+		Enable: true,
+	},
+	LogRetention: LogRetention{
+		MaxAge:        7 * 24 * time.Hour,
+		MaxTotalSize:  1 << 30,
+		MaxTunnelSize: 0,
+		MaxFileSize:   64 << 20,
+		Compress:      false,
+		Interval:      time.Minute,
+	},
+}
+
+// ~/.gopolar, or .gopolar in working directory if $HOME is unknown
+func defaultDataDir() string {
+	hd, err := os.UserHomeDir()
+	if err != nil {
+		return ".gopolar"
+	}
+	return filepath.Join(hd, ".gopolar")
+}
+
+var instanceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// defaults of a named instance, each instance has its own data directory,
+// unix domain socket and HTTP port, so several gpcore can run on one host,
+// the default instance is named "", and uses DefaultConfig,
+// the data directory is created to record the port if it does not exist,
+// see instancePort()
+func InstanceConfig(instance string) (Config, error) {
+	if instance == "" {
+		return DefaultConfig, nil
+	}
+	if !instanceNameRegexp.MatchString(instance) {
+		return DefaultConfig, fmt.Errorf("invalid instance name %q, only letters, digits, - and _ are allowed", instance)
+	}
+	port, err := instancePort(instance)
+	if err != nil {
+		return DefaultConfig, fmt.Errorf("fail to assign HTTP port of instance %q: %w", instance, err)
+	}
+	cfg := DefaultConfig
+	cfg.Instance = instance
+	cfg.HTTPListen = fmt.Sprintf(":%v", port)
+	cfg.SocketPath = fmt.Sprintf("/tmp/gopolar-%v.sock", instance)
+	cfg.DataDir = instanceDataDir(instance)
+	return cfg, nil
+}
+
+func instanceDataDir(instance string) string {
+	return filepath.Join(DefaultConfig.DataDir, "instances", instance)
+}
+
+// HTTP port of an instance, recorded in http_port of its data directory
+// the first time, so an instance always uses the same port unless configured,
+// a new instance gets the first port in [7071, 8070] starting from one
+// derived from its name, that is not recorded by any other instance
+func instancePort(instance string) (int, error) {
+	path := filepath.Join(instanceDataDir(instance), "http_port")
+	port, err := readInstancePort(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return port, err
+	}
+
+	used := make(map[int]bool)
+	entries, _ := os.ReadDir(filepath.Dir(instanceDataDir(instance)))
+	for _, e := range entries {
+		if p, err := readInstancePort(filepath.Join(instanceDataDir(e.Name()), "http_port")); err == nil {
+			used[p] = true
 		}
 	}
+	h := fnv.New32a()
+	h.Write([]byte(instance))
+	start := int(h.Sum32() % 1000)
+	for i := 0; i < 1000; i++ {
+		port = 7071 + (start+i)%1000
+		if !used[port] {
+			break
+		}
+	}
+	if used[port] {
+		return 0, fmt.Errorf("all ports in 7071-8070 are used by other instances")
+	}
 
-	// read tunnels from config file
-	ts, ok := viper.Get("tunnels").([]interface{})
-	ret := []Tunnel{}
-	if ok {
-		for _, t := range ts {
-			ti := t.(map[string]interface{})
-			res := Tunnel{}
-			if err := mapstructure.Decode(ti, &res); err != nil {
-				log.Fatal("fail to parse config file:", err)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) { // recorded by another process meanwhile
+		return readInstancePort(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = fmt.Fprintln(f, port)
+	return port, errors.Join(err, f.Close())
+}
+
+func readInstancePort(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port in %v: %q", path, b)
+	}
+	return port, nil
+}
+
+// path of config file when not specified: $GOPOLAR_CONFIG,
+// or gpcore.toml in data directory of the instance
+func ConfigPath(instance string) string {
+	if p := os.Getenv("GOPOLAR_CONFIG"); p != "" {
+		return p
+	}
+	if instance == "" || !instanceNameRegexp.MatchString(instance) {
+		return filepath.Join(DefaultConfig.DataDir, "gpcore.toml")
+	}
+	return filepath.Join(instanceDataDir(instance), "gpcore.toml")
+}
+
+// load config of the instance named by $GOPOLAR_INSTANCE,
+// see LoadInstanceConfig()
+func LoadConfig(path string) (Config, error) {
+	return LoadInstanceConfig(os.Getenv("GOPOLAR_INSTANCE"), path)
+}
+
+// load config from toml file at path, or ConfigPath(instance) if path is empty,
+// environment variables GOPOLAR_<KEY>(e.g. GOPOLAR_HTTP_LISTEN,
+// GOPOLAR_TUNNEL_DEFAULTS_ENABLE) override the file,
+// missing keys fall back to InstanceConfig(instance),
+// it's not an error if the file does not exist and path is not specified
+func LoadInstanceConfig(instance string, path string) (Config, error) {
+	def, err := InstanceConfig(instance)
+	if err != nil {
+		return def, err
+	}
+	explicit := path != "" || os.Getenv("GOPOLAR_CONFIG") != ""
+	if path == "" {
+		path = ConfigPath(instance)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	v.SetEnvPrefix("GOPOLAR")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	// AutomaticEnv only works for known keys
+	defaults := make(map[string]interface{})
+	if err := mapstructure.Decode(def, &defaults); err != nil {
+		return def, err
+	}
+	for k, val := range defaults {
+		if sub, ok := val.(map[string]interface{}); ok { // e.g. tunnel_defaults
+			for sk, sv := range sub {
+				v.SetDefault(k+"."+sk, sv)
 			}
-			ret = append(ret, res)
+			continue
 		}
-	} // else ts is nil
+		v.SetDefault(k, val)
+	}
 
-	return ret
+	if err := v.ReadInConfig(); err != nil {
+		if explicit || !errors.Is(err, fs.ErrNotExist) {
+			return def, fmt.Errorf("fail to read %v: %w", path, err)
+		}
+	}
+	cfg := Config{Instance: instance}
+	hook := mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.TextUnmarshallerHookFunc(), // e.g. ByteSize
+	)
+	if err := v.Unmarshal(&cfg, viper.DecodeHook(hook)); err != nil {
+		return def, fmt.Errorf("fail to parse %v: %w", path, err)
+	}
+	for _, p := range []*string{&cfg.SocketPath, &cfg.DataDir, &cfg.LogDir, &cfg.WebUIPath} {
+		*p = expandHome(*p)
+	}
+	corsCfg := cors.Config{AllowOrigins: cfg.CORSOrigins, AllowMethods: []string{"*"}}
+	if len(cfg.CORSOrigins) != 0 {
+		if err := corsCfg.Validate(); err != nil {
+			return def, fmt.Errorf("invalid cors_origins in %v: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// replace leading ~/ in path with $HOME
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	hd, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(hd, path[2:])
+}
+
+// path of tunnels.toml
+func (cfg Config) tunnelsPath() string {
+	return filepath.Join(cfg.DataDir, "tunnels.toml")
+}
+
+// file of API token, generated when gpcore starts if not exist
+func (cfg Config) TokenPath() string {
+	return filepath.Join(cfg.DataDir, "token")
+}
+
+// API token in TokenPath(), empty if it's not readable
+func (cfg Config) Token() string {
+	b, err := os.ReadFile(cfg.TokenPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
 
+// tokens created via API, see APIToken
+func (cfg Config) tokensPath() string {
+	return filepath.Join(cfg.DataDir, "tokens.toml")
+}
+
+// append-only log of changes to tunnels, see AuditEntry
+func (cfg Config) auditPath() string {
+	return filepath.Join(cfg.DataDir, "audit.jsonl")
+}
+
+// where ConnLogger writes, even if cfg.DoLogs is false since tunnels may
+// be captured on their own, empty if there is nowhere to write
+func (cfg Config) connLogDir() string {
+	if cfg.LogDir != "" {
+		return cfg.LogDir
+	}
+	if cfg.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.DataDir, "logs")
+}
+
+// read tunnels from tunnels.toml in cfg.DataDir,
+// create it if not exist,
+// tunnels that fail to parse are returned with Error set
+func readTunnels(cfg Config) ([]Tunnel, error) {
+	path := cfg.tunnelsPath()
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) { // config file not found, create it
+		if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+			return nil, fmt.Errorf("fail to create config directory: %w", err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("fail to create config file: %w", err)
+		}
+		f.Close()
+		return nil, nil
+	}
+
+	// read tunnels from config file
+	ret, err := parseTunnels(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read config file: %w", err)
+	}
+	return ret, nil
+}
+
+// save tunnels to path, overwriting it
+func writeTunnels(path string, tunnels []Tunnel) error {
+	v := viper.New()
+	v.Set("tunnels", tunnels)
+	return v.WriteConfigAs(path)
+}
+
+// read tunnels from path,
+// returns error if the file can not be read or parsed
+func parseTunnels(path string) ([]Tunnel, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return decodeTunnels(v.Get("tunnels"))
+}
+
+// decode value of "tunnels" key in tunnels.toml,
+// an entry that fails to decode is returned with Error set,
+// and other fields decoded as much as possible
+func decodeTunnels(value interface{}) ([]Tunnel, error) {
+	ret := []Tunnel{}
+	if value == nil { // no tunnels
+		return ret, nil
+	}
+	ts, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tunnels should be an array of tables, got %T", value)
+	}
+	for i, t := range ts {
+		res := Tunnel{}
+		ti, ok := t.(map[string]interface{})
+		if !ok {
+			res.Error = fmt.Sprintf("tunnel #%v should be a table, got %T", i+1, t)
+		} else if err := mapstructure.Decode(ti, &res); err != nil {
+			res.Error = fmt.Sprintf("fail to parse tunnel #%v: %v", i+1, err)
+		}
+		ret = append(ret, res)
+	}
+	return ret, nil
 }
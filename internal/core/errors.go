@@ -0,0 +1,40 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// kinds of errors, used as error codes in API v2
+const (
+	CodeInvalidArgument    = "invalid_argument"    // malformed request or tunnel
+	CodeUnauthenticated    = "unauthenticated"     // missing or invalid API token
+	CodePermissionDenied   = "permission_denied"   // not allowed by token scope or peer credentials
+	CodeNotFound           = "not_found"           // no such tunnel or token
+	CodeAlreadyExists      = "already_exists"      // tunnel with same source and dest exists
+	CodeFailedPrecondition = "failed_precondition" // e.g. source port is taken, audit is disabled
+	CodeInternal           = "internal"            // anything else
+)
+
+// error with a code, Error() is the message only
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorf(code string, format string, a ...interface{}) error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// code of err, CodeInternal if it has none
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
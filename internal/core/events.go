@@ -0,0 +1,174 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// interval of comments sent on idle event streams
+const eventPingInterval = 15 * time.Second
+
+// interval of tunnel.stats events
+const statsInterval = 2 * time.Second
+
+// types of Event
+const (
+	EventTunnelCreated = "tunnel.created"
+	EventTunnelChanged = "tunnel.changed"
+	EventTunnelToggled = "tunnel.toggled" // enabled or disabled
+	EventTunnelRemoved = "tunnel.removed"
+	EventConnOpened    = "connection.opened"
+	EventConnClosed    = "connection.closed"
+	EventDestDown      = "dest.down" // fail to dial a dest that was up
+	EventDestUp        = "dest.up"   // dial a dest that was down successfully
+	EventError         = "error"     // an operation on a tunnel failed
+	// stats of all tunnels every statsInterval, only to subscribers asking
+	// for them, see EventBus.SubscribeStats()
+	EventTunnelStats = "tunnel.stats"
+)
+
+type Event struct {
+	ID         uint64    `json:"id"` // increases by 1 for each event, tunnel.stats keeps the last one
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Op         string    `json:"op,omitempty"`         // error, operation that failed, see AuditEntry.Op
+	Tunnel     *Tunnel   `json:"tunnel,omitempty"`     // tunnel.*(but tunnel.stats) and error, the tunnel after the operation
+	Connection *ConnInfo `json:"connection,omitempty"` // connection.*
+	Source     string    `json:"source,omitempty"`     // dest.*
+	Dest       string    `json:"dest,omitempty"`       // dest.*
+	Error      string    `json:"error,omitempty"`      // dest.down and error
+	// tunnel.stats, tunnel ID -> its stats
+	Stats map[uint64]TunnelStats `json:"stats,omitempty"`
+}
+
+// a client connection to a tunnel source
+type ConnInfo struct {
+	ID            uint64    `json:"id"`     // unique while gpcore runs
+	Source        string    `json:"source"` // listening address, e.g. [::]:3300
+	Client        string    `json:"client"` // remote address of the client
+	Dests         []string  `json:"dests"`  // dests connected for this client
+	Started       time.Time `json:"started"`
+	BytesSent     uint64    `json:"bytes_sent"` // client to dests, counted once for all dests
+	BytesReceived uint64    `json:"bytes_received"`
+}
+
+// fan out events to subscribers, a nil *EventBus drops all events
+type EventBus struct {
+	subs   map[chan Event]bool // -> whether it receives tunnel.stats
+	nextID uint64
+	closed bool
+	mu     sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[chan Event]bool),
+	}
+}
+
+// never blocks, a subscriber too slow to keep up is unsubscribed,
+// with its channel closed
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.Type != EventTunnelStats { // not seen by all subscribers
+		b.nextID++
+	}
+	e.ID = b.nextID
+	e.Time = time.Now()
+	for ch, stats := range b.subs {
+		if e.Type == EventTunnelStats && !stats {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			Debugf("[events] subscriber is too slow, dropped\n")
+			close(ch)
+			delete(b.subs, ch)
+		}
+	}
+}
+
+// receive events published from now on except tunnel.stats, until cancel
+// is called, or the channel is closed(see Publish() and Close())
+func (b *EventBus) Subscribe() (events <-chan Event, cancel func()) {
+	return b.subscribe(false)
+}
+
+// Subscribe(), including tunnel.stats
+func (b *EventBus) SubscribeStats() (events <-chan Event, cancel func()) {
+	return b.subscribe(true)
+}
+
+func (b *EventBus) subscribe(stats bool) (events <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, 256)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = stats
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			close(ch)
+			delete(b.subs, ch)
+		}
+	}
+}
+
+// whether anyone receives tunnel.stats, so they are only collected if needed
+func (b *EventBus) WantsStats() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, stats := range b.subs {
+		if stats {
+			return true
+		}
+	}
+	return false
+}
+
+// close channels of all subscribers, no one can subscribe after this
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+}
+
+var opEventTypes = map[string]string{
+	"add":     EventTunnelCreated,
+	"change":  EventTunnelChanged,
+	"toggle":  EventTunnelToggled,
+	"enable":  EventTunnelToggled,
+	"disable": EventTunnelToggled,
+	"remove":  EventTunnelRemoved,
+	"capture": EventTunnelChanged,
+}
+
+// event of an operation on a tunnel, see recordL()
+func tunnelEvent(op string, before *Tunnel, after *Tunnel, err error) Event {
+	e := Event{Type: opEventTypes[op], Tunnel: after}
+	if after == nil { // removed
+		e.Tunnel = before
+	}
+	if err != nil {
+		e.Type = EventError
+		e.Op = op
+		e.Error = err.Error()
+	}
+	return e
+}
@@ -3,25 +3,64 @@ package core
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
 )
 
+// half-close state of a connS, a connS is fully closed only
+// when both directions are done
+type connState struct {
+	srcDone  bool            // connS sent FIN, propagated to all connD
+	destDone map[string]bool // connD sent FIN
+	finSent  bool            // all connD are done, propagated to connS
+
+	drain  map[string]time.Time // dest removed from forwarder -> when to close connD
+	opened map[string]time.Time // dest -> when connD was dialed
+	// dest -> stats counting connD, of the tunnel when connD was dialed
+	stats map[string]*forwardStats
+
+	id      uint64 // see ConnInfo
+	started time.Time
+	sent    uint64
+	recv    uint64
+	killed  bool // by Kill(), closed by copyRoutine()
+}
+
+// IDs of connections of all forwarders
+var lastConnID atomic.Uint64
+
 // forward one source to one or multiple dest
 type Forwarder struct {
 	src         net.Listener
 	dest        []string                           // only for new connection to src to set up
 	connections map[*net.Conn]map[string]*net.Conn // map[connSrc]map[dest]connDest
-	connLoggers map[*net.Conn]map[string]*ConnLogger
+	connLoggers map[*net.Conn]*ConnLogger
+	states      map[*net.Conn]*connState
+	config      Config
+	events      *EventBus
+	source      netip.AddrPort
+	stats       map[string]*forwardStats // dest -> its stats in metrics, kept after dest is removed
+	metrics     *Metrics
+	taps        *TapBus
+	destDown    map[string]bool           // last dial to dest failed
+	captures    map[string]*CaptureConfig // dest -> its capture, config.DoLogs if nil
 
-	quit bool
-	mu   sync.Mutex
+	closing bool // no dest remains, quit after all connections are closed
+	quit    bool
+	mu      sync.Mutex
 }
 
-func NewForwarder(source netip.AddrPort) (*Forwarder, error) {
+// connections and health of dests are published to events, traffic is
+// counted in metrics and published to taps, all may be nil
+func NewForwarder(source netip.AddrPort, cfg Config, events *EventBus, metrics *Metrics, taps *TapBus) (*Forwarder, error) {
 	src, err := net.Listen("tcp", ":"+fmt.Sprint(source.Port()))
 	if err != nil {
 		return nil, fmt.Errorf("fail to listen localhost:%v", source.Port())
@@ -30,7 +69,16 @@ func NewForwarder(source netip.AddrPort) (*Forwarder, error) {
 	fwd := &Forwarder{
 		src:         src,
 		connections: make(map[*net.Conn]map[string]*net.Conn),
-		connLoggers: make(map[*net.Conn]map[string]*ConnLogger),
+		connLoggers: make(map[*net.Conn]*ConnLogger),
+		states:      make(map[*net.Conn]*connState),
+		config:      cfg,
+		events:      events,
+		source:      source,
+		stats:       make(map[string]*forwardStats),
+		metrics:     metrics,
+		taps:        taps,
+		destDown:    make(map[string]bool),
+		captures:    make(map[string]*CaptureConfig),
 	}
 	go fwd.listen()
 	go fwd.copyRoutine()
@@ -42,23 +90,46 @@ func (fwd *Forwarder) Add(d string) {
 	fwd.mu.Lock()
 	defer fwd.mu.Unlock()
 	fwd.dest = append(fwd.dest, d)
+	// may differ from the one of a removed tunnel to d, whose connections
+	// are still draining
+	fwd.stats[d] = fwd.metrics.forward(fwd.source, d)
 	Debugf("[forward] new dest=%v\n", d)
 
 	// dial new dest for all existing connS
 	for cs := range fwd.connections {
-		connD, err := net.Dial("tcp", d)
+		if _, ok := fwd.states[cs].drain[d]; ok { // dest is back, stop draining
+			delete(fwd.states[cs].drain, d)
+			continue
+		}
+		connD, err := fwd.dialL(d)
 		if err != nil {
-			Debugf("[forward] fail to dial dest=%v for src=%v, err=%v\n", d, fwd.src.Addr(), err)
+			continue
+		}
+		if fwd.states[cs].srcDone { // client already sent FIN
+			closeWrite(connD)
 		}
-		fwd.connections[cs][d] = &connD
-		fwd.connLoggers[cs][d] = NewConnLogger(fwd.src.Addr().String(), d)
+		fwd.addConnDL(cs, d, connD)
 		Debugf("[forward] added dest=%v for src=%v\n", d, (*cs).RemoteAddr())
 	}
 }
 
+// capture connections to dest d accepted after this as c, or as
+// config.DoLogs if c is nil
+func (fwd *Forwarder) SetCapture(d string, c *CaptureConfig) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	if c == nil {
+		delete(fwd.captures, d)
+		return
+	}
+	fwd.captures[d] = c
+}
+
 // stop forwarding to a dest, does nothing if not found,
+// existing connections to the dest are closed after config.DrainTimeout,
 // return true if no dest remains after the operation,
-// in which case the forwarder should be deleted
+// in which case the forwarder stops accepting new connections
+// and quits after all existing connections are closed
 func (fwd *Forwarder) Remove(d string) bool {
 	fwd.mu.Lock()
 	defer fwd.mu.Unlock()
@@ -71,32 +142,117 @@ func (fwd *Forwarder) Remove(d string) bool {
 	}
 
 	// stop existing connections to this dest
+	deadline := time.Now().Add(fwd.config.DrainTimeout)
 	for cs := range fwd.connections {
+		if fwd.connections[cs][d] != nil && fwd.config.DrainTimeout > 0 {
+			fwd.states[cs].drain[d] = deadline
+			Debugf("[forward] draining existing connection: dest=%v for src=%v\n", d, fwd.src.Addr())
+			continue
+		}
 		if fwd.connections[cs][d] != nil {
-			(*fwd.connections[cs][d]).Close() // this should stops io.Copy
-			delete(fwd.connections[cs], d)
-			delete(fwd.connLoggers[cs], d)
+			fwd.closeConnDL(cs, d)
 			Debugf("[forward] ended existing connection: dest=%v for src=%v\n", d, fwd.src.Addr())
 		}
 	}
 	if len(fwd.dest) == 0 {
-		fwd.src.Close() // close listener
-		// close all existing connS
-		for cs := range fwd.connections {
-			(*cs).Close()
+		fwd.src.Close() // close listener, this stops listen()
+		if fwd.config.DrainTimeout == 0 {
+			// close all existing connS
+			for cs := range fwd.connections {
+				(*cs).Close()
+			}
 		}
-		fwd.quit = true // notify copyRoutine() and listen() to quit
+		fwd.closing = true // notify copyRoutine() to quit once drained
 		return true
 	}
 	return false
 }
 
+// stop listening and close all connections immediately,
+// the forwarder quits soon after this
+func (fwd *Forwarder) Close() {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	fwd.src.Close()
+	for cs, mde := range fwd.connections {
+		(*cs).Close()
+		for _, connD := range mde {
+			(*connD).Close()
+		}
+		fwd.connLoggers[cs].Close()
+	}
+	fwd.closing = true
+}
+
+// true if the forwarder has quitted
+func (fwd *Forwarder) Done() bool {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	return fwd.quit
+}
+
+// connections forwarded to dest d, including draining ones
+func (fwd *Forwarder) Connections(d string) []ConnInfo {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	ret := []ConnInfo{}
+	for cs, mde := range fwd.connections {
+		if _, ok := mde[d]; ok {
+			ret = append(ret, *fwd.connInfoL(cs))
+		}
+	}
+	return ret
+}
+
+// close the connection with id and its connections to all dests,
+// returns false if not found
+func (fwd *Forwarder) Kill(id uint64) bool {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	for cs, st := range fwd.states {
+		if st.id == id {
+			st.killed = true
+			Debugf("[forward] killing connection %v for src=%v\n", id, (*cs).RemoteAddr())
+			return true
+		}
+	}
+	return false
+}
+
+// connections being drained, grouped by dest
+func (fwd *Forwarder) Draining() []DrainInfo {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	m := make(map[string]*DrainInfo)
+	for cs := range fwd.connections {
+		for d, deadline := range fwd.states[cs].drain {
+			di, ok := m[d]
+			if !ok {
+				di = &DrainInfo{
+					Source: fwd.src.Addr().String(),
+					Dest:   d,
+				}
+				m[d] = di
+			}
+			di.Connections++
+			if deadline.After(di.Deadline) {
+				di.Deadline = deadline
+			}
+		}
+	}
+	ret := make([]DrainInfo, 0, len(m))
+	for _, di := range m {
+		ret = append(ret, *di)
+	}
+	return ret
+}
+
 func (fwd *Forwarder) listen() {
 	for {
 		// for each connect to source
 		fwd.mu.Lock()
 		src := fwd.src
-		if fwd.quit {
+		if fwd.closing {
 			Debugf("[forward] source=%v quitted\n", src.Addr())
 			fwd.mu.Unlock()
 			break
@@ -113,26 +269,150 @@ func (fwd *Forwarder) listen() {
 
 		fwd.mu.Lock()
 		fwd.connections[&connS] = make(map[string]*net.Conn)
-		fwd.connLoggers[&connS] = make(map[string]*ConnLogger)
+		st := &connState{
+			destDone: make(map[string]bool),
+			drain:    make(map[string]time.Time),
+			opened:   make(map[string]time.Time),
+			stats:    make(map[string]*forwardStats),
+			id:       lastConnID.Add(1),
+			started:  time.Now(),
+		}
+		fwd.states[&connS] = st
+		fwd.connLoggers[&connS] = NewConnLogger(capture.Header{
+			Connection: st.id,
+			Source:     src.Addr().String(),
+			Client:     connS.RemoteAddr().String(),
+			Local:      connS.LocalAddr().String(),
+			Started:    st.started,
+		}, fwd.config)
 		established := false
 		for _, d := range fwd.dest { // dial all dest for connS
-			connD, err := net.Dial("tcp", d)
+			connD, err := fwd.dialL(d)
 			if err != nil {
-				Debugf("[forward] fail to dial dest=%v for src=%v, err=%v\n", d, src.Addr(), err)
 				continue
 			}
 			Debugf("[forward] src=%v dialed %v\n", src.Addr(), d)
-			fwd.connections[&connS][d] = &connD
-			fwd.connLoggers[&connS][d] = NewConnLogger(fwd.src.Addr().String(), d)
+			fwd.addConnDL(&connS, d, connD)
 			established = true
 		}
 		if !established {
+			for _, d := range fwd.dest {
+				fwd.stats[d].rejected.Add(1)
+			}
 			connS.Close()
+			fwd.connLoggers[&connS].Close()
+			delete(fwd.connections, &connS)
+			delete(fwd.connLoggers, &connS)
+			delete(fwd.states, &connS)
+		} else {
+			fwd.events.Publish(Event{Type: EventConnOpened, Connection: fwd.connInfoL(&connS)})
 		}
 		fwd.mu.Unlock()
 	}
 }
 
+// fwd.mu must be held,
+// dial dest d, publish its health if it changes
+func (fwd *Forwarder) dialL(d string) (net.Conn, error) {
+	connD, err := net.Dial("tcp", d)
+	if err != nil {
+		Debugf("[forward] fail to dial dest=%v for src=%v, err=%v\n", d, fwd.src.Addr(), err)
+		fwd.stats[d].dialFailed(err)
+		if !fwd.destDown[d] {
+			fwd.destDown[d] = true
+			fwd.events.Publish(Event{Type: EventDestDown, Source: fwd.src.Addr().String(), Dest: d, Error: err.Error()})
+		}
+		return nil, err
+	}
+	if fwd.destDown[d] {
+		delete(fwd.destDown, d)
+		fwd.events.Publish(Event{Type: EventDestUp, Source: fwd.src.Addr().String(), Dest: d})
+	}
+	return connD, nil
+}
+
+// fwd.mu must be held,
+// forward connS to dest d over connD
+func (fwd *Forwarder) addConnDL(connS *net.Conn, d string, connD net.Conn) {
+	fwd.connections[connS][d] = &connD
+	st := fwd.states[connS]
+	st.opened[d] = time.Now()
+	fwd.connLoggers[connS].Open(d, connD.RemoteAddr().String(), fwd.captures[d])
+	st.stats[d] = fwd.stats[d]
+	st.stats[d].opened()
+	fwd.tapL(connS, d, capture.Open, nil)
+}
+
+// fwd.mu must be held,
+// close connD of connS to dest d and forget it
+func (fwd *Forwarder) closeConnDL(connS *net.Conn, d string) {
+	st := fwd.states[connS]
+	(*fwd.connections[connS][d]).Close()
+	fwd.connLoggers[connS].CloseDest(d)
+	fwd.tapL(connS, d, capture.Close, nil)
+	st.stats[d].observe(time.Since(st.opened[d]))
+	delete(fwd.connections[connS], d)
+	delete(st.destDone, d)
+	delete(st.drain, d)
+	delete(st.opened, d)
+	delete(st.stats, d)
+}
+
+// fwd.mu must be held,
+// publish a frame of connS to dest d to taps, if anyone is tapping
+func (fwd *Forwarder) tapL(connS *net.Conn, d string, typ capture.Type, b []byte) {
+	if !fwd.taps.Active() {
+		return
+	}
+	fwd.taps.Publish(fwd.source, TapFrame{Connection: fwd.states[connS].id, Type: typ, Time: time.Now(), Dest: d, Data: b})
+}
+
+// fwd.mu must be held
+func (fwd *Forwarder) connInfoL(connS *net.Conn) *ConnInfo {
+	st := fwd.states[connS]
+	ci := &ConnInfo{
+		ID:            st.id,
+		Source:        fwd.src.Addr().String(),
+		Client:        (*connS).RemoteAddr().String(),
+		Dests:         []string{},
+		Started:       st.started,
+		BytesSent:     st.sent,
+		BytesReceived: st.recv,
+	}
+	for d := range fwd.connections[connS] {
+		ci.Dests = append(ci.Dests, d)
+	}
+	sort.Strings(ci.Dests)
+	return ci
+}
+
+// send FIN on c if it supports half-close, otherwise close it
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// fwd.mu must be held,
+// true if every connD of connS has sent FIN
+func (fwd *Forwarder) destDoneL(connS *net.Conn) bool {
+	st := fwd.states[connS]
+	for d := range fwd.connections[connS] {
+		if !st.destDone[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// connD being drained is closed after its deadline,
+// each direction of a connection is shut down on its own:
+// when connS sends FIN, it is propagated to all connD by CloseWrite(),
+// when all connD have sent FIN, it is propagated to connS,
+// connS and all connD are closed after both directions are done,
+// or when any side of connS errors
 func (fwd *Forwarder) copyRoutine() {
 	size := 1024 * 1024 // TODO: doc this, or this should be adjustable
 	buf := make([]byte, size)
@@ -140,22 +420,42 @@ func (fwd *Forwarder) copyRoutine() {
 		fwd.mu.Lock()
 
 		closedConnS := []*net.Conn{}
+		now := time.Now()
 		for connS, mde := range fwd.connections {
+			st := fwd.states[connS]
+			for d, deadline := range st.drain {
+				if now.After(deadline) {
+					fwd.closeConnDL(connS, d)
+					Debugf("[forward] drained connection: dest=%v for src=%v\n", d, fwd.src.Addr())
+				}
+			}
+			if len(mde) == 0 || st.killed { // no dest to forward to
+				closedConnS = append(closedConnS, connS)
+				continue
+			}
+
 			// read many connD, write connS
 			shouldCloseConnS := false
 			totNr := 0
 			for d, connD := range mde {
+				if st.destDone[d] {
+					continue
+				}
 				(*connD).SetReadDeadline(time.Now().Add(time.Microsecond))
 				nr, err := (*connD).Read(buf[totNr:])
 				if nr != 0 {
-					fwd.connLoggers[connS][d].LogRecv(buf[totNr : totNr+nr])
+					fwd.connLoggers[connS].LogRecv(d, buf[totNr:totNr+nr])
+					fwd.tapL(connS, d, capture.Recv, buf[totNr:totNr+nr])
+					st.stats[d].received(nr)
 				}
 				// Debugf("[forward] read %v bytes from dest=%v, err=%v", nr, dest, err)
 				totNr += nr
-				if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) { // connD is down
-					(*connD).Close()
-					Debugf("[forward] connD closed for dest=%v", (*connD).RemoteAddr().String())
-					delete(fwd.connections[connS], d)
+				if errors.Is(err, io.EOF) { // connD half-closed
+					st.destDone[d] = true
+					Debugf("[forward] connD sent FIN for dest=%v", d)
+				} else if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) { // connD is down
+					fwd.closeConnDL(connS, d)
+					Debugf("[forward] connD closed for dest=%v", d)
 					if len(fwd.connections[connS]) == 0 {
 						shouldCloseConnS = true // if all connD is down, just close connS
 					}
@@ -166,36 +466,63 @@ func (fwd *Forwarder) copyRoutine() {
 				continue
 			}
 			if totNr != 0 {
+				st.recv += uint64(totNr)
 				(*connS).Write(buf[:totNr])
 				// Debugf("[forward] write %v bytes to src=%v, err=%v", nw, fwd.src.Addr(), err)
 			}
+			if !st.finSent && fwd.destDoneL(connS) {
+				closeWrite(*connS)
+				st.finSent = true
+				Debugf("[forward] all dest sent FIN, half-closed src=%v", (*connS).RemoteAddr())
+			}
 
 			// read connS, write to many connD
-			(*connS).SetReadDeadline(time.Now().Add(time.Microsecond)) // TODO: doc this in paper, see https://github.com/golang/go/issues/36973
-			nr, err := (*connS).Read(buf)
-			if nr != 0 {
-				for d, connD := range mde {
-					(*connD).Write(buf[0:nr])
-					fwd.connLoggers[connS][d].LogSend(buf[0:nr])
+			if !st.srcDone {
+				(*connS).SetReadDeadline(time.Now().Add(time.Microsecond)) // TODO: doc this in paper, see https://github.com/golang/go/issues/36973
+				nr, err := (*connS).Read(buf)
+				if nr != 0 {
+					st.sent += uint64(nr)
+					for d, connD := range mde {
+						(*connD).Write(buf[0:nr])
+						fwd.connLoggers[connS].LogSend(d, buf[0:nr])
+						fwd.tapL(connS, d, capture.Send, buf[0:nr])
+						st.stats[d].sent(nr)
+					}
+				}
+				if errors.Is(err, io.EOF) { // connS half-closed
+					st.srcDone = true
+					for _, connD := range mde {
+						closeWrite(*connD)
+					}
+					Debugf("[forward] src=%v sent FIN, half-closed all dest", (*connS).RemoteAddr())
+				} else if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) { // connS is down
+					closedConnS = append(closedConnS, connS)
+					continue
 				}
 			}
-			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) { // connS is down
+
+			if st.srcDone && st.finSent { // both directions are done
 				closedConnS = append(closedConnS, connS)
-				continue
 			}
 		}
 
 		// remove closed connS and close relevant connections
 		for _, ccs := range closedConnS {
+			fwd.events.Publish(Event{Type: EventConnClosed, Connection: fwd.connInfoL(ccs)})
 			(*ccs).Close()
 			Debugf("[forward] connS closed for src=%v", fwd.src.Addr())
-			for _, connD := range fwd.connections[ccs] {
-				(*connD).Close()
+			for d := range fwd.connections[ccs] {
+				fwd.closeConnDL(ccs, d)
 			}
+			fwd.connLoggers[ccs].Close()
 			delete(fwd.connections, ccs)
 			delete(fwd.connLoggers, ccs)
+			delete(fwd.states, ccs)
 		}
 
+		if fwd.closing && len(fwd.connections) == 0 {
+			fwd.quit = true
+		}
 		if fwd.quit {
 			Debugf("[forward] copyRoutine for src=%v quitted", fwd.src.Addr())
 			fwd.mu.Unlock()
@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 type CreateTunnelBody struct {
 	Name   string `json:"name"`
 	Source string `json:"source"`
@@ -12,6 +14,19 @@ type EditTunnelBody struct {
 	NewDest   string `json:"dest"`
 }
 
+type CreateTokenBody struct {
+	Name  string `json:"name"`
+	Scope Scope  `json:"scope"`
+}
+
 type AboutInfo struct {
 	Version string `json:"version"`
 }
+
+// connections of a removed forward that are still running
+type DrainInfo struct {
+	Source      string    `json:"source"`
+	Dest        string    `json:"dest"`
+	Connections int       `json:"connections"`
+	Deadline    time.Time `json:"deadline"` // all of them are closed after this
+}
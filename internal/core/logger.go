@@ -1,78 +1,326 @@
 package core
 
 import (
-	"encoding/binary"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
-)
 
-var homeDir string
+	"github.com/goverclock/gopolar/pkg/capture"
+)
 
+// captures traffic of a client connection to all its dests in one file,
+// see pkg/capture, the capture is rotated to a new part beyond
+// LogRetention.MaxFileSize
 type ConnLogger struct {
-	sendf *os.File
-	recvf *os.File
+	f         *os.File
+	w         *capture.Writer
+	path      string // of f
+	written   int64  // bytes written to f
+	header    capture.Header
+	part      int
+	logDir    string
+	retention LogRetention
+	doLogs    bool
+	dests     map[string]*destCapture // captured dests being connected
+	done      bool                    // closed or failed, nothing is captured after this
 }
 
-// remove all existing logs when gpcore starts
-func init() {
-	hd, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalln("fail to read $HOME dir: ", err)
+// capture of the connection to a dest
+type destCapture struct {
+	direction string // see CaptureConfig
+	remain    uint64 // bytes of data to capture before it's truncated, if limited
+	limited   bool
+}
+
+// capture of a tunnel set at runtime, overrides Config.DoLogs for it,
+// applies to client connections accepted after it's set
+type CaptureConfig struct {
+	Enable bool `json:"enable"`
+	// CIDRs(e.g. 10.0.0.0/8) or IPs of clients to capture, all if empty
+	Clients []string `json:"clients,omitempty"`
+	// send(client to dest) or recv to capture one direction, both if empty
+	Direction string `json:"direction,omitempty"`
+	// of data captured per connection to dest, 0 for no limit, later data
+	// is dropped from the capture
+	MaxBytes uint64 `json:"max_bytes,omitempty"`
+}
+
+// returns error if fields of c are invalid
+func (c CaptureConfig) Validate() error {
+	if _, err := c.prefixes(); err != nil {
+		return err
 	}
-	homeDir = hd
-	os.RemoveAll(fmt.Sprintf("%v/.gopolar/logs", homeDir))
+	if c.Direction != "" && c.Direction != capture.Send.String() && c.Direction != capture.Recv.String() {
+		return errorf(CodeInvalidArgument, "invalid direction %q, expect send or recv", c.Direction)
+	}
+	return nil
 }
 
-// log file at ~/.gopolar/logs/
-func NewConnLogger(source string, dest string) *ConnLogger {
-	if !config.DoLogs {
-		return &ConnLogger{
-			sendf: nil,
-			recvf: nil,
+// Clients parsed, an IP is a prefix of its full length
+func (c CaptureConfig) prefixes() ([]netip.Prefix, error) {
+	ret := []netip.Prefix{}
+	for _, s := range c.Clients {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, errorf(CodeInvalidArgument, "invalid client %q, expect CIDR or IP", s)
+			}
+			s = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String()
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, errorf(CodeInvalidArgument, "invalid client %q, expect CIDR or IP", s)
 		}
+		ret = append(ret, p.Masked())
 	}
+	return ret, nil
+}
 
-	current := time.Now()
+// whether connections from client(e.g. 10.0.0.1:52000) are captured
+func (c CaptureConfig) captures(client string) bool {
+	if !c.Enable {
+		return false
+	}
+	if len(c.Clients) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddrPort(client)
+	if err != nil {
+		return false
+	}
+	prefixes, _ := c.prefixes()
+	for _, p := range prefixes {
+		if p.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
 
-	logDir := fmt.Sprintf("%v/.gopolar/logs/%v-%v/", homeDir, source, dest)
-	os.MkdirAll(logDir, 0700)
+// paths of captures being written or compressed, never removed by retention
+var openCaptures = struct {
+	paths map[string]bool
+	mu    sync.Mutex
+}{paths: make(map[string]bool)}
 
-	sendLogName := fmt.Sprintf("%v-send", current.Format("2006-01-02 15:04:05.000000"))
-	recvLogName := fmt.Sprintf("%v-recv", current.Format("2006-01-02 15:04:05.000000"))
+func setCaptureOpen(path string, open bool) {
+	openCaptures.mu.Lock()
+	defer openCaptures.mu.Unlock()
+	if open {
+		openCaptures.paths[path] = true
+	} else {
+		delete(openCaptures.paths, path)
+	}
+}
+
+func isCaptureOpen(path string) bool {
+	openCaptures.mu.Lock()
+	defer openCaptures.mu.Unlock()
+	return openCaptures.paths[path]
+}
+
+// name of part of the capture of connection h, relative to log dir, e.g.
+// [::]:3300/2024-02-18 09:54:10.727005-12.gpcap for part 0, and
+// ...-12.1.gpcap for part 1
+func logName(h capture.Header, part int) string {
+	name := fmt.Sprintf("%v/%v-%v", h.Source, h.Started.Format("2006-01-02 15:04:05.000000"), h.Connection)
+	if part != 0 {
+		name += fmt.Sprintf(".%v", part)
+	}
+	return name + capture.Ext
+}
+
+// log file at cfg.LogDir(e.g. ~/.gopolar/logs/), created once the first
+// dest to capture is opened, see Open()
+func NewConnLogger(h capture.Header, cfg Config) *ConnLogger {
+	return &ConnLogger{
+		header:    h,
+		logDir:    cfg.connLogDir(),
+		retention: cfg.LogRetention,
+		doLogs:    cfg.DoLogs,
+		dests:     make(map[string]*destCapture),
+	}
+}
 
-	sendLogFile, err := os.OpenFile(logDir+sendLogName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+// capture traffic to dest d dialed at addr, d is not captured if c does
+// not capture the client, or c is nil and cfg.DoLogs is false, logging
+// is disabled for the connection if the log file can not be created
+func (cl *ConnLogger) Open(d string, addr string, c *CaptureConfig) {
+	if c == nil {
+		c = &CaptureConfig{Enable: cl.doLogs}
+	}
+	if cl.done || cl.logDir == "" || !c.captures(cl.header.Client) {
+		return
+	}
+	if cl.f == nil && !cl.open() {
+		return
+	}
+	cl.dests[d] = &destCapture{direction: c.Direction, remain: c.MaxBytes, limited: c.MaxBytes != 0}
+	cl.write(d, capture.Open, []byte(addr))
+}
+
+// open the current part, returns false and disables logging on error
+func (cl *ConnLogger) open() bool {
+	path := filepath.Join(cl.logDir, logName(cl.header, cl.part))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("[logger] fail to create log dir, logging disabled for this connection: %v\n", err)
+		cl.done = true
+		return false
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		log.Fatalf("fail to create log file: %v ,err=%v \n", sendLogName, err)
+		log.Printf("[logger] fail to create log file, logging disabled for this connection: %v\n", err)
+		cl.done = true
+		return false
 	}
-	recvLogFile, err := os.OpenFile(logDir+recvLogName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	setCaptureOpen(path, true)
+	cl.f = f
+	cl.path = path
+	cl.written = 0
+	w, err := capture.NewWriter(countWriter{f, &cl.written}, cl.header)
 	if err != nil {
-		log.Fatalf("fail to create log file: %v ,err=%v \n", recvLogName, err)
+		log.Printf("[logger] fail to write log file, logging disabled for this connection: %v\n", err)
+		cl.closeFile()
+		cl.done = true
+		return false
 	}
+	cl.w = w
+	return true
+}
 
-	return &ConnLogger{
-		sendf: sendLogFile,
-		recvf: recvLogFile,
-	}
+// counts bytes written to w in n
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	*cw.n += int64(n)
+	return n, err
 }
 
-func (cl *ConnLogger) LogSend(b []byte) {
-	if !config.DoLogs {
+// data from client to dest d
+func (cl *ConnLogger) LogSend(d string, b []byte) {
+	cl.write(d, capture.Send, b)
+}
+
+// data from dest d to client
+func (cl *ConnLogger) LogRecv(d string, b []byte) {
+	cl.write(d, capture.Recv, b)
+}
+
+// the connection to dest d is closed, it's captured again after Open()
+func (cl *ConnLogger) CloseDest(d string) {
+	cl.write(d, capture.Close, nil)
+	delete(cl.dests, d)
+}
+
+func (cl *ConnLogger) write(d string, typ capture.Type, b []byte) {
+	dc := cl.dests[d]
+	if dc == nil || cl.done {
 		return
 	}
-	err := binary.Write(cl.sendf, binary.LittleEndian, b)
+	if typ == capture.Send || typ == capture.Recv {
+		if dc.direction != "" && dc.direction != typ.String() {
+			return
+		}
+		if dc.limited {
+			if dc.remain == 0 {
+				return
+			}
+			b = b[:min(uint64(len(b)), dc.remain)]
+			dc.remain -= uint64(len(b))
+		}
+	}
+	// rotate before writing, so no part is left with the header only
+	if max := int64(cl.retention.MaxFileSize); max > 0 && cl.written >= max {
+		Debugf("[logger] rotate %v\n", cl.path)
+		cl.closeFile()
+		cl.part++
+		if !cl.open() {
+			return
+		}
+	}
+	err := cl.w.WriteFrame(capture.Frame{Time: time.Now(), Type: typ, Dest: d, Data: b})
 	if err != nil {
-		log.Fatal("[logger] LogSend fail")
+		log.Printf("[logger] fail to log %v, logging disabled for this connection: %v\n", typ, err)
+		cl.closeFile()
+		cl.done = true
+	}
+}
+
+// close all dests, then flush and close the log file, logging stops
+// after this
+func (cl *ConnLogger) Close() {
+	dests := []string{}
+	for d := range cl.dests {
+		dests = append(dests, d)
 	}
+	sort.Strings(dests)
+	for _, d := range dests {
+		cl.CloseDest(d)
+	}
+	cl.closeFile()
+	cl.done = true
 }
 
-func (cl *ConnLogger) LogRecv(b []byte) {
-	if !config.DoLogs {
+// close the current part, and compress it in background if configured
+func (cl *ConnLogger) closeFile() {
+	if cl.f == nil {
 		return
 	}
-	err := binary.Write(cl.recvf, binary.LittleEndian, b)
+	cl.f.Sync()
+	cl.f.Close()
+	if cl.retention.Compress {
+		go compressCapture(cl.path) // still open until compressed
+	} else {
+		setCaptureOpen(cl.path, false)
+	}
+	cl.f = nil
+	cl.w = nil
+}
+
+// replace capture at path with path.gz
+func compressCapture(path string) {
+	defer setCaptureOpen(path, false)
+	err := func() error {
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		tmp := path + ".gz.tmp"
+		dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		zw := gzip.NewWriter(dst)
+		_, err = io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, path+".gz")
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Remove(path)
+	}()
 	if err != nil {
-		log.Fatal("[logger] LogRecv fail")
+		log.Printf("[logger] fail to compress %v, kept as is: %v\n", path, err)
 	}
 }
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+)
+
+// capture of a client connection to all its dests, see NewConnLogger()
+// and pkg/capture
+type LogFile struct {
+	// relative to log dir, e.g. [::]:3300/2024-02-18 09:54:10.727005-12.gpcap
+	Path       string `json:"path"`
+	Source     string `json:"source"`     // listening address of the tunnel
+	Connection uint64 `json:"connection"` // ID of the client connection, see ConnInfo
+	// a long capture is rotated into parts 0, 1, ..., see LogRetention.MaxFileSize
+	Part       int       `json:"part"`
+	Compressed bool      `json:"compressed"` // gzipped, the path ends with .gz
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+}
+
+// log files sorted by path, parts of a capture in order
+func (tm *TunnelManager) GetLogs() ([]LogFile, error) {
+	logDir := tm.config.connLogDir()
+	if logDir == "" {
+		return []LogFile{}, errorf(CodeFailedPrecondition, "logs are disabled")
+	}
+	return readLogDir(logDir, false)
+}
+
+// parse capture name, e.g. 2024-02-18 09:54:10.727005-12.1.gpcap.gz,
+// returns the name without part and extensions for sorting
+func parseLogName(name string) (base string, conn uint64, part int, compressed bool, ok bool) {
+	name, compressed = strings.CutSuffix(name, ".gz")
+	name, ok = strings.CutSuffix(name, capture.Ext)
+	if !ok {
+		return
+	}
+	i := strings.LastIndex(name, "-")
+	id, p, hasPart := strings.Cut(name[i+1:], ".")
+	conn, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return "", 0, 0, false, false
+	}
+	if hasPart {
+		if part, err = strconv.Atoi(p); err != nil {
+			return "", 0, 0, false, false
+		}
+	}
+	return name[:i+1+len(id)], conn, part, compressed, true
+}
+
+// files in source dirs of logDir, captures only unless all, then other
+// files(e.g. logs of older versions in source-dest dirs) have zero
+// Connection
+func readLogDir(logDir string, all bool) ([]LogFile, error) {
+	ret := []LogFile{}
+	bases := make(map[string]string) // path -> path without part
+	dirs, err := os.ReadDir(logDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return ret, err
+	}
+	for _, dir := range dirs {
+		// source never contains "-", e.g. [::]:3300
+		source, _, older := strings.Cut(dir.Name(), "-")
+		if !dir.IsDir() || (older && !all) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(logDir, dir.Name()))
+		if err != nil {
+			return ret, err
+		}
+		for _, f := range files {
+			info, err := f.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			base, conn, part, compressed, ok := parseLogName(f.Name())
+			if older { // e.g. 2024-02-18 09:54:10.727005-send, or a capture per dest
+				base, conn, part, compressed, ok = "", 0, 0, false, false
+			}
+			if !ok && !all {
+				continue
+			}
+			l := LogFile{
+				Path:       dir.Name() + "/" + f.Name(),
+				Source:     source,
+				Connection: conn,
+				Part:       part,
+				Compressed: compressed,
+				Size:       info.Size(),
+				Modified:   info.ModTime(),
+			}
+			bases[l.Path] = l.Path
+			if ok {
+				bases[l.Path] = dir.Name() + "/" + base
+			}
+			ret = append(ret, l)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		bi, bj := bases[ret[i].Path], bases[ret[j].Path]
+		if bi != bj {
+			return bi < bj
+		}
+		if ret[i].Part != ret[j].Part {
+			return ret[i].Part < ret[j].Part
+		}
+		return ret[i].Path < ret[j].Path // compressed or not
+	})
+	return ret, nil
+}
+
+// open log file at path(see LogFile.Path) for reading
+func (tm *TunnelManager) OpenLog(path string) (*os.File, error) {
+	logDir := tm.config.connLogDir()
+	if logDir == "" {
+		return nil, errorf(CodeFailedPrecondition, "logs are disabled")
+	}
+	if !filepath.IsLocal(path) || strings.Count(filepath.Clean(path), string(filepath.Separator)) != 1 {
+		return nil, errorf(CodeInvalidArgument, "invalid log path %q", path)
+	}
+	f, err := os.Open(filepath.Join(logDir, path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errorf(CodeNotFound, "no log file %q", path)
+	}
+	return f, err
+}
+
+// parts of the capture of client connection conn to the source of tunnel
+// id in order, with traffic of all dests of the source
+func (tm *TunnelManager) GetCaptures(id uint64, conn uint64) ([]LogFile, error) {
+	t, err := tm.GetTunnel(id)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := tm.GetLogs()
+	if err != nil {
+		return nil, err
+	}
+	ret := []LogFile{}
+	src, err := t.ParseSource()
+	if err != nil {
+		return ret, errorf(CodeNotFound, "no capture of connection %v of tunnel %v", conn, id)
+	}
+	paths := make(map[string]bool)
+	for _, l := range logs {
+		paths[l.Path] = true
+	}
+	for _, l := range logs {
+		if !l.Compressed && paths[l.Path+".gz"] { // being removed after compression
+			continue
+		}
+		// logs are named by listening address, e.g. [::]:3300
+		lsrc, err := netip.ParseAddrPort(l.Source)
+		if err == nil && lsrc.Port() == src.Port() && l.Connection == conn {
+			ret = append(ret, l)
+		}
+	}
+	if len(ret) == 0 {
+		return ret, errorf(CodeNotFound, "no capture of connection %v of tunnel %v", conn, id)
+	}
+	return ret, nil
+}
+
+// write the capture of client connection conn of tunnel id to w as
+// pcapng, a TCP connection for each dest, see capture.PcapngWriter, a
+// capture being written is exported up to its last complete frame
+func (tm *TunnelManager) WritePcapng(w io.Writer, id uint64, conn uint64) error {
+	logs, err := tm.GetCaptures(id, conn)
+	if err != nil {
+		return err
+	}
+	pw, err := capture.NewPcapngWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		if err := tm.writeCapture(pw, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tm *TunnelManager) writeCapture(pw *capture.PcapngWriter, l LogFile) error {
+	path := l.Path
+	f, err := tm.OpenLog(path)
+	if ErrorCode(err) == CodeNotFound && !l.Compressed { // compressed since listed
+		path += ".gz"
+		f, err = tm.OpenLog(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return errorf(CodeInternal, "capture %q: %v", path, err)
+	}
+	err = pw.WriteCapture(r)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
@@ -1,98 +1,419 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/netip"
 	"os"
+	"slices"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
-var config Config
-
 type TunnelManager struct {
 	tunnels   map[uint64]*Tunnel            // ID -> source
 	forwarder map[netip.AddrPort]*Forwarder // source -> forwarder, only maintains running tunnels
+	draining  []*Forwarder                  // removed forwarders still draining connections
 	router    *gin.Engine
+	servers   []*http.Server    // set by Run()
+	token     string            // admin API token, set by Run()
+	tokens    []APIToken        // other API tokens, set by Run()
+	watcher   *fsnotify.Watcher // watches tunnels.toml, set by Run()
+	saveErr   error             // tunnels.toml is broken, do not overwrite it
+	// set by Shutdown(), Run() returns instead of serving from then on
+	shuttingDown bool
+	// enabled in tunnels.toml but failed to start when loaded, e.g. source
+	// port is taken, disabled but still saved as enabled
+	startFailed map[uint64]bool
+	audit       *os.File // audit.jsonl, nil if disabled
+	events      *EventBus
+	metrics     *Metrics
+	taps        *TapBus
+	config      Config
+	// stops runRetention(), nil if there is no log dir
+	retentionQuit chan struct{}
+	statsQuit     chan struct{} // stops publishStats()
 
 	mu sync.Mutex
 }
 
-// init tunnels from config file, exit if any error occurs
+// init tunnels from config file, invalid tunnels are loaded as disabled,
+// nothing is served until Run() is called
 func NewTunnelManager(cfg Config) *TunnelManager {
-	log.SetFlags(0)
-	config = cfg
-
 	tm := &TunnelManager{
-		tunnels:   make(map[uint64]*Tunnel),
-		forwarder: make(map[netip.AddrPort]*Forwarder),
+		tunnels:     make(map[uint64]*Tunnel),
+		forwarder:   make(map[netip.AddrPort]*Forwarder),
+		startFailed: make(map[uint64]bool),
+		events:      NewEventBus(),
+		metrics:     NewMetrics(),
+		taps:        NewTapBus(),
+		config:      cfg,
+		statsQuit:   make(chan struct{}),
 	}
 	tm.setupRouter()
 
-	if config.ReadSaved {
-		savedTunnels := readTunnels()
+	if tm.config.ReadSaved {
+		savedTunnels, err := readTunnels(tm.config)
+		if err != nil {
+			log.Println("fail to read saved tunnels, changes are not saved until tunnels.toml is fixed:", err)
+			tm.saveErr = err
+		}
 		for _, t := range savedTunnels {
-			tm.AddTunnel(t)
+			if err := tm.loadTunnel(localCaller, t); err != nil {
+				log.Printf("tunnel %q is disabled: %v\n", t.Name, err)
+			}
 		}
 	}
+	// loading saved tunnels is not audited
+	tm.audit = openAudit(tm.config)
+
+	if logDir := tm.config.connLogDir(); logDir != "" {
+		seedConnID(logDir)
+		tm.retentionQuit = make(chan struct{})
+		go runRetention(tm.config, tm.retentionQuit)
+	}
+	go tm.publishStats(tm.statsQuit)
 
 	return tm
 }
 
-func (tm *TunnelManager) Run() {
-	// in 1991, "Gopher" protocol uses 70 as its port
-	// see https://zh.wikipedia.org/wiki/Gopher_(%E7%BD%91%E7%BB%9C%E5%8D%8F%E8%AE%AE)
-	go tm.router.Run(":7070")
+// serve API on config.HTTPListen and config.SocketPath, and reload tunnels
+// when tunnels.toml changes(see Reload()),
+// blocks until Shutdown() is called or any server fails,
+// returns http.ErrServerClosed if Shutdown() is called before serving
+func (tm *TunnelManager) Run() error {
+	if tm.config.ReadSaved {
+		watcher, err := tm.watchTunnels()
+		if err != nil {
+			log.Println("fail to watch tunnels.toml, changes apply on restart:", err)
+		}
+		tm.mu.Lock()
+		if tm.shuttingDown {
+			tm.mu.Unlock()
+			if watcher != nil {
+				watcher.Close()
+			}
+			return http.ErrServerClosed
+		}
+		tm.watcher = watcher
+		tm.mu.Unlock()
+	}
 
-	err := os.Remove("/tmp/gopolar.sock")
+	httpListen := tm.config.HTTPListen
+	if httpListen != "" && tm.config.LoopbackOnly {
+		addr, err := loopbackListen(httpListen)
+		if err != nil {
+			return err
+		}
+		httpListen = addr
+	}
+	if tm.config.Auth {
+		if err := os.MkdirAll(tm.config.DataDir, 0700); err != nil {
+			return err
+		}
+		token, err := loadOrCreateToken(tm.config.TokenPath())
+		if err != nil {
+			return err
+		}
+		tokens, err := readTokens(tm.config.tokensPath())
+		if err != nil {
+			return fmt.Errorf("fail to read tokens: %w", err)
+		}
+		tm.mu.Lock()
+		tm.token = token
+		tm.tokens = tokens
+		tm.mu.Unlock()
+	}
+
+	err := os.Remove(tm.config.SocketPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		panic(err)
+		return err
 	}
 	// this creates the unix domain socket
-	err = tm.router.RunUnix("/tmp/gopolar.sock")
+	unixListener, err := net.Listen("unix", tm.config.SocketPath)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if err := setupSocket(tm.config); err != nil {
+		unixListener.Close()
+		return err
+	}
+	if !peerCredSupported && len(tm.config.SocketAllowUIDs)+len(tm.config.SocketAllowGIDs) != 0 {
+		log.Println("socket_allow_uids and socket_allow_gids are ignored on this platform, use socket_mode instead")
+	}
+
+	unixServer := &http.Server{Handler: tm.router, ConnContext: peerCredContext}
+	servers := []*http.Server{unixServer}
+	var tcpServer *http.Server
+	if httpListen != "" {
+		tcpServer = &http.Server{Addr: httpListen, Handler: tm.router}
+		servers = append(servers, tcpServer)
+	}
+	// registered before serving, so Shutdown() always sees them, servers
+	// shut down before serving return http.ErrServerClosed at once
+	tm.mu.Lock()
+	if tm.shuttingDown {
+		tm.mu.Unlock()
+		unixListener.Close() // this removes the socket
+		return http.ErrServerClosed
+	}
+	tm.servers = servers
+	tm.mu.Unlock()
+	errc := make(chan error, 2)
+	go func() { errc <- unixServer.Serve(unixListener) }()
+	if tcpServer != nil {
+		go func() { errc <- tcpServer.ListenAndServe() }()
+	}
+
+	for range servers {
+		err := <-errc
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop serving API, stop accepting new connections for all tunnels,
+// and wait for existing connections to finish(see Config.DrainTimeout),
+// connections still running when ctx is done are closed immediately,
+// log files are flushed as connections close,
+// tunnels are saved as they were, so they are restored on next start,
+// tm should not be used after this
+func (tm *TunnelManager) Shutdown(ctx context.Context) error {
+	tm.events.Close() // end event streams, or servers never become idle
+	tm.taps.Close()
+	tm.mu.Lock()
+	tm.shuttingDown = true
+	servers := tm.servers
+	if tm.watcher != nil {
+		tm.watcher.Close()
+	}
+	if tm.retentionQuit != nil {
+		close(tm.retentionQuit)
+		tm.retentionQuit = nil
+	}
+	if tm.statsQuit != nil {
+		close(tm.statsQuit)
+		tm.statsQuit = nil
+	}
+	tm.mu.Unlock()
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.Shutdown(ctx))
+	}
+	if servers != nil {
+		os.Remove(tm.config.SocketPath)
+	}
+
+	tm.mu.Lock()
+	for _, t := range tm.tunnels {
+		if t.Enable {
+			tm.removeForwardL(t.MustParseSource(), t.Dest)
+		}
+	}
+	if tm.audit != nil {
+		tm.audit.Close()
+		tm.audit = nil
+	}
+	tm.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		tm.mu.Lock()
+		tm.pruneDrainingL()
+		remain := tm.draining
+		tm.mu.Unlock()
+		if len(remain) == 0 {
+			return errors.Join(errs...)
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, fwd := range remain {
+				fwd.Close()
+			}
+			return errors.Join(append(errs, ctx.Err())...)
+		case <-ticker.C:
+		}
 	}
 }
 
 // tm.mu must be held,
 // save current tunnel list to tunnels.toml
 func (tm *TunnelManager) saveL() {
-	if !config.ReadSaved { // avoid truncating
+	if !tm.config.ReadSaved || tm.saveErr != nil { // avoid truncating
 		return
 	}
-	viper.Set("tunnels", tunnelMapToListL(tm.tunnels))
-	viper.WriteConfig()
+	tunnels := tunnelMapToListL(tm.tunnels)
+	for i := range tunnels {
+		if tm.startFailed[tunnels[i].ID] {
+			tunnels[i].Enable = true
+		}
+	}
+	err := writeTunnels(tm.config.tunnelsPath(), tunnels)
+	if err != nil {
+		log.Println("fail to save tunnels:", err)
+	}
 }
 
 // tm.mu must be held,
 // create new forwarder if needed,
-// then add the forward
-func (tm *TunnelManager) addForwardL(src netip.AddrPort, dest string) error {
+// then add the forward, captured as c(see Forwarder.SetCapture())
+func (tm *TunnelManager) addForwardL(src netip.AddrPort, dest string, c *CaptureConfig) error {
 	if tm.forwarder[src] == nil {
-		fwd, err := NewForwarder(src)
+		fwd, err := NewForwarder(src, tm.config, tm.events, tm.metrics, tm.taps)
 		if err != nil {
 			Debugf("[manager] fail to create new forwarder for src=%v: %v\n", src, err)
-			return err
+			return errorf(CodeFailedPrecondition, "%v", err)
 		}
 		tm.forwarder[src] = fwd
 	}
+	tm.forwarder[src].SetCapture(dest, c)
 	tm.forwarder[src].Add(dest)
 	return nil
 }
 
 // tm.mu must be held,
+// existing connections to dest are drained in background
 func (tm *TunnelManager) removeForwardL(src netip.AddrPort, dest string) {
-	if tm.forwarder[src].Remove(dest) {
+	fwd := tm.forwarder[src]
+	if fwd.Remove(dest) {
 		tm.forwarder[src] = nil
+		tm.draining = append(tm.draining, fwd)
+	}
+}
+
+// tm.mu must be held,
+// forget forwarders that finished draining
+func (tm *TunnelManager) pruneDrainingL() {
+	remain := []*Forwarder{}
+	for _, fwd := range tm.draining {
+		if !fwd.Done() {
+			remain = append(remain, fwd)
+		}
+	}
+	tm.draining = remain
+}
+
+// connections still running for removed forwards,
+// sorted by source then dest
+func (tm *TunnelManager) GetDraining() []DrainInfo {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ret := []DrainInfo{}
+	for _, fwd := range tm.forwardersL() {
+		ret = append(ret, fwd.Draining()...)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Source != ret[j].Source {
+			return ret[i].Source < ret[j].Source
+		}
+		return ret[i].Dest < ret[j].Dest
+	})
+	return ret
+}
+
+// tm.mu must be held,
+// running and draining forwarders
+func (tm *TunnelManager) forwardersL() []*Forwarder {
+	tm.pruneDrainingL()
+	ret := []*Forwarder{}
+	for _, fwd := range tm.forwarder {
+		if fwd != nil {
+			ret = append(ret, fwd)
+		}
+	}
+	return append(ret, tm.draining...)
+}
+
+// client connections of tunnel with id, including draining ones,
+// sorted by ID, returns error if tunnel with id does not exist
+func (tm *TunnelManager) GetConnections(id uint64) ([]ConnInfo, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return nil, errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	ret := []ConnInfo{}
+	src, err := t.ParseSource()
+	if err != nil { // invalid tunnels never run
+		return ret, nil
+	}
+	for _, fwd := range tm.forwardersL() {
+		if fwd.source == src {
+			ret = append(ret, fwd.Connections(t.Dest)...)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret, nil
+}
+
+// close client connection with id(see ConnInfo) and its connections
+// to all dests, returns error if it does not exist
+func (tm *TunnelManager) CloseConnection(id uint64) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for _, fwd := range tm.forwardersL() {
+		if fwd.Kill(id) {
+			return nil
+		}
+	}
+	return errorf(CodeNotFound, "connection %v does not exist", id)
+}
+
+// receive traffic of tunnel id from now on, see TapBus.Subscribe(),
+// the channel is also closed when the tunnel is edited or removed,
+// returns error if it does not exist
+func (tm *TunnelManager) Tap(id uint64) (frames <-chan TapFrame, cancel func(), err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return nil, nil, errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	src, err := t.ParseSource()
+	if err != nil {
+		return nil, nil, errorf(CodeFailedPrecondition, "tunnel %v is invalid: %v", id, err)
+	}
+	frames, cancel = tm.taps.Subscribe(src, t.Dest)
+	return frames, cancel, nil
+}
+
+// tm.mu must be held,
+// end taps and forget stats of t before its source or dest changes, or
+// it's removed, so stats are only kept while it's disabled
+func (tm *TunnelManager) forgetForwardL(t *Tunnel) {
+	if src, err := t.ParseSource(); err == nil {
+		tm.taps.CloseTunnel(src, t.Dest)
+		tm.metrics.remove(src, t.Dest)
 	}
 }
 
+// receive events of tunnels and connections, see EventBus.Subscribe()
+func (tm *TunnelManager) Subscribe() (events <-chan Event, cancel func()) {
+	return tm.events.Subscribe()
+}
+
+// routes served by the API, see openapi.json for their documentation
+func (tm *TunnelManager) Routes() gin.RoutesInfo {
+	return tm.router.Routes()
+}
+
 // always return a list sorted by tunnel ID,  never errors
 func (tm *TunnelManager) GetTunnels() []Tunnel {
 	tm.mu.Lock()
@@ -113,32 +434,38 @@ func tunnelMapToListL(m map[uint64]*Tunnel) []Tunnel {
 
 }
 
-// returns error if tunnel already exists
-func (tm *TunnelManager) AddTunnel(nt Tunnel) (uint64, error) {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
-
-	// validate souce, dest
+// tm.mu must be held,
+// check source and dest for tunnel with id(0 for a new tunnel),
+// returns error if they are invalid or used by another tunnel
+func (tm *TunnelManager) validateL(id uint64, source string, dest string) error {
+	nt := Tunnel{Source: source, Dest: dest}
 	src, err := nt.ParseSource()
 	if err != nil {
-		return 0, err
+		return errorf(CodeInvalidArgument, "%v", err)
 	}
-	dest, err := nt.ParseDest()
+	dst, err := nt.ParseDest()
 	if err != nil {
-		return 0, err
+		return errorf(CodeInvalidArgument, "%v", err)
 	}
-	if src == dest {
-		return 0, fmt.Errorf("source and dest can not be the same: %v", dest)
+	if src == dst {
+		return errorf(CodeInvalidArgument, "source and dest can not be the same: %v", dst)
 	}
 
 	// check if a forwarder routine is already running this mapping
-	for id, t := range tm.tunnels {
-		if t.MustParseSource() == src && t.MustParseDest() == dest {
-			return 0, fmt.Errorf("tunnel from %v to %v already exists(ID=%v)", src, dest, id)
+	for oid, t := range tm.tunnels {
+		if oid == id || t.Error != "" { // invalid tunnels are never running
+			continue
+		}
+		if t.MustParseSource() == src && t.MustParseDest() == dst {
+			return errorf(CodeAlreadyExists, "tunnel from %v to %v already exists(ID=%v)", src, dst, oid)
 		}
 	}
+	return nil
+}
 
-	// generate id for the new tunnel
+// tm.mu must be held,
+// smallest ID not taken
+func (tm *TunnelManager) newIDL() uint64 {
 	newID := uint64(1)
 	for {
 		_, ok := tm.tunnels[newID]
@@ -148,42 +475,126 @@ func (tm *TunnelManager) AddTunnel(nt Tunnel) (uint64, error) {
 			break
 		}
 	}
+	return newID
+}
+
+// returns error if tunnel already exists
+func (tm *TunnelManager) AddTunnel(nt Tunnel) (uint64, error) {
+	return tm.addTunnel(localCaller, nt)
+}
+
+// AddTunnel() by caller c
+func (tm *TunnelManager) addTunnel(c Caller, nt Tunnel) (id uint64, err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer tm.recordL(c, "add", &id, nil, &err)
+	return tm.addTunnelL(nt)
+}
+
+// tm.mu must be held
+func (tm *TunnelManager) addTunnelL(nt Tunnel) (uint64, error) {
+	if err := tm.validateL(0, nt.Source, nt.Dest); err != nil {
+		return 0, err
+	}
+
+	nt.Capture = nil // set by SetCapture() only
 
 	// update forward
 	if nt.Enable {
-		err := tm.addForwardL(src, nt.Dest)
+		err := tm.addForwardL(nt.MustParseSource(), nt.Dest, nil)
 		if err != nil {
 			return 0, err
 		}
 	}
 
 	// add the tunnel
-	nt.ID = newID
-	tm.tunnels[newID] = &nt
+	nt.ID = tm.newIDL()
+	nt.Error = ""
+	tm.tunnels[nt.ID] = &nt
+	tm.saveL()
+	return nt.ID, nil
+}
+
+// like AddTunnel, but a tunnel that fails to be added is still kept
+// as disabled, with the error attached to it,
+// so it's not lost from tunnels.toml and can be fixed later,
+// a valid one that fails to start is still saved as enabled
+func (tm *TunnelManager) loadTunnel(c Caller, nt Tunnel) (err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer tm.recordL(c, "add", &nt.ID, nil, &err)
+
+	startFailed := false
+	if nt.Error == "" {
+		id, err := tm.addTunnelL(nt)
+		if err == nil {
+			nt.ID = id
+			return nil
+		}
+		nt.Error = err.Error()
+		startFailed = nt.Enable && ErrorCode(err) == CodeFailedPrecondition
+	}
+
+	nt.ID = tm.newIDL()
+	nt.Enable = false
+	tm.tunnels[nt.ID] = &nt
+	if startFailed {
+		tm.startFailed[nt.ID] = true
+	}
 	tm.saveL()
-	return newID, nil
+	return errors.New(nt.Error)
+}
+
+// returns error if tunnel with id does not exist
+func (tm *TunnelManager) GetTunnel(id uint64) (Tunnel, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return Tunnel{}, errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	return *t, nil
 }
 
 // returns error if tunnel with id does not exist
 func (tm *TunnelManager) ChangeTunnel(id uint64, newName string, newSource string, newDest string) error {
+	return tm.changeTunnel(localCaller, id, newName, newSource, newDest)
+}
+
+// ChangeTunnel() by caller c
+func (tm *TunnelManager) changeTunnel(c Caller, id uint64, newName string, newSource string, newDest string) (err error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	defer tm.recordL(c, "change", &id, tm.snapshotL(id), &err)
+	return tm.changeTunnelL(id, newName, newSource, newDest)
+}
 
+// tm.mu must be held
+func (tm *TunnelManager) changeTunnelL(id uint64, newName string, newSource string, newDest string) error {
 	t, ok := tm.tunnels[id]
 	if !ok {
-		return fmt.Errorf("tunnel %v does not exist", id)
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+
+	if err := tm.validateL(id, newSource, newDest); err != nil {
+		return err
 	}
 
 	t.Name = newName
+	t.Error = "" // it's valid now
 	if t.Source != newSource || t.Dest != newDest {
 		if t.Enable {
 			tm.removeForwardL(t.MustParseSource(), t.Dest)
 		}
+		tm.forgetForwardL(t)
 		t.Source = newSource
 		t.Dest = newDest
 		if t.Enable {
-			err := tm.addForwardL(t.MustParseSource(), newDest)
-			if err != nil {
+			err := tm.addForwardL(t.MustParseSource(), newDest, t.Capture)
+			if err != nil { // the edit is kept, but the tunnel stops
+				t.Enable = false
+				t.Error = err.Error()
+				tm.saveL()
 				return err
 			}
 		}
@@ -193,46 +604,181 @@ func (tm *TunnelManager) ChangeTunnel(id uint64, newName string, newSource strin
 	return nil
 }
 
+// fields to change in a tunnel, nil fields are kept as they are
+type TunnelPatch struct {
+	Name   *string `json:"name"`
+	Source *string `json:"source"`
+	Dest   *string `json:"dest"`
+	Enable *bool   `json:"enable"`
+}
+
+// change fields set in p, then enable or disable the tunnel,
+// returns error if tunnel with id does not exist
+func (tm *TunnelManager) UpdateTunnel(id uint64, p TunnelPatch) error {
+	return tm.updateTunnel(localCaller, id, p)
+}
+
+// UpdateTunnel() by caller c
+func (tm *TunnelManager) updateTunnel(c Caller, id uint64, p TunnelPatch) (err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer tm.recordL(c, "change", &id, tm.snapshotL(id), &err)
+
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	if p.Name != nil || p.Source != nil || p.Dest != nil {
+		name, source, dest := t.Name, t.Source, t.Dest
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if p.Source != nil {
+			source = *p.Source
+		}
+		if p.Dest != nil {
+			dest = *p.Dest
+		}
+		if err := tm.changeTunnelL(id, name, source, dest); err != nil {
+			return err
+		}
+	}
+	if p.Enable != nil {
+		return tm.setEnableL(id, *p.Enable)
+	}
+	return nil
+}
+
 // returns error if tunnel with id does not exist
 func (tm *TunnelManager) ToggleTunnel(id uint64) error {
+	return tm.toggleTunnel(localCaller, id)
+}
+
+// ToggleTunnel() by caller c
+func (tm *TunnelManager) toggleTunnel(c Caller, id uint64) (err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer tm.recordL(c, "toggle", &id, tm.snapshotL(id), &err)
+
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	return tm.setEnableL(id, !t.Enable)
+}
+
+// start or stop the tunnel, nothing happens if it's already in that state,
+// returns error if tunnel with id does not exist
+func (tm *TunnelManager) EnableTunnel(id uint64, enable bool) error {
+	return tm.enableTunnel(localCaller, id, enable)
+}
+
+// EnableTunnel() by caller c
+func (tm *TunnelManager) enableTunnel(c Caller, id uint64, enable bool) (err error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	op := "disable"
+	if enable {
+		op = "enable"
+	}
+	defer tm.recordL(c, op, &id, tm.snapshotL(id), &err)
+	return tm.setEnableL(id, enable)
+}
 
+// tm.mu must be held
+func (tm *TunnelManager) setEnableL(id uint64, enable bool) error {
 	t, ok := tm.tunnels[id]
 	if !ok {
-		return fmt.Errorf("tunnel %v does not exist", id)
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	if t.Enable == enable {
+		if !enable && tm.startFailed[id] { // saved as disabled from now on
+			delete(tm.startFailed, id)
+			tm.saveL()
+		}
+		return nil
 	}
 
 	// update forwarder routine
-	if !t.Enable {
-		err := tm.addForwardL(t.MustParseSource(), t.Dest)
+	if enable {
+		if err := tm.validateL(id, t.Source, t.Dest); err != nil {
+			t.Error = err.Error()
+			return err
+		}
+		err := tm.addForwardL(t.MustParseSource(), t.Dest, t.Capture)
 		if err != nil {
+			t.Error = err.Error()
 			return err
 		}
+		t.Error = ""
 	} else {
 		tm.removeForwardL(t.MustParseSource(), t.Dest)
 	}
-	t.Enable = !t.Enable
+	t.Enable = enable
+	delete(tm.startFailed, id)
 
 	tm.saveL()
 	return nil
 }
 
+// capture client connections of tunnel id accepted after this as c, or as
+// config.DoLogs if c is nil, returns error if tunnel with id does not exist
+// or c is invalid
+func (tm *TunnelManager) SetCapture(id uint64, c *CaptureConfig) error {
+	return tm.setCapture(localCaller, id, c)
+}
+
+// SetCapture() by caller c
+func (tm *TunnelManager) setCapture(c Caller, id uint64, cc *CaptureConfig) (err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer tm.recordL(c, "capture", &id, tm.snapshotL(id), &err)
+
+	t, ok := tm.tunnels[id]
+	if !ok {
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
+	}
+	if cc != nil {
+		if err := cc.Validate(); err != nil {
+			return err
+		}
+		if cc.Enable && tm.config.connLogDir() == "" {
+			return errorf(CodeFailedPrecondition, "no log directory to capture to")
+		}
+		copied := *cc
+		copied.Clients = slices.Clone(cc.Clients)
+		cc = &copied
+	}
+	t.Capture = cc
+	if t.Enable {
+		tm.forwarder[t.MustParseSource()].SetCapture(t.Dest, cc)
+	}
+	return nil
+}
+
 // returns error if tunnel with id does not exist
 func (tm *TunnelManager) RemoveTunnel(id uint64) error {
+	return tm.removeTunnel(localCaller, id)
+}
+
+// RemoveTunnel() by caller c
+func (tm *TunnelManager) removeTunnel(c Caller, id uint64) (err error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	defer tm.recordL(c, "remove", &id, tm.snapshotL(id), &err)
 	t, ok := tm.tunnels[id]
 	if !ok {
-		return fmt.Errorf("tunnel %v does not exist", id)
+		return errorf(CodeNotFound, "tunnel %v does not exist", id)
 	}
 
 	// if tunnel is not enabled, it's already not in forwarder
 	if t.Enable {
 		tm.removeForwardL(t.MustParseSource(), t.Dest)
 	}
+	tm.forgetForwardL(t)
 
 	delete(tm.tunnels, id)
+	delete(tm.startFailed, id)
 
 	tm.saveL()
 	return nil
@@ -0,0 +1,317 @@
+package core
+
+import (
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upper bounds of buckets of connection durations, in seconds
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+
+// a forward is a tunnel while it runs, keyed the same as tm.forwarder
+type forwardKey struct {
+	source netip.AddrPort
+	dest   string
+}
+
+// bytes of each second in the last minute, a ring indexed by unix time
+type rateWindow struct {
+	secs  [60]int64 // unix time of each slot
+	bytes [60]uint64
+}
+
+func (w *rateWindow) add(now time.Time, n int) {
+	sec := now.Unix()
+	i := sec % int64(len(w.secs))
+	if w.secs[i] != sec {
+		w.secs[i] = sec
+		w.bytes[i] = 0
+	}
+	w.bytes[i] += uint64(n)
+}
+
+// average bytes per second over the last minute
+func (w *rateWindow) rate(now time.Time) float64 {
+	sec := now.Unix()
+	total := uint64(0)
+	for i := range w.secs {
+		if sec-w.secs[i] < int64(len(w.secs)) {
+			total += w.bytes[i]
+		}
+	}
+	return float64(total) / float64(len(w.secs))
+}
+
+// traffic of a forward, counters are updated by forwarders without
+// holding Metrics.mu
+type forwardStats struct {
+	bytesSent    atomic.Uint64 // client to dest
+	bytesRecv    atomic.Uint64
+	accepted     atomic.Uint64 // connections to dest established
+	rejected     atomic.Uint64 // clients closed as no dest could be dialed
+	active       atomic.Int64
+	dialFailures atomic.Uint64
+
+	durations     []uint64 // count per bucket of durationBuckets, not cumulative
+	durationSum   float64  // seconds
+	durationsNum  uint64
+	sendRate      rateWindow
+	recvRate      rateWindow
+	lastError     string // of the last failed dial
+	lastErrorTime time.Time
+	lastActivity  time.Time  // of the last connection or data
+	mu            sync.Mutex // protects fields above
+}
+
+// a connection to dest is established
+func (s *forwardStats) opened() {
+	s.accepted.Add(1)
+	s.active.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+}
+
+// n bytes are sent from client to dest
+func (s *forwardStats) sent(n int) {
+	s.bytesSent.Add(uint64(n))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+	s.sendRate.add(s.lastActivity, n)
+}
+
+// n bytes are received from dest
+func (s *forwardStats) received(n int) {
+	s.bytesRecv.Add(uint64(n))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+	s.recvRate.add(s.lastActivity, n)
+}
+
+func (s *forwardStats) dialFailed(err error) {
+	s.dialFailures.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+// a connection to dest of duration d is closed
+func (s *forwardStats) observe(d time.Duration) {
+	s.active.Add(-1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.durations == nil {
+		s.durations = make([]uint64, len(durationBuckets))
+	}
+	sec := d.Seconds()
+	for i, b := range durationBuckets {
+		if sec <= b {
+			s.durations[i]++
+			break
+		}
+	}
+	s.durationSum += sec
+	s.durationsNum++
+}
+
+// cumulative bucket counts for prometheus
+func (s *forwardStats) histogram() (count uint64, sum float64, buckets map[float64]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets = make(map[float64]uint64, len(durationBuckets))
+	cum := uint64(0)
+	for i, b := range durationBuckets {
+		if s.durations != nil {
+			cum += s.durations[i]
+		}
+		buckets[b] = cum
+	}
+	return s.durationsNum, s.durationSum, buckets
+}
+
+func (s *forwardStats) snapshot() TunnelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	ret := TunnelStats{
+		ActiveConnections: s.active.Load(),
+		TotalConnections:  s.accepted.Load(),
+		BytesSent:         s.bytesSent.Load(),
+		BytesReceived:     s.bytesRecv.Load(),
+		SendRate:          s.sendRate.rate(now),
+		ReceiveRate:       s.recvRate.rate(now),
+		LastError:         s.lastError,
+	}
+	if !s.lastErrorTime.IsZero() {
+		t := s.lastErrorTime
+		ret.LastErrorTime = &t
+	}
+	if !s.lastActivity.IsZero() {
+		t := s.lastActivity
+		ret.LastActivity = &t
+	}
+	return ret
+}
+
+// counters of all forwards, shared by forwarders so they are kept when
+// a forwarder is recreated, e.g. the tunnel is disabled then enabled,
+// a nil *Metrics counts nothing
+type Metrics struct {
+	forwards map[forwardKey]*forwardStats
+	mu       sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		forwards: make(map[forwardKey]*forwardStats),
+	}
+}
+
+// stats of the forward, created if not exist, only forwarders create them
+func (m *Metrics) forward(source netip.AddrPort, dest string) *forwardStats {
+	if m == nil {
+		return &forwardStats{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := forwardKey{source: source, dest: dest}
+	s, ok := m.forwards[k]
+	if !ok {
+		s = &forwardStats{}
+		m.forwards[k] = s
+	}
+	return s
+}
+
+// stats of the forward for reading, zero if it's never forwarded or it's
+// removed, without creating it
+func (m *Metrics) get(source netip.AddrPort, dest string) *forwardStats {
+	if m == nil {
+		return &forwardStats{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.forwards[forwardKey{source: source, dest: dest}]; ok {
+		return s
+	}
+	return &forwardStats{}
+}
+
+// forget stats of the forward, a forward created later starts from zero
+func (m *Metrics) remove(source netip.AddrPort, dest string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.forwards, forwardKey{source: source, dest: dest})
+}
+
+// stats of tunnel with id, zero for invalid tunnels,
+// returns error if tunnel with id does not exist
+func (tm *TunnelManager) GetStats(id uint64) (TunnelStats, error) {
+	t, err := tm.GetTunnel(id)
+	if err != nil {
+		return TunnelStats{}, err
+	}
+	return tm.statsOf(t), nil
+}
+
+func (tm *TunnelManager) statsOf(t Tunnel) TunnelStats {
+	src, err := t.ParseSource()
+	if err != nil {
+		return TunnelStats{}
+	}
+	return tm.metrics.get(src, t.Dest).snapshot()
+}
+
+// publish tunnel.stats every statsInterval while anyone receives them,
+// until quit is closed
+func (tm *TunnelManager) publishStats(quit <-chan struct{}) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !tm.events.WantsStats() {
+				continue
+			}
+			e := Event{Type: EventTunnelStats, Stats: make(map[uint64]TunnelStats)}
+			for _, t := range tm.GetTunnels() {
+				e.Stats[t.ID] = tm.statsOf(t)
+			}
+			tm.events.Publish(e)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// tunnels with Stats set, for API responses
+func (tm *TunnelManager) withStats(tunnels ...Tunnel) []Tunnel {
+	for i := range tunnels {
+		s := tm.statsOf(tunnels[i])
+		tunnels[i].Stats = &s
+	}
+	return tunnels
+}
+
+var (
+	tunnelLabels = []string{"tunnel_id", "name", "source", "dest"}
+
+	descBytesSent = prometheus.NewDesc("gopolar_tunnel_sent_bytes_total",
+		"Bytes sent from clients to dest.", tunnelLabels, nil)
+	descBytesRecv = prometheus.NewDesc("gopolar_tunnel_received_bytes_total",
+		"Bytes received from dest.", tunnelLabels, nil)
+	descAccepted = prometheus.NewDesc("gopolar_tunnel_connections_accepted_total",
+		"Client connections forwarded to dest.", tunnelLabels, nil)
+	descRejected = prometheus.NewDesc("gopolar_tunnel_connections_rejected_total",
+		"Client connections closed as no dest of the source could be dialed.", tunnelLabels, nil)
+	descActive = prometheus.NewDesc("gopolar_tunnel_connections_active",
+		"Connections to dest open now, including draining ones.", tunnelLabels, nil)
+	descDialFailures = prometheus.NewDesc("gopolar_tunnel_dial_failures_total",
+		"Failed dials to dest.", tunnelLabels, nil)
+	descDuration = prometheus.NewDesc("gopolar_tunnel_connection_duration_seconds",
+		"Duration of closed connections to dest.", tunnelLabels, nil)
+)
+
+// collects metrics of tunnels in tm, invalid tunnels are omitted
+type tunnelCollector struct {
+	tm *TunnelManager
+}
+
+func (c tunnelCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descBytesSent, descBytesRecv, descAccepted, descRejected, descActive, descDialFailures, descDuration} {
+		ch <- d
+	}
+}
+
+func (c tunnelCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.tm.GetTunnels() {
+		src, err := t.ParseSource()
+		if err != nil {
+			continue
+		}
+		s := c.tm.metrics.get(src, t.Dest)
+		labels := []string{strconv.FormatUint(t.ID, 10), t.Name, t.Source, t.Dest}
+		counter := func(d *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+		}
+		counter(descBytesSent, s.bytesSent.Load())
+		counter(descBytesRecv, s.bytesRecv.Load())
+		counter(descAccepted, s.accepted.Load())
+		counter(descRejected, s.rejected.Load())
+		counter(descDialFailures, s.dialFailures.Load())
+		ch <- prometheus.MustNewConstMetric(descActive, prometheus.GaugeValue, float64(s.active.Load()), labels...)
+		count, sum, buckets := s.histogram()
+		ch <- prometheus.MustNewConstHistogram(descDuration, count, sum, buckets, labels...)
+	}
+}
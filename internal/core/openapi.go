@@ -0,0 +1,349 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+)
+
+// documentation of a route for openapi.json, every route registered in
+// setupRouter() must have one, see openAPISpec()
+type routeDoc struct {
+	Method    string
+	Path      string // as registered in gin, e.g. /tunnels/edit/:id
+	Summary   string
+	Query     []string    // names of optional date-time query parameters
+	Flags     []string    // names of optional boolean query parameters
+	Params    []string    // names of required string query parameters
+	Body      interface{} // JSON request body, nil if none
+	Status    int         // status on success, 0 for 200
+	Resp      interface{} // JSON response on success, nil if none
+	V1        bool        // Resp is "data" in {success, err_msg, data}
+	Stream    interface{} // JSON data of server-sent events, nil if not a stream
+	Binary    string      // media type of a binary response, e.g. application/octet-stream
+	Text      string      // media type of a text response, e.g. text/plain
+	WebSocket interface{} // JSON text messages sent over WebSocket, nil if not a WebSocket
+}
+
+type tunnelsData struct {
+	Tunnels  []Tunnel    `json:"tunnels"`
+	Draining []DrainInfo `json:"draining"`
+}
+
+type idData struct {
+	ID uint64 `json:"id"`
+}
+
+type tokensData struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+type auditData struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+type aboutData struct {
+	About AboutInfo `json:"about"`
+}
+
+type tunnelListV2 struct {
+	Tunnels []Tunnel `json:"tunnels"`
+}
+
+type drainingV2 struct {
+	Draining []DrainInfo `json:"draining"`
+}
+
+type connectionsV2 struct {
+	Connections []ConnInfo `json:"connections"`
+}
+
+type logsV2 struct {
+	Logs []LogFile `json:"logs"`
+}
+
+var timeQuery = []string{"since", "until"}
+
+var routeDocs = []routeDoc{
+	{Method: "GET", Path: "/tunnels/list", Summary: "List tunnels and draining connections", Resp: tunnelsData{}, V1: true},
+	{Method: "POST", Path: "/tunnels/create", Summary: "Create a tunnel", Body: CreateTunnelBody{}, Resp: idData{}, V1: true},
+	{Method: "POST", Path: "/tunnels/edit/:id", Summary: "Edit a tunnel", Body: EditTunnelBody{}, Resp: struct{}{}, V1: true},
+	{Method: "POST", Path: "/tunnels/toggle/:id", Summary: "Enable or disable a tunnel", Resp: struct{}{}, V1: true},
+	{Method: "DELETE", Path: "/tunnels/delete/:id", Summary: "Delete a tunnel", Resp: struct{}{}, V1: true},
+	{Method: "GET", Path: "/tokens/list", Summary: "List API tokens", Resp: tokensData{}, V1: true},
+	{Method: "POST", Path: "/tokens/create", Summary: "Create an API token", Body: CreateTokenBody{}, Resp: CreateTokenResponse{}, V1: true},
+	{Method: "DELETE", Path: "/tokens/delete/:id", Summary: "Revoke an API token", Resp: struct{}{}, V1: true},
+	{Method: "GET", Path: "/audit", Summary: "Query audit log", Query: timeQuery, Resp: auditData{}, V1: true},
+	{Method: "GET", Path: "/about", Summary: "Information about gopolar", Resp: aboutData{}, V1: true},
+	{Method: "GET", Path: "/events", Summary: "Stream events of tunnels and connections", Flags: []string{"stats"}, Stream: Event{}},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics of tunnels", Text: "text/plain; version=0.0.4"},
+
+	{Method: "GET", Path: "/api/v2/tunnels", Summary: "List tunnels", Resp: tunnelListV2{}},
+	{Method: "POST", Path: "/api/v2/tunnels", Summary: "Create a tunnel", Body: CreateTunnelBodyV2{}, Status: http.StatusCreated, Resp: Tunnel{}},
+	{Method: "GET", Path: "/api/v2/tunnels/:id", Summary: "Get a tunnel", Resp: Tunnel{}},
+	{Method: "PATCH", Path: "/api/v2/tunnels/:id", Summary: "Change fields of a tunnel", Body: TunnelPatch{}, Resp: Tunnel{}},
+	{Method: "DELETE", Path: "/api/v2/tunnels/:id", Summary: "Delete a tunnel", Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v2/tunnels/:id/enable", Summary: "Enable a tunnel", Resp: Tunnel{}},
+	{Method: "POST", Path: "/api/v2/tunnels/:id/disable", Summary: "Disable a tunnel", Resp: Tunnel{}},
+	{Method: "GET", Path: "/api/v2/tunnels/:id/connections", Summary: "List client connections of a tunnel", Resp: connectionsV2{}},
+	{Method: "GET", Path: "/api/v2/tunnels/:id/tap", Summary: "Stream traffic of a tunnel over WebSocket", Status: http.StatusSwitchingProtocols, WebSocket: TapFrame{}},
+	{Method: "PUT", Path: "/api/v2/tunnels/:id/capture", Summary: "Capture traffic of a tunnel", Body: CaptureConfig{}, Resp: Tunnel{}},
+	{Method: "DELETE", Path: "/api/v2/tunnels/:id/capture", Summary: "Capture a tunnel as configured by logs", Resp: Tunnel{}},
+	{Method: "GET", Path: "/api/v2/tunnels/:id/captures/:conn", Summary: "Export captures of a client connection as pcapng", Binary: "application/x-pcapng"},
+	{Method: "DELETE", Path: "/api/v2/connections/:id", Summary: "Close a client connection", Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v2/draining", Summary: "List draining connections", Resp: drainingV2{}},
+	{Method: "GET", Path: "/api/v2/tokens", Summary: "List API tokens", Resp: tokensData{}},
+	{Method: "POST", Path: "/api/v2/tokens", Summary: "Create an API token", Body: CreateTokenBody{}, Status: http.StatusCreated, Resp: CreateTokenResponse{}},
+	{Method: "DELETE", Path: "/api/v2/tokens/:id", Summary: "Revoke an API token", Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v2/audit", Summary: "Query audit log", Query: timeQuery, Resp: auditData{}},
+	{Method: "GET", Path: "/api/v2/logs", Summary: "List log files of connections", Resp: logsV2{}},
+	{Method: "GET", Path: "/api/v2/logs/file", Summary: "Download a log file", Params: []string{"path"}, Binary: "application/octet-stream"},
+	{Method: "GET", Path: "/api/v2/about", Summary: "Information about gopolar", Resp: AboutInfo{}},
+
+	{Method: "GET", Path: "/openapi.json", Summary: "This document, no token required"},
+}
+
+// routes that do not require API token
+var publicRoutes = map[string]bool{
+	"GET /openapi.json": true,
+}
+
+var ginParamRegexp = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+// path parameters that are not IDs
+var pathParamSchemas = map[string]interface{}{
+	"conn": map[string]interface{}{"type": "string", "pattern": `^[0-9]+\.pcapng$`}, // connection ID with extension
+}
+
+// builds JSON schemas of Go types, named structs go to components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema of the type, following encoding/json rules
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == reflect.TypeOf(Scope("")) {
+		return map[string]interface{}{"type": "string", "enum": []Scope{ScopeRead, ScopeOperate, ScopeAdmin}}
+	}
+	if t == reflect.TypeOf(capture.Type(0)) {
+		return map[string]interface{}{"type": "string", "enum": []capture.Type{capture.Open, capture.Send, capture.Recv, capture.Close}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return map[string]interface{}{"oneOf": []interface{}{b.schema(t.Elem()), map[string]interface{}{"type": "null"}}}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = nil // recursive types
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// schema of struct t with fields named by json tags
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for _, f := range jsonFields(t) {
+		props[f.name] = b.schema(f.typ)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// fields of struct t in JSON, without embedded structs
+func jsonFields(t reflect.Type) []jsonField {
+	ret := []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		ret = append(ret, jsonField{name: name, typ: f.Type})
+	}
+	return ret
+}
+
+// OpenAPI 3.1 document of routeDocs
+func openAPISpec() map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	errorRef := b.schema(reflect.TypeOf(ErrorBody{}))
+	paths := make(map[string]map[string]interface{})
+	for _, d := range routeDocs {
+		op := map[string]interface{}{
+			"summary":     d.Summary,
+			"operationId": operationID(d),
+		}
+		if publicRoutes[d.Method+" "+d.Path] {
+			op["security"] = []interface{}{}
+		} else {
+			op["x-scope"] = requiredScope(d.Method, d.Path)
+		}
+
+		params := []interface{}{}
+		for _, m := range ginParamRegexp.FindAllStringSubmatch(d.Path, -1) {
+			schema, ok := pathParamSchemas[m[1]]
+			if !ok {
+				schema = map[string]interface{}{"type": "integer", "minimum": 0}
+			}
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": schema,
+			})
+		}
+		for _, q := range d.Params {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range d.Query {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query",
+				"schema": map[string]interface{}{"type": "string", "format": "date-time"},
+			})
+		}
+		for _, q := range d.Flags {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query",
+				"schema": map[string]interface{}{"type": "boolean"},
+			})
+		}
+		if len(params) != 0 {
+			op["parameters"] = params
+		}
+		if d.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(b.schema(reflect.TypeOf(d.Body))),
+			}
+		}
+
+		status := d.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]interface{}{"description": http.StatusText(status)}
+		if d.V1 {
+			resp["content"] = jsonContent(map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"success": map[string]interface{}{"type": "boolean"},
+					"err_msg": map[string]interface{}{"type": "string"},
+					"data":    b.schema(reflect.TypeOf(d.Resp)),
+				},
+			})
+		} else if d.Stream != nil {
+			resp["content"] = map[string]interface{}{
+				"text/event-stream": map[string]interface{}{
+					"schema":        map[string]interface{}{"type": "string"},
+					"x-data-schema": b.schema(reflect.TypeOf(d.Stream)),
+				},
+			}
+		} else if d.WebSocket != nil {
+			resp["x-websocket-message-schema"] = b.schema(reflect.TypeOf(d.WebSocket))
+		} else if d.Binary != "" {
+			resp["content"] = map[string]interface{}{
+				d.Binary: map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string", "contentMediaType": d.Binary},
+				},
+			}
+		} else if d.Text != "" {
+			resp["content"] = map[string]interface{}{
+				d.Text: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		} else if d.Resp != nil {
+			resp["content"] = jsonContent(b.schema(reflect.TypeOf(d.Resp)))
+		} else if d.Path == "/openapi.json" {
+			resp["content"] = jsonContent(map[string]interface{}{"type": "object"})
+		}
+		responses := map[string]interface{}{fmt.Sprint(status): resp}
+		if strings.HasPrefix(d.Path, apiV2Prefix+"/") {
+			responses["default"] = map[string]interface{}{
+				"description": "Error",
+				"content":     jsonContent(errorRef),
+			}
+		}
+		op["responses"] = responses
+
+		path := ginParamRegexp.ReplaceAllString(d.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(d.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "gopolar",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// e.g. GET /api/v2/tunnels/:id -> getApiV2TunnelsId
+func operationID(d routeDoc) string {
+	id := strings.ToLower(d.Method)
+	for _, part := range strings.FieldsFunc(d.Path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
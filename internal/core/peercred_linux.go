@@ -0,0 +1,29 @@
+//go:build linux
+
+package core
+
+import (
+	"net"
+	"syscall"
+)
+
+const peerCredSupported = true
+
+func getPeerCred(c *net.UnixConn) (peerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+	return peerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
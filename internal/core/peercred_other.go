@@ -0,0 +1,12 @@
+//go:build !linux
+
+package core
+
+import "net"
+
+// callers on unix domain socket are only restricted by Config.SocketMode
+const peerCredSupported = false
+
+func getPeerCred(c *net.UnixConn) (peerCred, error) {
+	return peerCred{}, errPeerCredUnsupported
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// apply tunnels.toml to running tunnels incrementally:
+// tunnels missing from the file are removed, tunnels with a known ID are
+// edited and enabled/disabled as needed, others are created with a new ID,
+// the file is left untouched and nothing changes if it fails to parse,
+// otherwise all changes that can be applied are applied, and errors of
+// the rest are returned
+func (tm *TunnelManager) Reload() error {
+	if !tm.config.ReadSaved {
+		return fmt.Errorf("saved tunnels are ignored, nothing to reload")
+	}
+	saved, err := parseTunnels(tm.config.tunnelsPath())
+	if err != nil {
+		return fmt.Errorf("fail to parse %v: %w", tm.config.tunnelsPath(), err)
+	}
+	tm.mu.Lock()
+	tm.saveErr = nil // the file is fixed
+	tm.mu.Unlock()
+
+	current := make(map[uint64]Tunnel)
+	for _, t := range tm.GetTunnels() {
+		current[t.ID] = t
+	}
+	kept := make(map[uint64]bool)
+	edited := []Tunnel{}
+	created := []Tunnel{}
+	for _, st := range saved {
+		// unknown or duplicated ID in file is handled as created
+		if _, ok := current[st.ID]; !ok || kept[st.ID] {
+			created = append(created, st)
+			continue
+		}
+		kept[st.ID] = true
+		edited = append(edited, st)
+	}
+
+	var errs []error
+	// removed first, so their source and dest can be reused
+	for id := range current {
+		if !kept[id] {
+			Debugf("[reload] removing tunnel %v\n", id)
+			errs = append(errs, tm.removeTunnel(reloadCaller, id))
+		}
+	}
+	for _, st := range edited {
+		t := current[st.ID]
+		if st.Error != "" { // keep the running one
+			errs = append(errs, fmt.Errorf("tunnel %v: %v", st.ID, st.Error))
+			continue
+		}
+		if t.Name != st.Name || t.Source != st.Source || t.Dest != st.Dest {
+			Debugf("[reload] editing tunnel %v\n", st.ID)
+			if err := tm.changeTunnel(reloadCaller, st.ID, st.Name, st.Source, st.Dest); err != nil {
+				errs = append(errs, fmt.Errorf("tunnel %v: %w", st.ID, err))
+				continue
+			}
+		}
+		if t.Enable != st.Enable {
+			Debugf("[reload] toggling tunnel %v\n", st.ID)
+			if err := tm.toggleTunnel(reloadCaller, st.ID); err != nil {
+				errs = append(errs, fmt.Errorf("tunnel %v: %w", st.ID, err))
+			}
+		}
+	}
+	for _, st := range created {
+		Debugf("[reload] creating tunnel %v\n", st.Name)
+		if err := tm.loadTunnel(reloadCaller, st); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: %w", st.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reload tunnels.toml whenever it changes, until the returned watcher is closed,
+// bursts of events(e.g. editors writing a temp file then renaming it,
+// or tm saving the file itself) are merged into one reload
+func (tm *TunnelManager) watchTunnels() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watch the directory, the file itself may be replaced
+	if err := watcher.Add(filepath.Dir(tm.config.tunnelsPath())); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(ev.Name) != filepath.Base(tm.config.tunnelsPath()) ||
+					!ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(200*time.Millisecond, func() {
+					if err := tm.Reload(); err != nil {
+						log.Println("[reload] tunnels.toml:", err)
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("[reload] fail to watch tunnels.toml:", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// enforce config.LogRetention every Interval until quit is closed,
+// only once if Interval is 0
+func runRetention(cfg Config, quit <-chan struct{}) {
+	logDir := cfg.connLogDir()
+	enforceRetention(logDir, cfg.LogRetention, time.Now())
+	if cfg.LogRetention.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.LogRetention.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			enforceRetention(logDir, cfg.LogRetention, now)
+		}
+	}
+}
+
+// remove files in source dirs of logDir beyond r, oldest first,
+// including logs of older versions, returns number of files removed
+func enforceRetention(logDir string, r LogRetention, now time.Time) int {
+	files, err := readLogDir(logDir, true)
+	if err != nil {
+		log.Printf("[logger] fail to read log dir for retention: %v\n", err)
+		return 0
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Modified.Before(files[j].Modified)
+	})
+	removed := 0
+	remove := func(l LogFile) bool {
+		path := filepath.Join(logDir, l.Path)
+		if isCaptureOpen(path) || strings.HasSuffix(path, ".tmp") { // being compressed
+			return false
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[logger] fail to remove %v: %v\n", path, err)
+			return false
+		}
+		Debugf("[logger] removed %v by retention\n", l.Path)
+		removed++
+		return true
+	}
+
+	kept := []LogFile{}
+	for _, l := range files {
+		if r.MaxAge > 0 && now.Sub(l.Modified) > r.MaxAge && remove(l) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	if r.MaxTunnelSize > 0 {
+		sizes := make(map[string]int64) // source dir -> size of its files
+		for _, l := range kept {
+			sizes[filepath.Dir(l.Path)] += l.Size
+		}
+		next := []LogFile{}
+		for _, l := range kept {
+			dir := filepath.Dir(l.Path)
+			if sizes[dir] > int64(r.MaxTunnelSize) && remove(l) {
+				sizes[dir] -= l.Size
+				continue
+			}
+			next = append(next, l)
+		}
+		kept = next
+	}
+	if r.MaxTotalSize > 0 {
+		total := int64(0)
+		for _, l := range kept {
+			total += l.Size
+		}
+		for _, l := range kept {
+			if total <= int64(r.MaxTotalSize) {
+				break
+			}
+			if remove(l) {
+				total -= l.Size
+			}
+		}
+	}
+	return removed
+}
+
+// continue connection IDs after those in captures of previous runs, so
+// they are not reused
+func seedConnID(logDir string) {
+	files, err := readLogDir(logDir, false)
+	if err != nil {
+		return
+	}
+	for _, l := range files {
+		for {
+			last := lastConnID.Load()
+			if l.Connection <= last || lastConnID.CompareAndSwap(last, l.Connection) {
+				break
+			}
+		}
+	}
+}
@@ -1,40 +1,55 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const version = "1.0.0"
+
 func (tm *TunnelManager) setupRouter() {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New() // use gin.Default() for http log, gin.New() to omit
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:  []string{"*"},
-		AllowMethods:  []string{"*"},
-		AllowHeaders:  []string{"*"},
-		ExposeHeaders: []string{"*"},
-	}))
+	// no CORS headers means browsers only allow same origin
+	if len(tm.config.CORSOrigins) != 0 {
+		router.Use(cors.New(cors.Config{
+			AllowOrigins:  tm.config.CORSOrigins,
+			AllowMethods:  []string{"*"},
+			AllowHeaders:  []string{"*"},
+			ExposeHeaders: []string{"*"},
+		}))
+	}
+	if tm.config.LoopbackOnly {
+		router.Use(loopbackMiddleware())
+	}
+	router.Use(tm.peerCredMiddleware())
 
 	// webui integration
-	webuiPath := os.Getenv("GOPATH") + "/bin/gpwebui"
-	router.Use(static.Serve("/", static.LocalFile(webuiPath, false)))
+	if tm.config.WebUIPath != "" {
+		router.Use(static.Serve("/", static.LocalFile(tm.config.WebUIPath, false)))
+	}
+	// web UI is public, API is not
+	router.Use(tm.authMiddleware())
 
 	router.GET("/tunnels/list", func(ctx *gin.Context) {
 		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				Tunnels []Tunnel `json:"tunnels"`
-			} `json:"data"`
+			Success bool        `json:"success"`
+			ErrMsg  string      `json:"err_msg"`
+			Data    tunnelsData `json:"data"`
 		}
 		response.Success = true
-		response.Data.Tunnels = tm.GetTunnels()
+		response.Data.Tunnels = tm.withStats(tm.GetTunnels()...)
+		response.Data.Draining = tm.GetDraining()
 		ctx.JSON(http.StatusOK, response)
 	})
 
@@ -42,9 +57,7 @@ func (tm *TunnelManager) setupRouter() {
 		var response struct {
 			Success bool   `json:"success"`
 			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				ID uint64 `json:"id"`
-			} `json:"data"`
+			Data    idData `json:"data"`
 		}
 		response.Success = true
 		request := CreateTunnelBody{}
@@ -53,11 +66,11 @@ func (tm *TunnelManager) setupRouter() {
 		newTunnel := Tunnel{
 			// ID:     ,
 			Name:   request.Name,
-			Enable: true, // new tunnels are enabled by default
+			Enable: tm.config.TunnelDefaults.Enable,
 			Source: request.Source,
 			Dest:   request.Dest,
 		}
-		newTunnelID, err := tm.AddTunnel(newTunnel)
+		newTunnelID, err := tm.addTunnel(callerOf(ctx), newTunnel)
 		if err != nil {
 			response.Success = false
 			response.ErrMsg = fmt.Sprint(err)
@@ -89,7 +102,7 @@ func (tm *TunnelManager) setupRouter() {
 			ctx.JSON(http.StatusOK, response)
 			return
 		}
-		err = tm.ChangeTunnel(id, request.NewName, request.NewSource, request.NewDest)
+		err = tm.changeTunnel(callerOf(ctx), id, request.NewName, request.NewSource, request.NewDest)
 		if err != nil {
 			response.Success = false
 			response.ErrMsg = fmt.Sprint(err)
@@ -115,7 +128,7 @@ func (tm *TunnelManager) setupRouter() {
 			return
 		}
 
-		err = tm.ToggleTunnel(id)
+		err = tm.toggleTunnel(callerOf(ctx), id)
 		if err != nil {
 			response.Success = false
 			response.ErrMsg = fmt.Sprint(err)
@@ -141,7 +154,7 @@ func (tm *TunnelManager) setupRouter() {
 			return
 		}
 
-		err = tm.RemoveTunnel(id)
+		err = tm.removeTunnel(callerOf(ctx), id)
 		if err != nil {
 			response.Success = false
 			response.ErrMsg = fmt.Sprint(err)
@@ -149,21 +162,149 @@ func (tm *TunnelManager) setupRouter() {
 		ctx.JSON(http.StatusOK, response)
 	})
 
-	router.GET("/about", func(ctx *gin.Context) {
+	router.GET("/tokens/list", func(ctx *gin.Context) {
+		var response struct {
+			Success bool       `json:"success"`
+			ErrMsg  string     `json:"err_msg"`
+			Data    tokensData `json:"data"`
+		}
+		response.Success = true
+		response.Data.Tokens = tm.GetTokens()
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	router.POST("/tokens/create", func(ctx *gin.Context) {
+		var response struct {
+			Success bool                `json:"success"`
+			ErrMsg  string              `json:"err_msg"`
+			Data    CreateTokenResponse `json:"data"`
+		}
+		response.Success = true
+		request := CreateTokenBody{}
+		ctx.Bind(&request)
+
+		token, secret, err := tm.CreateToken(request.Name, request.Scope)
+		if err != nil {
+			response.Success = false
+			response.ErrMsg = fmt.Sprint(err)
+		} else {
+			response.Data.Token = token
+			response.Data.Secret = secret
+		}
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	router.DELETE("/tokens/delete/:id", func(ctx *gin.Context) {
 		var response struct {
 			Success bool   `json:"success"`
 			ErrMsg  string `json:"err_msg"`
 			Data    struct {
-				About AboutInfo `json:"about"`
 			} `json:"data"`
 		}
 		response.Success = true
+		id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+		if err != nil {
+			response.Success = false
+			response.ErrMsg = fmt.Sprint(err)
+			ctx.JSON(http.StatusOK, response)
+			return
+		}
+
+		err = tm.RevokeToken(id)
+		if err != nil {
+			response.Success = false
+			response.ErrMsg = fmt.Sprint(err)
+		}
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	router.GET("/audit", func(ctx *gin.Context) {
+		var response struct {
+			Success bool      `json:"success"`
+			ErrMsg  string    `json:"err_msg"`
+			Data    auditData `json:"data"`
+		}
+		response.Success = true
+		var since, until time.Time
+		var err error
+		if s := ctx.Query("since"); s != "" {
+			since, err = time.Parse(time.RFC3339, s)
+		}
+		if s := ctx.Query("until"); s != "" && err == nil {
+			until, err = time.Parse(time.RFC3339, s)
+		}
+		if err == nil {
+			response.Data.Entries, err = tm.GetAudit(since, until)
+		}
+		if err != nil {
+			response.Success = false
+			response.ErrMsg = fmt.Sprint(err)
+		}
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	router.GET("/about", func(ctx *gin.Context) {
+		var response struct {
+			Success bool      `json:"success"`
+			ErrMsg  string    `json:"err_msg"`
+			Data    aboutData `json:"data"`
+		}
+		response.Success = true
 
 		response.Data.About = AboutInfo{
-			Version: "1.0.0",
+			Version: version,
 		}
 		ctx.JSON(http.StatusOK, response)
 	})
 
+	// server-sent events, see Event
+	router.GET("/events", func(ctx *gin.Context) {
+		subscribe := tm.events.Subscribe
+		if stats, _ := strconv.ParseBool(ctx.Query("stats")); stats {
+			subscribe = tm.events.SubscribeStats
+		}
+		events, cancel := subscribe()
+		defer cancel()
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no") // for reverse proxies
+		ctx.Status(http.StatusOK)
+		ctx.Writer.Flush()
+
+		ping := time.NewTicker(eventPingInterval)
+		defer ping.Stop()
+		ctx.Stream(func(w io.Writer) bool {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return false
+				}
+				b, err := json.Marshal(e)
+				if err != nil {
+					return true
+				}
+				_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, b)
+				return err == nil
+			case <-ping.C:
+				_, err := io.WriteString(w, ": ping\n\n") // keep proxies from timing out
+				return err == nil
+			case <-ctx.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
+	// prometheus metrics of tunnels, see tunnelCollector
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tunnelCollector{tm: tm})
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+
+	tm.setupRouterV2(router)
+
+	spec := openAPISpec()
+	router.GET("/openapi.json", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, spec)
+	})
+
 	tm.router = router
 }
@@ -0,0 +1,443 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const apiV2Prefix = "/api/v2"
+
+// body of all errors in API v2
+type ErrorBody struct {
+	Error struct {
+		Code    string `json:"code"` // see Code* constants
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type CreateTunnelBodyV2 struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	Enable *bool  `json:"enable"` // default to tunnel_defaults.enable
+}
+
+type CreateTokenResponse struct {
+	Token  APIToken `json:"token"`
+	Secret string   `json:"secret"` // only returned here
+}
+
+var codeStatus = map[string]int{
+	CodeInvalidArgument:    http.StatusBadRequest,
+	CodeUnauthenticated:    http.StatusUnauthorized,
+	CodePermissionDenied:   http.StatusForbidden,
+	CodeNotFound:           http.StatusNotFound,
+	CodeAlreadyExists:      http.StatusConflict,
+	CodeFailedPrecondition: http.StatusConflict,
+	CodeInternal:           http.StatusInternalServerError,
+}
+
+var statusCode = map[int]string{
+	http.StatusUnauthorized: CodeUnauthenticated,
+	http.StatusForbidden:    CodePermissionDenied,
+}
+
+func isV2(ctx *gin.Context) bool {
+	return strings.HasPrefix(ctx.Request.URL.Path, apiV2Prefix+"/")
+}
+
+func abortWithErrorV2(ctx *gin.Context, err error) {
+	code := ErrorCode(err)
+	body := ErrorBody{}
+	body.Error.Code = code
+	body.Error.Message = err.Error()
+	ctx.AbortWithStatusJSON(codeStatus[code], body)
+}
+
+// ID in route parameter "id"
+func paramID(ctx *gin.Context) (uint64, error) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return 0, errorf(CodeInvalidArgument, "invalid ID %q", ctx.Param("id"))
+	}
+	return id, nil
+}
+
+// bind JSON body to obj
+func bindV2(ctx *gin.Context, obj interface{}) error {
+	if err := ctx.ShouldBindJSON(obj); err != nil {
+		return errorf(CodeInvalidArgument, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// resource style API with HTTP status codes, errors are in ErrorBody
+func (tm *TunnelManager) setupRouterV2(router *gin.Engine) {
+	v2 := router.Group(apiV2Prefix)
+
+	v2.GET("/tunnels", func(ctx *gin.Context) {
+		response := tunnelListV2{}
+		response.Tunnels = tm.withStats(tm.GetTunnels()...)
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	v2.POST("/tunnels", func(ctx *gin.Context) {
+		request := CreateTunnelBodyV2{}
+		if err := bindV2(ctx, &request); err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		if request.Source == "" || request.Dest == "" {
+			abortWithErrorV2(ctx, errorf(CodeInvalidArgument, "source and dest must be specified"))
+			return
+		}
+		enable := tm.config.TunnelDefaults.Enable
+		if request.Enable != nil {
+			enable = *request.Enable
+		}
+		id, err := tm.addTunnel(callerOf(ctx), Tunnel{
+			Name:   request.Name,
+			Enable: enable,
+			Source: request.Source,
+			Dest:   request.Dest,
+		})
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		t, err := tm.GetTunnel(id)
+		if err != nil { // removed just now
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.Header("Location", fmt.Sprintf("%v/tunnels/%v", apiV2Prefix, id))
+		ctx.JSON(http.StatusCreated, tm.withStats(t)[0])
+	})
+
+	v2.GET("/tunnels/:id", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err == nil {
+			var t Tunnel
+			if t, err = tm.GetTunnel(id); err == nil {
+				ctx.JSON(http.StatusOK, tm.withStats(t)[0])
+				return
+			}
+		}
+		abortWithErrorV2(ctx, err)
+	})
+
+	v2.PATCH("/tunnels/:id", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		request := TunnelPatch{}
+		if err := bindV2(ctx, &request); err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		tm.respondTunnelV2(ctx, id, tm.updateTunnel(callerOf(ctx), id, request))
+	})
+
+	v2.DELETE("/tunnels/:id", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err == nil {
+			err = tm.removeTunnel(callerOf(ctx), id)
+		}
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	for _, action := range []string{"enable", "disable"} {
+		enable := action == "enable"
+		v2.POST("/tunnels/:id/"+action, func(ctx *gin.Context) {
+			id, err := paramID(ctx)
+			if err != nil {
+				abortWithErrorV2(ctx, err)
+				return
+			}
+			tm.respondTunnelV2(ctx, id, tm.enableTunnel(callerOf(ctx), id, enable))
+		})
+	}
+
+	v2.GET("/tunnels/:id/connections", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err == nil {
+			response := connectionsV2{}
+			if response.Connections, err = tm.GetConnections(id); err == nil {
+				ctx.JSON(http.StatusOK, response)
+				return
+			}
+		}
+		abortWithErrorV2(ctx, err)
+	})
+
+	v2.PUT("/tunnels/:id/capture", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		request := CaptureConfig{}
+		if err := bindV2(ctx, &request); err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		tm.respondTunnelV2(ctx, id, tm.setCapture(callerOf(ctx), id, &request))
+	})
+
+	// back to config.DoLogs
+	v2.DELETE("/tunnels/:id/capture", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		tm.respondTunnelV2(ctx, id, tm.setCapture(callerOf(ctx), id, nil))
+	})
+
+	v2.GET("/tunnels/:id/tap", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		if !websocket.IsWebSocketUpgrade(ctx.Request) {
+			abortWithErrorV2(ctx, errorf(CodeInvalidArgument, "tap must be requested as WebSocket"))
+			return
+		}
+		frames, cancel, err := tm.Tap(id)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		defer cancel()
+		serveTap(ctx, frames)
+	})
+
+	// :conn is e.g. 12.pcapng, so the download is named after it
+	v2.GET("/tunnels/:id/captures/:conn", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		name, ok := strings.CutSuffix(ctx.Param("conn"), ".pcapng")
+		conn, err := strconv.ParseUint(name, 10, 64)
+		if !ok || err != nil {
+			abortWithErrorV2(ctx, errorf(CodeNotFound, "no capture %q, expect CONNECTION_ID.pcapng", ctx.Param("conn")))
+			return
+		}
+		if _, err := tm.GetCaptures(id, conn); err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		// streamed, captures can be large
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="tunnel-%v-%v.pcapng"`, id, conn))
+		ctx.Header("Content-Type", "application/x-pcapng")
+		ctx.Status(http.StatusOK)
+		if err := tm.WritePcapng(ctx.Writer, id, conn); err != nil {
+			if !ctx.Writer.Written() { // e.g. removed by retention since checked
+				ctx.Writer.Header().Del("Content-Disposition")
+				ctx.Writer.Header().Del("Content-Type")
+				abortWithErrorV2(ctx, err)
+				return
+			}
+			log.Printf("[api] pcapng of connection %v of tunnel %v is cut short: %v\n", conn, id, err)
+			ctx.Abort()
+		}
+	})
+
+	v2.DELETE("/connections/:id", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err == nil {
+			err = tm.CloseConnection(id)
+		}
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	v2.GET("/draining", func(ctx *gin.Context) {
+		response := drainingV2{}
+		response.Draining = tm.GetDraining()
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	v2.GET("/tokens", func(ctx *gin.Context) {
+		response := tokensData{}
+		response.Tokens = tm.GetTokens()
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	v2.POST("/tokens", func(ctx *gin.Context) {
+		request := CreateTokenBody{}
+		if err := bindV2(ctx, &request); err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		token, secret, err := tm.CreateToken(request.Name, request.Scope)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusCreated, CreateTokenResponse{Token: token, Secret: secret})
+	})
+
+	v2.DELETE("/tokens/:id", func(ctx *gin.Context) {
+		id, err := paramID(ctx)
+		if err == nil {
+			err = tm.RevokeToken(id)
+		}
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	v2.GET("/audit", func(ctx *gin.Context) {
+		var since, until time.Time
+		var err error
+		if s := ctx.Query("since"); s != "" {
+			since, err = time.Parse(time.RFC3339, s)
+		}
+		if s := ctx.Query("until"); s != "" && err == nil {
+			until, err = time.Parse(time.RFC3339, s)
+		}
+		if err != nil {
+			abortWithErrorV2(ctx, errorf(CodeInvalidArgument, "%v", err))
+			return
+		}
+		response := auditData{}
+		response.Entries, err = tm.GetAudit(since, until)
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	v2.GET("/logs", func(ctx *gin.Context) {
+		logs, err := tm.GetLogs()
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, logsV2{Logs: logs})
+	})
+
+	v2.GET("/logs/file", func(ctx *gin.Context) {
+		f, err := tm.OpenLog(ctx.Query("path"))
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			abortWithErrorV2(ctx, err)
+			return
+		}
+		ctx.DataFromReader(http.StatusOK, info.Size(), "application/octet-stream", f, nil)
+	})
+
+	v2.GET("/about", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, AboutInfo{Version: version})
+	})
+
+	router.NoRoute(func(ctx *gin.Context) {
+		if isV2(ctx) {
+			abortWithErrorV2(ctx, errorf(CodeNotFound, "no route %v %v", ctx.Request.Method, ctx.Request.URL.Path))
+		}
+	})
+}
+
+// respond with tunnel id after it's changed by an operation returning err,
+// the tunnel is changed even if err is not nil in some cases,
+// e.g. it fails to start after being edited
+func (tm *TunnelManager) respondTunnelV2(ctx *gin.Context, id uint64, err error) {
+	if err != nil {
+		abortWithErrorV2(ctx, err)
+		return
+	}
+	t, err := tm.GetTunnel(id)
+	if err != nil {
+		abortWithErrorV2(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tm.withStats(t)[0])
+}
+
+// error of middlewares in API v2 shape, code is derived from HTTP status
+func abortMiddlewareV2(ctx *gin.Context, status int, msg string) {
+	code, ok := statusCode[status]
+	if !ok {
+		code = CodeInternal
+	}
+	abortWithErrorV2(ctx, &Error{Code: code, Msg: msg})
+}
+
+// how long writing a message of a tap may take before it's closed
+const tapWriteTimeout = 10 * time.Second
+
+// only same origin(or no Origin, e.g. gpctl) can connect by default
+var tapUpgrader = websocket.Upgrader{}
+
+// send frames to the WebSocket upgraded from ctx as JSON text messages,
+// until the channel is closed or the peer goes away
+func serveTap(ctx *gin.Context, frames <-chan TapFrame) {
+	conn, err := tapUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil { // Upgrade() has responded
+		Debugf("[tap] fail to upgrade: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// messages from the peer are ignored, reading handles pings and close
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tunnel is edited or removed, or gpcore is shutting down")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(tapWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(tapWriteTimeout))
+			if err := conn.WriteJSON(f); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tapWriteTimeout)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
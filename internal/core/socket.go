@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// credentials of the process on the other end of a unix domain socket
+type peerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+type peerCredKey struct{}
+
+type peerCredResult struct {
+	cred peerCred
+	err  error
+}
+
+// used as http.Server.ConnContext, attach credentials of the caller
+// on unix domain socket to ctx
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := getPeerCred(uc)
+	return context.WithValue(ctx, peerCredKey{}, peerCredResult{cred: cred, err: err})
+}
+
+// set mode and group of the socket at cfg.SocketPath,
+// callers are still checked by peerCredMiddleware() before this is done
+func setupSocket(cfg Config) error {
+	if cfg.SocketGroup != "" {
+		gid, err := lookupGroup(cfg.SocketGroup)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(cfg.SocketPath, -1, gid); err != nil {
+			return fmt.Errorf("fail to set group of %v: %w", cfg.SocketPath, err)
+		}
+	}
+	if cfg.SocketMode != 0 {
+		if err := os.Chmod(cfg.SocketPath, cfg.SocketMode); err != nil {
+			return fmt.Errorf("fail to set mode of %v: %w", cfg.SocketPath, err)
+		}
+	}
+	return nil
+}
+
+// gid of group name, or group given by gid
+func lookupGroup(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		g, err = user.LookupGroupId(group)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unknown socket_group %q", group)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// whether the caller is the user running gpcore, or allowed by config
+func (cfg Config) peerAllowed(cred peerCred) bool {
+	return int(cred.UID) == os.Getuid() ||
+		slices.Contains(cfg.SocketAllowUIDs, cred.UID) ||
+		slices.Contains(cfg.SocketAllowGIDs, cred.GID)
+}
+
+// reject callers on unix domain socket not allowed by config,
+// requests on TCP are not affected
+func (tm *TunnelManager) peerCredMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		r, ok := ctx.Request.Context().Value(peerCredKey{}).(peerCredResult)
+		if !ok || errors.Is(r.err, errPeerCredUnsupported) {
+			ctx.Next()
+			return
+		}
+		if r.err != nil {
+			abortWithError(ctx, http.StatusForbidden, fmt.Sprintf("fail to get peer credentials: %v", r.err))
+			return
+		}
+		if !tm.config.peerAllowed(r.cred) {
+			abortWithError(ctx, http.StatusForbidden, fmt.Sprintf("uid %v gid %v is not allowed on %v", r.cred.UID, r.cred.GID, tm.config.SocketPath))
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+)
+
+// a chunk of traffic of a client connection, or its connection to a dest
+// being opened or closed, see TapBus
+type TapFrame struct {
+	Connection uint64       `json:"connection"` // see ConnInfo
+	Type       capture.Type `json:"type"`       // open, send(client to dest), recv or close
+	Time       time.Time    `json:"time"`
+	Dest       string       `json:"dest"`
+	Data       []byte       `json:"data,omitempty"` // send and recv, base64 in JSON
+	// frames dropped before this one since the subscriber fell behind
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// subscribers of a tunnel, forwarded by the forwarder of source to dest
+type tapKey struct {
+	source netip.AddrPort
+	dest   string
+}
+
+type tapSub struct {
+	ch      chan TapFrame
+	dropped uint64
+}
+
+// fan out traffic of tunnels to subscribers, frames are dropped for
+// subscribers too slow to keep up instead of slowing down forwarding,
+// a nil *TapBus drops all frames
+type TapBus struct {
+	n      atomic.Int64 // number of subscribers, read without mu by Active()
+	subs   map[tapKey]map[*tapSub]bool
+	closed bool
+	mu     sync.Mutex
+}
+
+func NewTapBus() *TapBus {
+	return &TapBus{
+		subs: make(map[tapKey]map[*tapSub]bool),
+	}
+}
+
+// false if there is no subscriber of any tunnel, so forwarders skip
+// publishing at the cost of an atomic load
+func (b *TapBus) Active() bool {
+	return b != nil && b.n.Load() != 0
+}
+
+// never blocks, f.Data is copied if any subscriber receives it
+func (b *TapBus) Publish(source netip.AddrPort, f TapFrame) {
+	if !b.Active() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := b.subs[tapKey{source, f.Dest}]
+	if len(subs) == 0 {
+		return
+	}
+	f.Data = append([]byte(nil), f.Data...)
+	for sub := range subs {
+		f.Dropped = sub.dropped
+		select {
+		case sub.ch <- f:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// receive frames of the tunnel from source to dest published from now on,
+// until cancel is called, or the channel is closed(see CloseTunnel() and
+// Close())
+func (b *TapBus) Subscribe(source netip.AddrPort, dest string) (frames <-chan TapFrame, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := &tapSub{ch: make(chan TapFrame, 256)}
+	if b.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	k := tapKey{source, dest}
+	if b.subs[k] == nil {
+		b.subs[k] = make(map[*tapSub]bool)
+	}
+	b.subs[k][sub] = true
+	b.n.Add(1)
+	return sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[k][sub] {
+			b.removeL(k, sub)
+		}
+	}
+}
+
+// b.mu must be held
+func (b *TapBus) removeL(k tapKey, sub *tapSub) {
+	close(sub.ch)
+	delete(b.subs[k], sub)
+	if len(b.subs[k]) == 0 {
+		delete(b.subs, k)
+	}
+	b.n.Add(-1)
+}
+
+// close channels of subscribers of the tunnel from source to dest, e.g.
+// when it's edited or removed
+func (b *TapBus) CloseTunnel(source netip.AddrPort, dest string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := tapKey{source, dest}
+	for sub := range b.subs[k] {
+		b.removeL(k, sub)
+	}
+}
+
+// close channels of all subscribers, no one can subscribe after this
+func (b *TapBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for k, subs := range b.subs {
+		for sub := range subs {
+			b.removeL(k, sub)
+		}
+	}
+}
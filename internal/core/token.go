@@ -0,0 +1,190 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// what an API token is allowed to do, each scope includes the ones before it
+type Scope string
+
+const (
+	ScopeRead    Scope = "read"    // list tunnels
+	ScopeOperate Scope = "operate" // start and stop tunnels
+	ScopeAdmin   Scope = "admin"   // create, edit and delete tunnels, manage tokens
+)
+
+func (s Scope) level() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeOperate:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+func (s Scope) Valid() bool {
+	return s.level() != 0
+}
+
+// whether a token of scope s can access routes requiring scope required
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && s.level() >= required.level()
+}
+
+// API token created via /tokens API, in addition to the admin token at
+// Config.TokenPath(), only hash of the secret is kept
+type APIToken struct {
+	ID      uint64    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   Scope     `json:"scope"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"-"` // hex of sha256 of the secret
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// read tokens from path, no tokens if it does not exist
+func readTokens(path string) ([]APIToken, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	ret := []APIToken{}
+	if err := v.UnmarshalKey("tokens", &ret); err != nil {
+		return nil, err
+	}
+	for _, t := range ret {
+		if !t.Scope.Valid() {
+			return nil, fmt.Errorf("token %v has invalid scope %q", t.ID, t.Scope)
+		}
+	}
+	return ret, nil
+}
+
+// save tokens to path, overwriting it, only readable by owner
+func writeTokens(path string, tokens []APIToken) error {
+	v := viper.New()
+	v.SetConfigPermissions(0600)
+	v.Set("tokens", tokens)
+	return v.WriteConfigAs(path)
+}
+
+// the token file, it's not in tm.tokens
+var defaultToken = APIToken{Name: "default", Scope: ScopeAdmin}
+
+// tm.mu must be held,
+// the token with secret, false if no token matches
+func (tm *TunnelManager) lookupTokenL(secret string) (APIToken, bool) {
+	if tm.token != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(tm.token)) == 1 {
+		return defaultToken, true
+	}
+	hash := []byte(hashToken(secret))
+	for _, t := range tm.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// tokens sorted by ID, without secrets
+func (tm *TunnelManager) GetTokens() []APIToken {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	ret := make([]APIToken, len(tm.tokens))
+	copy(ret, tm.tokens)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// returns the new token and its secret, the secret can not be retrieved later
+func (tm *TunnelManager) CreateToken(name string, scope Scope) (APIToken, string, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if !tm.config.Auth {
+		return APIToken{}, "", errorf(CodeFailedPrecondition, "authentication is disabled")
+	}
+	if name == "" {
+		return APIToken{}, "", errorf(CodeInvalidArgument, "token name must be specified")
+	}
+	if !scope.Valid() {
+		return APIToken{}, "", errorf(CodeInvalidArgument, "invalid scope %q, should be one of %v, %v, %v", scope, ScopeRead, ScopeOperate, ScopeAdmin)
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	var id uint64 = 1
+	for _, t := range tm.tokens {
+		id = max(id, t.ID+1)
+	}
+	t := APIToken{
+		ID:      id,
+		Name:    name,
+		Scope:   scope,
+		Created: time.Now().Truncate(time.Second),
+		Hash:    hashToken(secret),
+	}
+	tokens := append(tm.tokens[:len(tm.tokens):len(tm.tokens)], t)
+	if err := writeTokens(tm.config.tokensPath(), tokens); err != nil {
+		return APIToken{}, "", fmt.Errorf("fail to save tokens: %w", err)
+	}
+	tm.tokens = tokens
+	return t, secret, nil
+}
+
+// the token stops working immediately
+func (tm *TunnelManager) RevokeToken(id uint64) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if !tm.config.Auth {
+		return errorf(CodeFailedPrecondition, "authentication is disabled")
+	}
+	tokens := []APIToken{}
+	for _, t := range tm.tokens {
+		if t.ID != id {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(tm.tokens) {
+		return errorf(CodeNotFound, "no token of ID %v", id)
+	}
+	if err := writeTokens(tm.config.tokensPath(), tokens); err != nil {
+		return fmt.Errorf("fail to save tokens: %w", err)
+	}
+	tm.tokens = tokens
+	return nil
+}
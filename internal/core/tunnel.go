@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/netip"
 	"strings"
+	"time"
 )
 
 type Tunnel struct {
@@ -12,6 +13,27 @@ type Tunnel struct {
 	Enable bool   `json:"enable"`
 	Source string `json:"source"` // e.g. localhost:xxxx
 	Dest   string `json:"dest"`   // e.g. 192.168.1.0:7878, localhost:7878
+	// why the tunnel is invalid or fails to run, it's disabled if not empty,
+	// not saved to tunnels.toml
+	Error string `json:"error,omitempty" toml:"-" mapstructure:"-"`
+	// capture set at runtime, see CaptureConfig, not saved to tunnels.toml
+	Capture *CaptureConfig `json:"capture,omitempty" toml:"-" mapstructure:"-"`
+	// traffic while gpcore runs, only set in API responses
+	Stats *TunnelStats `json:"stats,omitempty" toml:"-" mapstructure:"-"`
+}
+
+// traffic of a tunnel since gpcore started, kept while it's disabled,
+// reset when its source or dest is edited
+type TunnelStats struct {
+	ActiveConnections int64      `json:"active_connections"` // including draining ones
+	TotalConnections  uint64     `json:"total_connections"`
+	BytesSent         uint64     `json:"bytes_sent"` // client to dest
+	BytesReceived     uint64     `json:"bytes_received"`
+	SendRate          float64    `json:"send_rate"` // bytes per second over the last minute
+	ReceiveRate       float64    `json:"receive_rate"`
+	LastError         string     `json:"last_error,omitempty"` // of dialing dest
+	LastErrorTime     *time.Time `json:"last_error_time,omitempty"`
+	LastActivity      *time.Time `json:"last_activity,omitempty"` // last connection or data
 }
 
 func (t Tunnel) String() string {
@@ -20,6 +42,9 @@ func (t Tunnel) String() string {
 	ret += fmt.Sprintf("\tEnable: %v\n", t.Enable)
 	ret += fmt.Sprintf("\tSource: %v\n", t.Source)
 	ret += fmt.Sprintf("\tDest: %v\n", t.Dest)
+	if t.Error != "" {
+		ret += fmt.Sprintf("\tError: %v\n", t.Error)
+	}
 	return ret
 }
 
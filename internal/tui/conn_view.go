@@ -0,0 +1,52 @@
+package tui
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/goverclock/gopolar/pkg/client"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/lipgloss"
+)
+
+func NewConnTableModel(connList []client.ConnInfo) *table.Model {
+	columns := []table.Column{
+		{Title: "ID", Width: 6},
+		{Title: "Client", Width: 22},
+		{Title: "Dests", Width: 20},
+		{Title: "Started", Width: 20},
+		{Title: "Sent", Width: 8},
+		{Title: "Recv", Width: 8},
+	}
+	tb := table.New(
+		table.WithColumns(columns),
+		table.WithRows(connsToRows(connList)),
+		table.WithHeight(10),
+		table.WithFocused(true),
+	)
+	tb.KeyMap.HalfPageDown.Unbind() // conflicts with 'd' - kill connection, so unbind it
+	tb.KeyMap.HalfPageUp.Unbind()
+	s := table.DefaultStyles()
+	s.Selected = s.Selected.
+		Foreground(lipgloss.Color("255")).
+		Background(lipgloss.Color("8")).
+		Bold(false)
+	tb.SetStyles(s)
+	return &tb
+}
+
+func connsToRows(connList []client.ConnInfo) []table.Row {
+	rows := []table.Row{}
+	for _, c := range connList {
+		rows = append(rows, table.Row{
+			strconv.FormatUint(c.ID, 10),
+			c.Client,
+			strings.Join(c.Dests, ","),
+			c.Started.Local().Format("2006-01-02 15:04:05"),
+			formatBytes(c.BytesSent),
+			formatBytes(c.BytesReceived),
+		})
+	}
+	return rows
+}
@@ -0,0 +1,86 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/client"
+)
+
+// e.g. 512B, 1.5K, 20.0M
+func formatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%vB", n)
+	}
+	v := float64(n) / 1024
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", v, units[i])
+}
+
+// e.g. 3s ago, never
+func formatAgo(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return fmt.Sprintf("%v ago(%v)", time.Since(*t).Truncate(time.Second), t.Local().Format("2006-01-02 15:04:05"))
+}
+
+// e.g. on, send only, clients 10.0.0.0/8, up to 1.0K per connection
+func captureDetail(c *client.CaptureConfig) string {
+	if c == nil {
+		return "as logs of gpcore"
+	}
+	if !c.Enable {
+		return "off"
+	}
+	ret := "on"
+	if c.Direction != "" {
+		ret += ", " + c.Direction + " only"
+	}
+	if len(c.Clients) != 0 {
+		ret += ", clients " + strings.Join(c.Clients, " ")
+	}
+	if c.MaxBytes != 0 {
+		ret += ", up to " + formatBytes(c.MaxBytes) + " per connection"
+	}
+	return ret
+}
+
+// all fields and stats of t
+func tunnelDetail(t client.Tunnel) string {
+	var b strings.Builder
+	row := func(name string, value interface{}) {
+		fmt.Fprintf(&b, "%-20v%v\n", name, value)
+	}
+	row("ID", t.ID)
+	row("Name", t.Name)
+	row("Source", t.Source)
+	row("Dest", t.Dest)
+	row("Enable", t.Enable)
+	if t.Error != "" {
+		row("Error", t.Error)
+	}
+	row("Capture", captureDetail(t.Capture))
+	s := t.Stats
+	if s == nil { // gpcore is older
+		s = &client.TunnelStats{}
+	}
+	b.WriteString("\n")
+	row("Active connections", s.ActiveConnections)
+	row("Total connections", s.TotalConnections)
+	row("Sent", formatBytes(s.BytesSent))
+	row("Received", formatBytes(s.BytesReceived))
+	row("Send rate", formatBytes(uint64(s.SendRate))+"/s")
+	row("Receive rate", formatBytes(uint64(s.ReceiveRate))+"/s")
+	row("Last activity", formatAgo(s.LastActivity))
+	if s.LastError != "" {
+		row("Last error", s.LastError+", "+formatAgo(s.LastErrorTime))
+	}
+	return b.String()
+}
@@ -1,6 +1,7 @@
 package tui
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -91,7 +92,7 @@ func ValidateSource(s string) error {
 		return err
 	}
 	if port < 0 || port > 65535 {
-		return fmt.Errorf("invalid port: " + strconv.FormatInt(port, 10))
+		return errors.New("invalid port: " + strconv.FormatInt(port, 10))
 	}
 	return nil
 }
@@ -116,7 +117,7 @@ func ValidateDest(s string) error {
 		return err
 	}
 	if port < 0 || port > 65535 {
-		return fmt.Errorf("invalid port: " + strconv.FormatInt(port, 10))
+		return errors.New("invalid port: " + strconv.FormatInt(port, 10))
 	}
 	return nil
 }
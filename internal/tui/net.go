@@ -1,180 +1,192 @@
 package tui
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net"
-	"net/http"
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/goverclock/gopolar/internal/core"
-
-	"github.com/mitchellh/mapstructure"
+	"github.com/goverclock/gopolar/pkg/client"
 )
 
+// timeout of each request, except events
+const requestTimeout = 3 * time.Second
+
 // connection between gopolar core and cli
 type CLIEnd struct {
-	client http.Client
+	client *client.Client
 }
 
+// connect to the socket in gpcore config(see core.LoadConfig())
 func NewCLIEnd() *CLIEnd {
-	client := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", "/tmp/gopolar.sock")
-			},
-		},
-		Timeout: 3 * time.Second,
-	}
-	return &CLIEnd{
-		client: client,
+	cfg, err := core.LoadConfig("")
+	if err != nil {
+		cfg = core.DefaultConfig
 	}
+	return NewCLIEndWithConfig(cfg)
 }
 
-func (ce *CLIEnd) GetTunnelList() ([]core.Tunnel, error) {
-	response, err := ce.GET("/tunnels/list")
-	if err != nil {
-		return nil, err
-	}
-	ret := []core.Tunnel{}
-	mapstructure.Decode(response["tunnels"], &ret)
-	return ret, nil
+// connect to cfg.SocketPath, authenticate with token at cfg.TokenPath()
+func NewCLIEndWithConfig(cfg core.Config) *CLIEnd {
+	return &CLIEnd{client: client.NewFromConfig(cfg.SocketPath, cfg.Token())}
+}
+
+func NewCLIEndWithSocket(socketPath string) *CLIEnd {
+	return &CLIEnd{client: client.NewUnix(socketPath)}
+}
+
+// authenticate with token instead
+func (ce *CLIEnd) SetToken(token string) {
+	ce.client.SetToken(token)
+}
+
+func (ce *CLIEnd) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+func (ce *CLIEnd) GetTunnelList() ([]client.Tunnel, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.ListTunnels(ctx)
 }
 
 // returns ID of the new tunnel
 func (ce *CLIEnd) CreateTunnel(name string, source string, dest string) (uint64, error) {
-	body := core.CreateTunnelBody{
+	ctx, cancel := ce.context()
+	defer cancel()
+	t, err := ce.client.CreateTunnel(ctx, client.CreateTunnelRequest{
 		Name:   name,
 		Source: source,
 		Dest:   dest,
-	}
-	response, err := ce.POST("/tunnels/create", body)
-	if err != nil {
-		return 0, err
-	}
-	id := uint64(response["id"].(float64))
-	return id, nil
+	})
+	return t.ID, err
 }
 
 func (ce *CLIEnd) EditTunnel(id uint64, newName string, newSource string, newDest string) error {
-	body := core.EditTunnelBody{
-		NewName:   newName,
-		NewSource: newSource,
-		NewDest:   newDest,
-	}
-	_, err := ce.POST("/tunnels/edit/"+fmt.Sprint(id), body)
+	ctx, cancel := ce.context()
+	defer cancel()
+	_, err := ce.client.UpdateTunnel(ctx, id, client.TunnelPatch{
+		Name:   &newName,
+		Source: &newSource,
+		Dest:   &newDest,
+	})
 	return err
 }
 
+// API v2 has no toggle, use v1 to keep it a single operation
 func (ce *CLIEnd) ToggleTunnel(id int64) error {
 	_, err := ce.POST("/tunnels/toggle/"+strconv.FormatInt(id, 10), nil)
 	return err
 }
 
 func (ce *CLIEnd) DeleteTunnel(id int64) error {
-	_, err := ce.DELETE("/tunnels/delete/" + strconv.FormatInt(id, 10))
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.DeleteTunnel(ctx, uint64(id))
+}
+
+func (ce *CLIEnd) SetCapture(id uint64, c client.CaptureConfig) error {
+	ctx, cancel := ce.context()
+	defer cancel()
+	_, err := ce.client.SetCapture(ctx, id, c)
 	return err
 }
 
-func (ce *CLIEnd) GetAboutInfo() (core.AboutInfo, error) {
-	ret := core.AboutInfo{}
-	response, err := ce.GET("/about")
-	if err != nil {
-		return ret, err
-	}
-	mapstructure.Decode(response["about"], &ret)
-	return ret, nil
+func (ce *CLIEnd) GetConnections(id uint64) ([]client.ConnInfo, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.ListConnections(ctx, id)
 }
 
-func bodyToJSON(body io.ReadCloser) (map[string]interface{}, error) {
-	ret := make(map[string]interface{})
-	jsonBytes, err := io.ReadAll(body)
-	// WriteTTY("/dev/ttys018", fmt.Sprintln(string(jsonBytes)))
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(jsonBytes, &ret)
-	if err != nil {
-		return nil, err
-	}
-	return ret, nil
+func (ce *CLIEnd) KillConnection(id uint64) error {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.CloseConnection(ctx, id)
 }
 
-func (ce *CLIEnd) GET(url string) (map[string]interface{}, error) {
-	response, err := ce.client.Get("http://unix" + url)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET %v responses code %v", url, response.StatusCode)
-	}
+func (ce *CLIEnd) GetTokenList() ([]client.APIToken, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.ListTokens(ctx)
+}
 
-	ret, err := bodyToJSON(response.Body)
-	if err != nil {
-		return nil, err
-	}
-	if !ret["success"].(bool) {
-		return nil, fmt.Errorf("Operation failed: " + ret["err_msg"].(string))
-	}
-	ret = ret["data"].(map[string]interface{})
-	return ret, nil
+// returns the new token and its secret
+func (ce *CLIEnd) CreateToken(name string, scope client.Scope) (client.APIToken, string, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.CreateToken(ctx, name, scope)
 }
 
-func (ce *CLIEnd) POST(url string, data interface{}) (map[string]interface{}, error) {
-	body, err := json.Marshal(data)
+func (ce *CLIEnd) DeleteToken(id uint64) error {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.RevokeToken(ctx, id)
+}
+
+// audit entries in [since, until), zero time means no limit
+func (ce *CLIEnd) GetAudit(since time.Time, until time.Time) ([]client.AuditEntry, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.Audit(ctx, since, until)
+}
+
+func (ce *CLIEnd) GetAboutInfo() (client.AboutInfo, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	return ce.client.About(ctx)
+}
+
+// stream traffic of tunnel id, the channel is closed when the stream ends,
+// or after cancel is called
+func (ce *CLIEnd) Tap(id uint64) (frames <-chan client.TapFrame, cancel func(), err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	frames, err = ce.client.Tap(ctx, id)
 	if err != nil {
-		return nil, err
+		cancel()
+		return nil, nil, err
 	}
-	response, err := ce.client.Post("http://unix"+url, "application/json", bytes.NewBuffer(body))
+	return frames, cancel, nil
+}
+
+// stream events from /events including tunnel.stats, the channel is closed
+// when the stream ends, or after cancel is called
+func (ce *CLIEnd) Events() (events <-chan client.Event, cancel func(), err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err = ce.client.EventsWithStats(ctx)
 	if err != nil {
-		return nil, err
+		cancel()
+		return nil, nil, err
 	}
-	defer response.Body.Close()
+	return events, cancel, nil
+}
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("POST %v responses code %v", url, response.StatusCode)
-	}
+func (ce *CLIEnd) GET(url string) (map[string]interface{}, error) {
+	return ce.do("GET", url, nil)
+}
 
-	ret, err := bodyToJSON(response.Body)
-	if err != nil {
-		return nil, err
-	}
-	if !ret["success"].(bool) {
-		return nil, fmt.Errorf("Operation failed: " + ret["err_msg"].(string))
-	}
-	ret = ret["data"].(map[string]interface{})
-	return ret, nil
+func (ce *CLIEnd) POST(url string, data interface{}) (map[string]interface{}, error) {
+	return ce.do("POST", url, data)
 }
 
 func (ce *CLIEnd) DELETE(url string) (map[string]interface{}, error) {
-	// mimic of http.Client.Get
-	response, err := func(c *http.Client, url string) (resp *http.Response, err error) {
-		req, err := http.NewRequest("DELETE", url, nil)
-		if err != nil {
-			return nil, err
-		}
-		return c.Do(req)
-	}(&ce.client, "http://unix"+url)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("DELETE %v responses code %v", url, response.StatusCode)
-	}
+	return ce.do("DELETE", url, nil)
+}
 
-	ret, err := bodyToJSON(response.Body)
-	if err != nil {
+// send request to API v1, returns "data" of response
+func (ce *CLIEnd) do(method string, url string, body interface{}) (map[string]interface{}, error) {
+	ctx, cancel := ce.context()
+	defer cancel()
+	var response struct {
+		Success bool                   `json:"success"`
+		ErrMsg  string                 `json:"err_msg"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	if err := ce.client.Do(ctx, method, url, body, &response); err != nil {
 		return nil, err
 	}
-	if !ret["success"].(bool) {
-		return nil, fmt.Errorf("Operation failed: " + ret["err_msg"].(string))
+	if !response.Success {
+		return nil, errors.New("Operation failed: " + response.ErrMsg)
 	}
-	ret = ret["data"].(map[string]interface{})
-	return ret, nil
+	return response.Data, nil
 }
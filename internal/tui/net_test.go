@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/client"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -25,7 +26,7 @@ func TestMain(m *testing.M) {
 	os.Remove("/tmp/gopolar.sock")
 	isMock := os.Getenv("MOCK")
 
-	end = NewCLIEnd()
+	end = NewCLIEndWithSocket("/tmp/gopolar.sock")
 	// mock core
 	sock, err := net.Listen("unix", "/tmp/gopolar.sock")
 	if err != nil {
@@ -85,7 +86,7 @@ func TestGetBad(t *testing.T) {
 func TestGetTunnelsList(t *testing.T) {
 	assert := assert.New(t)
 
-	expectList := []core.Tunnel{
+	expectList := []client.Tunnel{
 		{
 			ID:     1,
 			Name:   "first tunnel",
@@ -108,16 +109,11 @@ func TestGetTunnelsList(t *testing.T) {
 			Dest:   "localhost:2333",
 		},
 	}
-	mock_router.GET("/tunnels/list", func(ctx *gin.Context) {
+	mock_router.GET("/api/v2/tunnels", func(ctx *gin.Context) {
 		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				Tunnels []core.Tunnel `json:"tunnels"`
-			} `json:"data"`
+			Tunnels []client.Tunnel `json:"tunnels"`
 		}
-		response.Success = true
-		response.Data.Tunnels = append(response.Data.Tunnels, expectList...)
+		response.Tunnels = append(response.Tunnels, expectList...)
 		ctx.JSON(http.StatusOK, response)
 	})
 
@@ -133,22 +129,18 @@ func TestCreateTunnel(t *testing.T) {
 	source := "localhost:3456"
 	dest := "localhost:4567"
 	createdTunnelID := uint64(23423)
-	mock_router.POST("/tunnels/create", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				ID uint64 `json:"id"`
-			} `json:"data"`
-		}
-		request := core.CreateTunnelBody{}
+	mock_router.POST("/api/v2/tunnels", func(ctx *gin.Context) {
+		request := core.CreateTunnelBodyV2{}
 		ctx.Bind(&request)
 		assert.Equal(name, request.Name)
 		assert.Equal(source, request.Source)
 		assert.Equal(dest, request.Dest)
-		response.Success = true
-		response.Data.ID = createdTunnelID
-		ctx.JSON(http.StatusOK, response)
+		ctx.JSON(http.StatusCreated, core.Tunnel{
+			ID:     createdTunnelID,
+			Name:   request.Name,
+			Source: request.Source,
+			Dest:   request.Dest,
+		})
 	})
 
 	id, err := end.CreateTunnel(name, source, dest)
@@ -163,29 +155,24 @@ func TestEditTunnel(t *testing.T) {
 	newName := "new created me"
 	newSource := "newhahah:3456"
 	newDest := "newDest:4567"
-	mock_router.POST("/tunnels/edit/:id", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-			} `json:"data"`
-		}
-		request := core.EditTunnelBody{}
+	mock_router.PATCH("/api/v2/tunnels/:id", func(ctx *gin.Context) {
+		request := core.TunnelPatch{}
 		ctx.Bind(&request)
-		// parse params manually, due to possible gin issue on post params
-		reqUrl := ctx.Request.URL.String()
-		idStr := reqUrl[len("/tunnels/edit/"):]
-		// idStr := ctx.Param("id")	// somehow buggy
+		// parse params manually, ctx.Param() is empty for routes added
+		// after the router runs
+		idStr := ctx.Request.URL.Path[len("/api/v2/tunnels/"):]
 		recvID, err := strconv.ParseUint(idStr, 10, 64)
 		if err != nil {
 			t.Log(err)
 		}
 		assert.Equal(targetID, recvID)
-		assert.Equal(newName, request.NewName)
-		assert.Equal(newSource, request.NewSource)
-		assert.Equal(newDest, request.NewDest)
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+		if assert.NotNil(request.Name) && assert.NotNil(request.Source) && assert.NotNil(request.Dest) {
+			assert.Equal(newName, *request.Name)
+			assert.Equal(newSource, *request.Source)
+			assert.Equal(newDest, *request.Dest)
+		}
+		assert.Nil(request.Enable)
+		ctx.JSON(http.StatusOK, core.Tunnel{ID: recvID})
 	})
 
 	err := end.EditTunnel(targetID, newName, newSource, newDest)
@@ -221,22 +208,14 @@ func TestDeleteTunnel(t *testing.T) {
 	assert := assert.New(t)
 
 	targetID := int64(78967)
-	mock_router.DELETE("/tunnels/delete/:id", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-			} `json:"data"`
-		}
-		reqUrl := ctx.Request.URL.String()
-		idStr := reqUrl[len("/tunnels/delete/"):]
+	mock_router.DELETE("/api/v2/tunnels/:id", func(ctx *gin.Context) {
+		idStr := ctx.Request.URL.Path[len("/api/v2/tunnels/"):]
 		recvID, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			t.Log(err)
 		}
 		assert.Equal(targetID, recvID)
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+		ctx.Status(http.StatusNoContent)
 	})
 	err := end.DeleteTunnel(targetID)
 	assert.Equal(nil, err)
@@ -245,20 +224,11 @@ func TestDeleteTunnel(t *testing.T) {
 func TestGetAboutInfo(t *testing.T) {
 	assert := assert.New(t)
 
-	target := core.AboutInfo{
+	target := client.AboutInfo{
 		Version: "0.0.1",
 	}
-	mock_router.GET("/about", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				About core.AboutInfo `json:"about"`
-			} `json:"data"`
-		}
-		response.Data.About = target
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+	mock_router.GET("/api/v2/about", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, target)
 	})
 	ret, err := end.GetAboutInfo()
 	assert.Equal(nil, err)
@@ -3,19 +3,22 @@ package tui
 import (
 	"strconv"
 
-	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/client"
 
 	"github.com/charmbracelet/bubbles/table"
 	"github.com/charmbracelet/lipgloss"
 )
 
-func NewTableModel(tunnelList []core.Tunnel) *table.Model {
+func NewTableModel(tunnelList []client.Tunnel) *table.Model {
 	columns := []table.Column{
 		{Title: "ID", Width: 4},
 		{Title: "Name", Width: 16},
 		{Title: "Source", Width: 16},
 		{Title: "Dest", Width: 20},
 		{Title: "Status", Width: 8},
+		{Title: "Conns", Width: 6},
+		{Title: "Sent", Width: 8},
+		{Title: "Recv", Width: 8},
 	}
 	rows := listToRows(tunnelList)
 	tb := table.New(
@@ -35,19 +38,29 @@ func NewTableModel(tunnelList []core.Tunnel) *table.Model {
 	return &tb
 }
 
-func listToRows(tunnelList []core.Tunnel) []table.Row {
+func listToRows(tunnelList []client.Tunnel) []table.Row {
 	rows := []table.Row{}
 	for _, t := range tunnelList {
 		status := "STOPPED"
 		if t.Enable {
 			status = "RUNNING"
 		}
+		if t.Error != "" {
+			status = "ERROR"
+		}
+		s := t.Stats
+		if s == nil {
+			s = &client.TunnelStats{}
+		}
 		rows = append(rows, table.Row{
 			strconv.FormatUint(t.ID, 10),
 			t.Name,
 			t.Source,
 			t.Dest,
 			status,
+			strconv.FormatInt(s.ActiveConnections, 10),
+			formatBytes(s.BytesSent),
+			formatBytes(s.BytesReceived),
 		})
 	}
 	return rows
@@ -0,0 +1,60 @@
+package tui
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+	"github.com/goverclock/gopolar/pkg/client"
+)
+
+const (
+	tapMaxFrames = 200 // frames kept for tapView, older ones are forgotten
+	tapViewLines = 24  // lines of the latest frames shown
+)
+
+// e.g. 15:04:05.000 #12 send localhost:8800 4 bytes, followed by the data
+// as hex dump if hexMode, otherwise as text with unprintable bytes as '.'
+func renderTapFrame(f client.TapFrame, hexMode bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v #%v %-5v %v", f.Time.Local().Format("15:04:05.000"), f.Connection, f.Type, f.Dest)
+	if f.Type == capture.Send || f.Type == capture.Recv {
+		fmt.Fprintf(&b, " %v bytes", len(f.Data))
+	}
+	if f.Dropped != 0 {
+		fmt.Fprintf(&b, " (%v frames dropped before)", f.Dropped)
+	}
+	b.WriteString("\n")
+	if len(f.Data) == 0 {
+		return b.String()
+	}
+	if hexMode {
+		b.WriteString(hex.Dump(f.Data))
+		return b.String()
+	}
+	for _, c := range f.Data {
+		if c == '\n' || c == '\t' || (c >= 0x20 && c < 0x7f) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('.')
+		}
+	}
+	if f.Data[len(f.Data)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// the last tapViewLines lines of frames
+func tapLines(frames []client.TapFrame, hexMode bool) string {
+	var b strings.Builder
+	for _, f := range frames {
+		b.WriteString(renderTapFrame(f, hexMode))
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) > tapViewLines {
+		lines = lines[len(lines)-tapViewLines:]
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
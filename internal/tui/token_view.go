@@ -0,0 +1,123 @@
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/goverclock/gopolar/pkg/client"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var scopes = []client.Scope{client.ScopeRead, client.ScopeOperate, client.ScopeAdmin}
+
+func NewTokenTableModel(tokenList []client.APIToken) *table.Model {
+	columns := []table.Column{
+		{Title: "ID", Width: 4},
+		{Title: "Name", Width: 16},
+		{Title: "Scope", Width: 8},
+		{Title: "Created", Width: 20},
+	}
+	tb := table.New(
+		table.WithColumns(columns),
+		table.WithRows(tokensToRows(tokenList)),
+		table.WithHeight(10),
+		table.WithFocused(true),
+	)
+	tb.KeyMap.HalfPageDown.Unbind() // conflicts with 'd' - delete token, so unbind it
+	tb.KeyMap.HalfPageUp.Unbind()
+	s := table.DefaultStyles()
+	s.Selected = s.Selected.
+		Foreground(lipgloss.Color("255")).
+		Background(lipgloss.Color("8")).
+		Bold(false)
+	tb.SetStyles(s)
+	return &tb
+}
+
+func tokensToRows(tokenList []client.APIToken) []table.Row {
+	rows := []table.Row{}
+	for _, t := range tokenList {
+		rows = append(rows, table.Row{
+			strconv.FormatUint(t.ID, 10),
+			t.Name,
+			string(t.Scope),
+			t.Created.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	return rows
+}
+
+// name input, and scope selected by tab
+type TokenCreateModel struct {
+	name  textinput.Model
+	scope int // index of scopes
+}
+
+func NewTokenCreateModel() *TokenCreateModel {
+	t := textinput.New()
+	t.CharLimit = 16
+	t.Placeholder = "token name"
+	t.PromptStyle = focusedStyle
+	t.TextStyle = focusedStyle
+	t.Focus()
+	return &TokenCreateModel{
+		name: t,
+	}
+}
+
+func (m *TokenCreateModel) Reset() {
+	m.name.SetValue("")
+	m.name.SetCursor(0)
+	m.scope = 0
+}
+
+func (m TokenCreateModel) GetInput() (name string, scope client.Scope) {
+	return m.name.Value(), scopes[m.scope]
+}
+
+// like EditModel, cmd returns "submit" on enter, or error message
+func (m TokenCreateModel) Update(msg tea.Msg) (TokenCreateModel, tea.Cmd) {
+	msgv, ok := msg.(tea.KeyMsg) // only care about key message
+	if !ok {
+		return m, nil
+	}
+	switch msgv.String() {
+	case "tab":
+		m.scope = (m.scope + 1) % len(scopes)
+		return m, nil
+	case "shift+tab":
+		m.scope = (m.scope + len(scopes) - 1) % len(scopes)
+		return m, nil
+	case "enter":
+		ret := "submit"
+		if err := ValidateName(m.name.Value()); err != nil {
+			ret = "Invalid name: " + fmt.Sprint(err)
+		}
+		return m, func() tea.Msg {
+			return ret
+		}
+	}
+	m.name, _ = m.name.Update(msg)
+	return m, nil
+}
+
+func (m TokenCreateModel) View() string {
+	var b strings.Builder
+	b.WriteString("Name  ")
+	b.WriteString(m.name.View())
+	b.WriteString("\nScope ")
+	for i, s := range scopes {
+		if i == m.scope {
+			b.WriteString(focusedStyle.Render(" " + string(s) + " "))
+		} else {
+			b.WriteString(" " + string(s) + " ")
+		}
+	}
+	b.WriteString("\n\n")
+	return b.String()
+}
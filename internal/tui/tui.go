@@ -5,9 +5,10 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/client"
 
 	"github.com/charmbracelet/bubbles/table"
 	tea "github.com/charmbracelet/bubbletea"
@@ -27,16 +28,45 @@ const (
 	createView
 	editView
 	deleteConfirm
+	tokenView
+	tokenCreate
+	tokenDeleteConfirm
+	detailView
+	connView
+	connKillConfirm
+	tapView
 )
 const (
-	TableHelpMsg string = "c - CREATE, e - EDIT, d - DELETE, r - RUN/STOP"
-	EditHelpMsg  string = "enter - CONFIRM, esc - CANCEL"
+	TableHelpMsg       string = "c - CREATE, e - EDIT, d - DELETE, r - RUN/STOP, i - INFO, o - CONNECTIONS, t - TOKENS"
+	DetailHelpMsg      string = "p - CAPTURE ON/OFF, w - WATCH TRAFFIC, esc - BACK"
+	TapHelpMsg         string = "x - HEX/TEXT, c - CLEAR, esc - BACK"
+	ConnHelpMsg        string = "k - KILL, esc - BACK"
+	EditHelpMsg        string = "enter - CONFIRM, esc - CANCEL"
+	TokenHelpMsg       string = "c - CREATE, d - REVOKE, esc - BACK"
+	TokenCreateHelpMsg string = "tab - SCOPE, enter - CONFIRM, esc - CANCEL"
 )
 
 type UIModel struct {
 	table   table.Model
-	edit    EditModel // multiple textinputs
+	tunnels []client.Tunnel // rows of table
+	edit    EditModel       // multiple textinputs
 	helpMsg string
+	detail  uint64 // ID of tunnel in detailView
+
+	tokenTable  table.Model
+	tokens      []client.APIToken // rows of tokenTable
+	tokenCreate TokenCreateModel
+
+	connTable  table.Model
+	conns      []client.ConnInfo // rows of connTable
+	connTunnel uint64            // ID of tunnel in connView
+	connsTick  int               // increases each time connView is entered
+
+	tapFrames []client.TapFrame // latest frames in tapView
+	tapStream <-chan client.TapFrame
+	tapCancel func() // ends tapStream
+	tapHex    bool
+	tapEnded  string // why tapStream ended, empty if it's running
 
 	state sessionState
 	end   *CLIEnd
@@ -50,14 +80,22 @@ func NewUIModel(end *CLIEnd) *UIModel {
 	}
 	ret := &UIModel{
 		table:   *NewTableModel(tunnelList),
+		tunnels: tunnelList,
 		edit:    *NewEditModel(),
 		helpMsg: TableHelpMsg,
-		state:   tableView,
-		end:     end,
+
+		tokenTable:  *NewTokenTableModel(nil),
+		tokenCreate: *NewTokenCreateModel(),
+
+		connTable: *NewConnTableModel(nil),
+
+		state: tableView,
+		end:   end,
 	}
 	return ret
 }
 
+// polling is only used when events are not available, see eventsCmd()
 type tickMsg time.Time
 
 func tickCmd() tea.Cmd {
@@ -66,6 +104,17 @@ func tickCmd() tea.Cmd {
 	})
 }
 
+// bytes of connections change without events, so they are polled while
+// connView is shown, a tick is dropped if connView is entered again after
+// it's scheduled, see UIModel.connsTick
+type connsTickMsg int
+
+func connsTickCmd(seq int) tea.Cmd {
+	return tea.Tick(2*time.Second, func(time.Time) tea.Msg {
+		return connsTickMsg(seq)
+	})
+}
+
 func (m *UIModel) updateListCmd() tea.Msg {
 	newTunnels, err := m.end.GetTunnelList()
 	if err != nil {
@@ -75,29 +124,186 @@ func (m *UIModel) updateListCmd() tea.Msg {
 	return newTunnels
 }
 
+type eventsConnectedMsg <-chan client.Event
+
+type eventMsg struct {
+	event  client.Event
+	events <-chan client.Event
+}
+
+// the event stream failed or ended
+type eventsClosedMsg struct{}
+
+// subscribe to events of gpcore
+func (m *UIModel) eventsCmd() tea.Msg {
+	events, _, err := m.end.Events()
+	if err != nil {
+		return eventsClosedMsg{}
+	}
+	return eventsConnectedMsg(events)
+}
+
+func waitEventCmd(events <-chan client.Event) tea.Cmd {
+	return func() tea.Msg {
+		e, ok := <-events
+		if !ok {
+			return eventsClosedMsg{}
+		}
+		return eventMsg{event: e, events: events}
+	}
+}
+
+type tapFrameMsg struct {
+	frame  client.TapFrame
+	frames <-chan client.TapFrame
+}
+
+// the tap stream ended
+type tapClosedMsg <-chan client.TapFrame
+
+func waitTapCmd(frames <-chan client.TapFrame) tea.Cmd {
+	return func() tea.Msg {
+		f, ok := <-frames
+		if !ok {
+			return tapClosedMsg(frames)
+		}
+		return tapFrameMsg{frame: f, frames: frames}
+	}
+}
+
+// connections of tunnel in connView
+type connsMsg struct {
+	conns []client.ConnInfo
+	err   error
+}
+
+func (m *UIModel) updateConnsCmd() tea.Msg {
+	conns, err := m.end.GetConnections(m.connTunnel)
+	return connsMsg{conns: conns, err: err}
+}
+
+func (m *UIModel) updateTokensCmd() tea.Msg {
+	newTokens, err := m.end.GetTokenList()
+	if err != nil {
+		return err
+	}
+	return newTokens
+}
+
+// update stats of tunnels listed only, the list itself is updated on
+// other tunnel.* events
+func (m *UIModel) setStats(stats map[uint64]client.TunnelStats) {
+	for i := range m.tunnels {
+		if s, ok := stats[m.tunnels[i].ID]; ok {
+			m.tunnels[i].Stats = &s
+		}
+	}
+	m.table.SetRows(listToRows(m.tunnels))
+}
+
 // for debug
 func WriteTTY(tty string, msg string) {
 	os.WriteFile(tty, []byte(msg), os.ModePerm)
 }
 
 func (m UIModel) Init() tea.Cmd {
-	return tickCmd()
+	return m.eventsCmd
 }
 
 func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	// tick update
+	// tick update, try to subscribe again
 	_, ok := msg.(tickMsg)
 	if ok {
-		return m,
-			tea.Batch(tickCmd(), m.updateListCmd)
+		return m, m.eventsCmd
+	}
+	msgct, ok := msg.(connsTickMsg)
+	if ok {
+		if int(msgct) != m.connsTick || (m.state != connView && m.state != connKillConfirm) {
+			return m, nil
+		}
+		return m, tea.Batch(m.updateConnsCmd, connsTickCmd(m.connsTick))
+	}
+
+	// event update
+	msgec, ok := msg.(eventsConnectedMsg)
+	if ok { // tunnels may have changed while not subscribed
+		return m, tea.Batch(m.updateListCmd, waitEventCmd(msgec))
+	}
+	_, ok = msg.(eventsClosedMsg)
+	if ok {
+		return m, tickCmd()
+	}
+	msgev, ok := msg.(eventMsg)
+	if ok {
+		next := waitEventCmd(msgev.events)
+		e := msgev.event
+		switch {
+		case e.Type == client.EventDestDown && m.state == tableView:
+			m.helpMsg = fmt.Sprintf("Dest %v of %v is down: %v", e.Dest, e.Source, e.Error)
+		case e.Type == client.EventError && m.state == tableView:
+			m.helpMsg = fmt.Sprintf("Fail to %v tunnel: %v", e.Op, e.Error)
+		}
+		if e.Type == client.EventTunnelStats {
+			m.setStats(e.Stats)
+			return m, next
+		}
+		if strings.HasPrefix(e.Type, "tunnel.") || e.Type == client.EventError {
+			return m, tea.Batch(m.updateListCmd, next)
+		}
+		if strings.HasPrefix(e.Type, "connection.") && m.state == connView {
+			return m, tea.Batch(m.updateConnsCmd, next)
+		}
+		return m, next
+	}
+
+	// tap update, frames of a stream already stopped are ignored
+	msgtf, ok := msg.(tapFrameMsg)
+	if ok {
+		if msgtf.frames != m.tapStream {
+			return m, nil
+		}
+		m.tapFrames = append(m.tapFrames, msgtf.frame)
+		if len(m.tapFrames) > tapMaxFrames {
+			m.tapFrames = m.tapFrames[len(m.tapFrames)-tapMaxFrames:]
+		}
+		return m, waitTapCmd(msgtf.frames)
+	}
+	msgtc, ok := msg.(tapClosedMsg)
+	if ok {
+		if (<-chan client.TapFrame)(msgtc) == m.tapStream && m.tapCancel != nil {
+			m.tapEnded = "Stream ended, the tunnel is edited or removed, or gpcore is down"
+		}
+		return m, nil
 	}
 
 	// local update
-	msgnt, ok := msg.([]core.Tunnel)
+	msgnt, ok := msg.([]client.Tunnel)
 	if ok {
+		m.tunnels = msgnt
 		m.table.SetRows(listToRows(msgnt))
 		return m, nil
 	}
+	msgtk, ok := msg.([]client.APIToken)
+	if ok {
+		m.tokens = msgtk
+		m.tokenTable.SetRows(tokensToRows(msgtk))
+		return m, nil
+	}
+	msgcs, ok := msg.(connsMsg)
+	if ok {
+		if msgcs.err != nil {
+			m.helpMsg = "Fail to list connections: " + fmt.Sprint(msgcs.err)
+			return m, nil
+		}
+		m.conns = msgcs.conns
+		m.connTable.SetRows(connsToRows(msgcs.conns))
+		return m, nil
+	}
+	msgerr, ok := msg.(error)
+	if ok {
+		m.helpMsg = "Fail to list tokens: " + fmt.Sprint(msgerr)
+		return m, nil
+	}
 
 	msgk, ok := msg.(tea.KeyMsg) // only care about key message
 	if !ok {
@@ -109,6 +315,24 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// main model
 	switch s {
 	case "esc":
+		if m.state == tapView {
+			m.tapCancel()
+			m.tapCancel = nil
+			m.tapStream = nil
+			m.state = detailView
+			m.helpMsg = DetailHelpMsg
+			return m, nil
+		}
+		if m.state == tokenCreate || m.state == tokenDeleteConfirm {
+			m.state = tokenView
+			m.helpMsg = TokenHelpMsg
+			return m, nil
+		}
+		if m.state == connKillConfirm {
+			m.state = connView
+			m.helpMsg = ConnHelpMsg
+			return m, nil
+		}
 		m.state = tableView
 		m.helpMsg = TableHelpMsg
 		return m, nil
@@ -144,6 +368,54 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.state = deleteConfirm
 			m.helpMsg = fmt.Sprintf("Delete tunnel %v(%v)?(Y/n)", sr[0], sr[1])
 			return m, nil
+		case "i", "enter":
+			sr := m.table.SelectedRow()
+			if sr == nil {
+				return m, nil
+			}
+			id, err := strconv.ParseUint(sr[0], 10, 64)
+			if err != nil {
+				m.helpMsg = "Fail to parse tunnel ID: " + fmt.Sprint(err)
+				break
+			}
+			m.state = detailView
+			m.detail = id
+			m.helpMsg = DetailHelpMsg
+			return m, nil
+		case "o":
+			sr := m.table.SelectedRow()
+			if sr == nil {
+				return m, nil
+			}
+			id, err := strconv.ParseUint(sr[0], 10, 64)
+			if err != nil {
+				m.helpMsg = "Fail to parse tunnel ID: " + fmt.Sprint(err)
+				break
+			}
+			conns, err := m.end.GetConnections(id)
+			if err != nil {
+				m.helpMsg = "Fail to list connections: " + fmt.Sprint(err)
+				return m, nil
+			}
+			m.conns = conns
+			m.connTable.SetRows(connsToRows(conns))
+			m.connTable.SetCursor(0)
+			m.connTunnel = id
+			m.state = connView
+			m.helpMsg = ConnHelpMsg
+			m.connsTick++
+			return m, connsTickCmd(m.connsTick)
+		case "t":
+			tokens, err := m.end.GetTokenList()
+			if err != nil {
+				m.helpMsg = "Fail to list tokens: " + fmt.Sprint(err)
+				return m, nil
+			}
+			m.tokens = tokens
+			m.tokenTable.SetRows(tokensToRows(tokens))
+			m.state = tokenView
+			m.helpMsg = TokenHelpMsg
+			return m, nil
 		case "r":
 			sr := m.table.SelectedRow()
 			if sr == nil {
@@ -158,7 +430,7 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			err = m.end.ToggleTunnel(id)
 			strOk := "Stopped"
 			strFail := "stop"
-			if sr[4] == "STOPPED" {
+			if sr[4] != "RUNNING" {
 				strOk = "Started"
 				strFail = "start"
 			}
@@ -169,11 +441,11 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			return m, m.updateListCmd
 		}
+		m.table, cmd = m.table.Update(msg)
 		// reset to table help message only when table updates
 		if m.state == tableView {
-			m.helpMsg = TableHelpMsg
+			m.helpMsg = m.tableHelpMsg()
 		}
-		m.table, cmd = m.table.Update(msg)
 	case createView:
 		m.edit, cmd = m.edit.Update(msg)
 		if cmd == nil {
@@ -238,11 +510,191 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.state = tableView
 			return m, nil
 		}
+	case detailView:
+		switch s {
+		case "q":
+			return m, tea.Quit
+		case "p":
+			for _, t := range m.tunnels {
+				if t.ID != m.detail {
+					continue
+				}
+				// filters set by other clients are kept
+				c := client.CaptureConfig{Enable: true}
+				if t.Capture != nil {
+					c = *t.Capture
+					c.Enable = !c.Enable
+				}
+				if err := m.end.SetCapture(t.ID, c); err != nil {
+					m.helpMsg = "Fail to set capture: " + fmt.Sprint(err)
+				} else if c.Enable {
+					m.helpMsg = "Capturing new connections of tunnel " + fmt.Sprint(t.ID)
+				} else {
+					m.helpMsg = "Stopped capturing new connections of tunnel " + fmt.Sprint(t.ID)
+				}
+				return m, m.updateListCmd
+			}
+		case "w":
+			frames, cancel, err := m.end.Tap(m.detail)
+			if err != nil {
+				m.helpMsg = "Fail to watch traffic: " + fmt.Sprint(err)
+				return m, nil
+			}
+			m.tapFrames = nil
+			m.tapStream = frames
+			m.tapCancel = cancel
+			m.tapEnded = ""
+			m.state = tapView
+			m.helpMsg = TapHelpMsg
+			return m, waitTapCmd(frames)
+		}
+	case tapView:
+		switch s {
+		case "q":
+			return m, tea.Quit
+		case "x":
+			m.tapHex = !m.tapHex
+		case "c":
+			m.tapFrames = nil
+		}
+	case connView:
+		switch s {
+		case "q":
+			return m, tea.Quit
+		case "k", "d":
+			sr := m.connTable.SelectedRow()
+			if sr == nil {
+				return m, nil
+			}
+			m.state = connKillConfirm
+			m.helpMsg = fmt.Sprintf("Kill connection %v from %v?(Y/n)", sr[0], sr[1])
+			return m, nil
+		}
+		m.connTable, cmd = m.connTable.Update(msg)
+	case connKillConfirm:
+		switch s {
+		case "y", "Y", "enter": // confirm
+			id, err := strconv.ParseUint(m.connTable.SelectedRow()[0], 10, 64)
+			if err != nil {
+				m.helpMsg = "Fail to parse connection ID: " + fmt.Sprint(err)
+				break
+			}
+			err = m.end.KillConnection(id)
+			if err != nil {
+				m.helpMsg = "Fail to kill connection: " + fmt.Sprint(err)
+			} else {
+				m.helpMsg = "Killed connection " + fmt.Sprint(id) + " successfully"
+			}
+			m.state = connView
+			return m, m.updateConnsCmd
+		case "n", "N": // cancel
+			m.helpMsg = ConnHelpMsg
+			m.state = connView
+			return m, nil
+		}
+	case tokenView:
+		switch s {
+		case "q":
+			return m, tea.Quit
+		case "c":
+			m.state = tokenCreate
+			m.helpMsg = TokenCreateHelpMsg
+			m.tokenCreate.Reset()
+			return m, nil
+		case "d":
+			sr := m.tokenTable.SelectedRow()
+			if sr == nil {
+				return m, nil
+			}
+			m.state = tokenDeleteConfirm
+			m.helpMsg = fmt.Sprintf("Revoke token %v(%v)?(Y/n)", sr[0], sr[1])
+			return m, nil
+		}
+		m.tokenTable, cmd = m.tokenTable.Update(msg)
+	case tokenCreate:
+		m.tokenCreate, cmd = m.tokenCreate.Update(msg)
+		if cmd == nil {
+			break
+		}
+		if cmd() == "submit" { // submitted
+			name, scope := m.tokenCreate.GetInput()
+			// request core
+			token, secret, err := m.end.CreateToken(name, scope)
+			if err != nil {
+				m.helpMsg = "Fail to create token: " + fmt.Sprint(err)
+			} else {
+				m.helpMsg = fmt.Sprintf("Created token %v, save it now as it won't be shown again:\n%v", token.ID, secret)
+			}
+			m.state = tokenView
+			return m, m.updateTokensCmd
+		} else {
+			m.helpMsg = cmd().(string)
+		}
+	case tokenDeleteConfirm:
+		switch s {
+		case "y", "Y", "enter": // confirm
+			id, err := strconv.ParseUint(m.tokenTable.SelectedRow()[0], 10, 64)
+			if err != nil {
+				m.helpMsg = "Fail to parse token ID: " + fmt.Sprint(err)
+				break
+			}
+			err = m.end.DeleteToken(id)
+			if err != nil {
+				m.helpMsg = "Fail to revoke token: " + fmt.Sprint(err)
+			} else {
+				m.helpMsg = "Revoked token " + fmt.Sprint(id) + " successfully"
+			}
+			m.state = tokenView
+			return m, m.updateTokensCmd
+		case "n", "N": // cancel
+			m.helpMsg = TokenHelpMsg
+			m.state = tokenView
+			return m, nil
+		}
 	}
 	return m, cmd
 }
 
+// error of selected tunnel if any, otherwise TableHelpMsg
+func (m UIModel) tableHelpMsg() string {
+	i := m.table.Cursor()
+	if i >= 0 && i < len(m.tunnels) && m.tunnels[i].Error != "" {
+		return fmt.Sprintf("Tunnel %v: %v", m.tunnels[i].ID, m.tunnels[i].Error)
+	}
+	return TableHelpMsg
+}
+
 func (m UIModel) View() string {
+	if m.state == tokenView || m.state == tokenCreate || m.state == tokenDeleteConfirm {
+		ret := m.tokenTable.View()
+		ret += "\n" + m.helpMsg
+		if m.state == tokenCreate {
+			ret += "\n" + m.tokenCreate.View()
+		}
+		return ret
+	}
+	if m.state == connView || m.state == connKillConfirm {
+		return fmt.Sprintf("Connections of tunnel %v\n", m.connTunnel) + m.connTable.View() + "\n" + m.helpMsg
+	}
+	if m.state == tapView {
+		ret := fmt.Sprintf("Traffic of tunnel %v\n\n", m.detail)
+		if len(m.tapFrames) == 0 {
+			ret += "Waiting for traffic...\n"
+		}
+		ret += tapLines(m.tapFrames, m.tapHex)
+		if m.tapEnded != "" {
+			ret += "\n" + m.tapEnded
+		}
+		return ret + "\n" + m.helpMsg
+	}
+	if m.state == detailView {
+		for _, t := range m.tunnels {
+			if t.ID == m.detail {
+				return tunnelDetail(t) + "\n" + m.helpMsg
+			}
+		}
+		return fmt.Sprintf("Tunnel %v is deleted\n\n", m.detail) + m.helpMsg
+	}
 	ret := m.table.View()
 	ret += "\n" + m.helpMsg
 	if m.state == createView || m.state == editView {
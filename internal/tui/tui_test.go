@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/goverclock/gopolar/internal/core"
 
@@ -51,28 +52,16 @@ func setupMockRouter(e *gin.Engine) {
 			Dest:   "localhost:2333",
 		},
 	}
-	mock_router.GET("/tunnels/list", func(ctx *gin.Context) {
+	mock_router.GET("/api/v2/tunnels", func(ctx *gin.Context) {
 		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				Tunnels []core.Tunnel `json:"tunnels"`
-			} `json:"data"`
+			Tunnels []core.Tunnel `json:"tunnels"`
 		}
-		response.Success = true
-		response.Data.Tunnels = append(response.Data.Tunnels, tunnels...)
+		response.Tunnels = append(response.Tunnels, tunnels...)
 		ctx.JSON(http.StatusOK, response)
 	})
 
-	mock_router.POST("/tunnels/create", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				ID uint64 `json:"id"`
-			} `json:"data"`
-		}
-		request := core.CreateTunnelBody{}
+	mock_router.POST("/api/v2/tunnels", func(ctx *gin.Context) {
+		request := core.CreateTunnelBodyV2{}
 		ctx.Bind(&request)
 		log.Printf("%#v", request)
 		newTunnel := core.Tunnel{
@@ -83,36 +72,25 @@ func setupMockRouter(e *gin.Engine) {
 			Dest:   request.Dest,
 		}
 		tunnels = append(tunnels, newTunnel)
-		response.Success = true
-		response.Data.ID = newTunnel.ID
-		ctx.JSON(http.StatusOK, response)
+		ctx.JSON(http.StatusCreated, newTunnel)
 	})
 
-	mock_router.POST("/tunnels/edit/:id", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-			} `json:"data"`
-		}
-		request := core.EditTunnelBody{}
+	mock_router.PATCH("/api/v2/tunnels/:id", func(ctx *gin.Context) {
+		request := core.TunnelPatch{}
 		ctx.Bind(&request)
 		log.Printf("%#v", request)
-		// parse params manually, due to possible gin issue on post params
-		reqUrl := ctx.Request.URL.String()
-		idStr := reqUrl[len("/tunnels/edit/"):]
-		// idStr := ctx.Param("id")	// somehow buggy
-		_, err := strconv.ParseInt(idStr, 10, 64)
+		id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
 		if err != nil {
 			log.Println(err)
 		}
 		for i, t := range tunnels {
-			if fmt.Sprint(t.ID) == idStr {
-				tunnels[i].Name, tunnels[i].Source, tunnels[i].Dest = request.NewName, request.NewSource, request.NewDest
+			if t.ID == id {
+				tunnels[i].Name, tunnels[i].Source, tunnels[i].Dest = *request.Name, *request.Source, *request.Dest
+				ctx.JSON(http.StatusOK, tunnels[i])
+				return
 			}
 		}
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+		ctx.Status(http.StatusNotFound)
 	})
 
 	mock_router.POST("/tunnels/toggle/:id", func(ctx *gin.Context) {
@@ -137,42 +115,67 @@ func setupMockRouter(e *gin.Engine) {
 		ctx.JSON(http.StatusOK, response)
 	})
 
-	mock_router.DELETE("/tunnels/delete/:id", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-			} `json:"data"`
+	mock_router.DELETE("/api/v2/tunnels/:id", func(ctx *gin.Context) {
+		id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+		if err != nil {
+			log.Println(err)
 		}
-		reqUrl := ctx.Request.URL.String()
-		idStr := reqUrl[len("/tunnels/delete/"):]
-		id, err := strconv.ParseUint(idStr, 10, 64)
 		for i, t := range tunnels {
 			if t.ID == id {
 				tunnels = append(tunnels[:i], tunnels[i+1:]...)
 				break
 			}
 		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	tokens := []core.APIToken{
+		{
+			ID:      1,
+			Name:    "watcher",
+			Scope:   core.ScopeRead,
+			Created: time.Now(),
+		},
+	}
+	mock_router.GET("/api/v2/tokens", func(ctx *gin.Context) {
+		var response struct {
+			Tokens []core.APIToken `json:"tokens"`
+		}
+		response.Tokens = append(response.Tokens, tokens...)
+		ctx.JSON(http.StatusOK, response)
+	})
+
+	mock_router.POST("/api/v2/tokens", func(ctx *gin.Context) {
+		request := core.CreateTokenBody{}
+		ctx.Bind(&request)
+		newToken := core.APIToken{
+			ID:      rand.Uint64() % 100,
+			Name:    request.Name,
+			Scope:   request.Scope,
+			Created: time.Now(),
+		}
+		tokens = append(tokens, newToken)
+		ctx.JSON(http.StatusCreated, core.CreateTokenResponse{Token: newToken, Secret: "mocksecret"})
+	})
+
+	mock_router.DELETE("/api/v2/tokens/:id", func(ctx *gin.Context) {
+		id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
 		if err != nil {
 			log.Println(err)
 		}
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+		for i, t := range tokens {
+			if t.ID == id {
+				tokens = append(tokens[:i], tokens[i+1:]...)
+				break
+			}
+		}
+		ctx.Status(http.StatusNoContent)
 	})
 
 	target := core.AboutInfo{
 		Version: "0.0.1",
 	}
-	mock_router.GET("/about", func(ctx *gin.Context) {
-		var response struct {
-			Success bool   `json:"success"`
-			ErrMsg  string `json:"err_msg"`
-			Data    struct {
-				About core.AboutInfo `json:"about"`
-			} `json:"data"`
-		}
-		response.Data.About = target
-		response.Success = true
-		ctx.JSON(http.StatusOK, response)
+	mock_router.GET("/api/v2/about", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, target)
 	})
 }
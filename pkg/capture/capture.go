@@ -0,0 +1,241 @@
+// Package capture reads and writes traffic captures of gpcore, one file
+// per client connection to a tunnel source, with the traffic of all dests
+// it's forwarded to(see LogFile in API.md).
+//
+// A capture starts with Magic, a version byte and a length-prefixed JSON
+// Header, followed by frames until EOF:
+//
+//	time    int64   unix nanoseconds
+//	type    uint8   see Type
+//	dest    uint16 length + bytes
+//	data    uint32 length + bytes
+//
+// integers are big endian. The data of an Open frame is the address
+// dialed for its dest. A long connection may be split into parts, each is
+// a capture with the same Header, continuing the dests opened in parts
+// before it. A capture may be compressed by gzip, with extension
+// Ext+".gz", NewReader reads both.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	Magic   = "GPCAP"
+	Version = 1
+	Ext     = ".gpcap" // extension of capture files
+)
+
+// limits of a frame, larger ones are rejected as corrupted
+const (
+	maxHeader = 64 * 1024
+	maxData   = 64 * 1024 * 1024
+)
+
+// the capture is not in this format, or it's corrupted
+var ErrFormat = errors.New("invalid capture")
+
+type Type uint8
+
+const (
+	Open  Type = 'o' // connected to dest
+	Send  Type = '>' // data from client to dest
+	Recv  Type = '<' // data from dest to client
+	Close Type = 'c' // connection to dest is closed
+)
+
+func (t Type) String() string {
+	switch t {
+	case Open:
+		return "open"
+	case Send:
+		return "send"
+	case Recv:
+		return "recv"
+	case Close:
+		return "close"
+	}
+	return fmt.Sprintf("type(%v)", uint8(t))
+}
+
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Type) UnmarshalText(b []byte) error {
+	for _, v := range []Type{Open, Send, Recv, Close} {
+		if string(b) == v.String() {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown frame type %q", ErrFormat, b)
+}
+
+// the connection captured, addresses are as seen by gpcore
+type Header struct {
+	Connection uint64    `json:"connection"` // see ConnInfo in API.md
+	Source     string    `json:"source"`     // listening address of the tunnel, e.g. [::]:3300
+	Client     string    `json:"client"`     // remote address of the client
+	Local      string    `json:"local"`      // address the client connected to, e.g. 127.0.0.1:3300
+	Started    time.Time `json:"started"`    // when the client connected
+}
+
+type Frame struct {
+	Time time.Time `json:"time"`
+	Type Type      `json:"type"`
+	Dest string    `json:"dest"`           // dest of the tunnel, e.g. localhost:8800
+	Data []byte    `json:"data,omitempty"` // Send and Recv, or address dialed for Dest for Open
+}
+
+// writes a capture, not safe for concurrent use
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// write Magic, Version and h to w
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte(Magic), Version)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+	buf = append(buf, b...)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// write f in a single Write() of the underlying writer
+func (cw *Writer) WriteFrame(f Frame) error {
+	if len(f.Dest) > 0xffff || len(f.Data) > maxData {
+		return fmt.Errorf("frame too large: dest %v bytes, data %v bytes", len(f.Dest), len(f.Data))
+	}
+	buf := cw.buf[:0]
+	buf = binary.BigEndian.AppendUint64(buf, uint64(f.Time.UnixNano()))
+	buf = append(buf, byte(f.Type))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.Dest)))
+	buf = append(buf, f.Dest...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Data)))
+	buf = append(buf, f.Data...)
+	cw.buf = buf
+	_, err := cw.w.Write(buf)
+	return err
+}
+
+// reads a capture, not safe for concurrent use
+type Reader struct {
+	r      io.Reader
+	header Header
+}
+
+// read Magic, Version and header from r, which is buffered and
+// decompressed if it's gzipped, returns ErrFormat if r is not a capture
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	r = br
+	if b, _ := br.Peek(2); bytes.Equal(b, []byte{0x1f, 0x8b}) { // gzip magic
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+		}
+		r = zr
+	}
+	prefix := make([]byte, len(Magic)+1+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	if string(prefix[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("%w: bad magic", ErrFormat)
+	}
+	if v := prefix[len(Magic)]; v != Version {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrFormat, v)
+	}
+	n := binary.BigEndian.Uint32(prefix[len(Magic)+1:])
+	if n > maxHeader {
+		return nil, fmt.Errorf("%w: header too large", ErrFormat)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	cr := &Reader{r: r}
+	if err := json.Unmarshal(b, &cr.header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	return cr, nil
+}
+
+func (cr *Reader) Header() Header {
+	return cr.header
+}
+
+// the next frame, io.EOF after the last one, io.ErrUnexpectedEOF if the
+// capture ends in a frame, e.g. gpcore was killed while writing it
+func (cr *Reader) Next() (Frame, error) {
+	var fixed [8 + 1 + 2]byte
+	if _, err := io.ReadFull(cr.r, fixed[:]); err != nil {
+		return Frame{}, err // io.EOF only if no byte is read
+	}
+	f := Frame{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(fixed[:8]))),
+		Type: Type(fixed[8]),
+	}
+	dest := make([]byte, binary.BigEndian.Uint16(fixed[9:]))
+	if err := readFull(cr.r, dest); err != nil {
+		return Frame{}, err
+	}
+	f.Dest = string(dest)
+	var size [4]byte
+	if err := readFull(cr.r, size[:]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxData {
+		return Frame{}, fmt.Errorf("%w: frame too large", ErrFormat)
+	}
+	if n != 0 {
+		f.Data = make([]byte, n)
+		if err := readFull(cr.r, f.Data); err != nil {
+			return Frame{}, err
+		}
+	}
+	return f, nil
+}
+
+// like io.ReadFull, but EOF in a frame is unexpected
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// all frames of r, frames before a truncated one are returned with
+// io.ErrUnexpectedEOF
+func ReadAll(r *Reader) ([]Frame, error) {
+	ret := []Frame{}
+	for {
+		f, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, f)
+	}
+}
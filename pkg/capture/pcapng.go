@@ -0,0 +1,267 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcapng blocks and options, see https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+const (
+	blockSHB = 0x0a0d0d0a // section header
+	blockIDB = 0x00000001 // interface description
+	blockEPB = 0x00000006 // enhanced packet
+
+	optEnd      = 0
+	optUserAppl = 4 // shb_userappl
+	optTSResol  = 9 // if_tsresol
+
+	linkTypeRaw = 101 // raw IPv4 or IPv6, no link layer
+)
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// max payload of a synthesized segment, so the IPv4 total length fits in 16 bits
+const maxSegment = 0xffff - 20 - 20
+
+// writes captures as pcapng for Wireshark, the traffic to each dest in a
+// capture becomes a TCP connection from its Client to the address dialed
+// for the dest with synthesized IP and TCP headers, parts of a capture
+// written in order continue the connections, not safe for concurrent use
+type PcapngWriter struct {
+	w     io.Writer
+	buf   []byte
+	flows map[flowKey]*tcpFlow
+}
+
+type flowKey struct {
+	conn   uint64
+	client netip.AddrPort
+	dest   string
+}
+
+// write the section header and the interface of nanosecond timestamps to w
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w, flows: make(map[flowKey]*tcpFlow)}
+
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d) // byte-order magic
+	shb = binary.LittleEndian.AppendUint16(shb, 1)           // version 1.0
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // section length unknown
+	shb = appendOption(shb, optUserAppl, []byte("gopolar"))
+	shb = appendOption(shb, optEnd, nil)
+	if err := pw.writeBlock(blockSHB, shb); err != nil {
+		return nil, err
+	}
+
+	idb := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	idb = appendOption(idb, optTSResol, []byte{9})
+	idb = appendOption(idb, optEnd, nil)
+	if err := pw.writeBlock(blockIDB, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// options and packet data are padded to 32 bits
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+func (pw *PcapngWriter) writeBlock(typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(pw.buf[:0], typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	pw.buf = b
+	_, err := pw.w.Write(b)
+	return err
+}
+
+// a synthesized TCP connection
+type tcpFlow struct {
+	pw        *PcapngWriter
+	client    netip.AddrPort
+	dest      netip.AddrPort
+	clientSeq uint32 // next sequence number from client
+	destSeq   uint32
+}
+
+// write frames of r as packets, frames of a dest not opened in r or the
+// captures written before are skipped, frames before a truncated one are
+// written, with io.ErrUnexpectedEOF
+func (pw *PcapngWriter) WriteCapture(r *Reader) error {
+	h := r.Header()
+	client, err := netip.ParseAddrPort(h.Client)
+	if err != nil {
+		return fmt.Errorf("%w: client address: %v", ErrFormat, err)
+	}
+	for {
+		f, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		k := flowKey{conn: h.Connection, client: client, dest: f.Dest}
+		if f.Type == Open { // dest is connected again if it's removed then added back
+			dest, err := netip.ParseAddrPort(string(f.Data))
+			if err != nil {
+				return fmt.Errorf("%w: address of dest %v: %v", ErrFormat, f.Dest, err)
+			}
+			pw.flows[k] = pw.newFlow(client, dest)
+		}
+		flow := pw.flows[k]
+		if flow == nil {
+			continue
+		}
+		if err := flow.write(f); err != nil {
+			return err
+		}
+	}
+}
+
+// both ends in one family, IPv4 if possible
+func (pw *PcapngWriter) newFlow(client netip.AddrPort, dest netip.AddrPort) *tcpFlow {
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	dest = netip.AddrPortFrom(dest.Addr().Unmap(), dest.Port())
+	if client.Addr().Is4() != dest.Addr().Is4() {
+		client = netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port())
+		dest = netip.AddrPortFrom(netip.AddrFrom16(dest.Addr().As16()), dest.Port())
+	}
+	return &tcpFlow{pw: pw, client: client, dest: dest, clientSeq: 1000, destSeq: 2000}
+}
+
+func (flow *tcpFlow) write(f Frame) error {
+	switch f.Type {
+	case Open:
+		if err := flow.packet(f.Time, true, tcpSYN, nil); err != nil {
+			return err
+		}
+		flow.clientSeq++
+		if err := flow.packet(f.Time, false, tcpSYN|tcpACK, nil); err != nil {
+			return err
+		}
+		flow.destSeq++
+		return flow.packet(f.Time, true, tcpACK, nil)
+	case Send, Recv:
+		for data := f.Data; len(data) != 0; {
+			n := min(len(data), maxSegment)
+			if err := flow.packet(f.Time, f.Type == Send, tcpPSH|tcpACK, data[:n]); err != nil {
+				return err
+			}
+			if f.Type == Send {
+				flow.clientSeq += uint32(n)
+			} else {
+				flow.destSeq += uint32(n)
+			}
+			data = data[n:]
+		}
+	case Close:
+		if err := flow.packet(f.Time, true, tcpFIN|tcpACK, nil); err != nil {
+			return err
+		}
+		flow.clientSeq++
+		if err := flow.packet(f.Time, false, tcpFIN|tcpACK, nil); err != nil {
+			return err
+		}
+		flow.destSeq++
+		return flow.packet(f.Time, true, tcpACK, nil)
+	}
+	return nil
+}
+
+// write a segment from client to dest if fromClient, or the reverse
+func (flow *tcpFlow) packet(t time.Time, fromClient bool, flags byte, data []byte) error {
+	src, dst := flow.client, flow.dest
+	seq, ack := flow.clientSeq, flow.destSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	seg := binary.BigEndian.AppendUint16(nil, src.Port())
+	seg = binary.BigEndian.AppendUint16(seg, dst.Port())
+	seg = binary.BigEndian.AppendUint32(seg, seq)
+	seg = binary.BigEndian.AppendUint32(seg, ack)
+	seg = append(seg, 5<<4, flags)                  // header of 5 words, no options
+	seg = binary.BigEndian.AppendUint16(seg, 65535) // window
+	seg = binary.BigEndian.AppendUint16(seg, 0)     // checksum, set below
+	seg = binary.BigEndian.AppendUint16(seg, 0)     // urgent pointer
+	seg = append(seg, data...)
+
+	var pkt, pseudo []byte
+	if src.Addr().Is4() {
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		pkt = []byte{0x45, 0}
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(20+len(seg)))
+		pkt = append(pkt, 0, 0, 0x40, 0, 64, 6, 0, 0) // id, don't fragment, ttl, TCP, checksum
+		pkt = append(pkt, s[:]...)
+		pkt = append(pkt, d[:]...)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt))
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(seg)))
+	} else {
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		pkt = []byte{0x60, 0, 0, 0}
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(seg)))
+		pkt = append(pkt, 6, 64) // TCP, hop limit
+		pkt = append(pkt, s[:]...)
+		pkt = append(pkt, d[:]...)
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(seg)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(seg[16:], checksum(append(pseudo, seg...)))
+	pkt = append(pkt, seg...)
+
+	ts := uint64(t.UnixNano())
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt))) // captured
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt))) // original
+	epb = pad(append(epb, pkt...))
+	return flow.pw.writeBlock(blockEPB, epb)
+}
+
+// internet checksum of b
+func checksum(b []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,49 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const timeFormat = "2006-01-02 15:04:05.000000"
+
+// convert the capture in r to a readable transcript of the conversation,
+// with data of each frame in hex dump, e.g.
+//
+//	connection 12: 127.0.0.1:53422 -> 127.0.0.1:3300([::]:3300)
+//	2024-02-18 09:54:10.727005 open  localhost:8800(127.0.0.1:8800)
+//	2024-02-18 09:54:10.728001 send  localhost:8800 4 bytes
+//	00000000  66 6f 6f 0a                                       |foo.|
+//
+// frames before a truncated one are written, with io.ErrUnexpectedEOF
+func WriteText(w io.Writer, r *Reader) error {
+	bw := bufio.NewWriter(w)
+	h := r.Header()
+	fmt.Fprintf(bw, "connection %v: %v -> %v(%v)\n", h.Connection, h.Client, h.Local, h.Source)
+	var err error
+	for {
+		var f Frame
+		f, err = r.Next()
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(bw, "%v %-5v %v", f.Time.Format(timeFormat), f.Type, f.Dest)
+		if f.Type == Send || f.Type == Recv {
+			fmt.Fprintf(bw, " %v bytes\n%v", len(f.Data), hex.Dump(f.Data))
+		} else if f.Type == Open {
+			fmt.Fprintf(bw, "(%s)\n", f.Data)
+		} else {
+			fmt.Fprintln(bw)
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
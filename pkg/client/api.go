@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+const apiV2 = "/api/v2"
+
+// tunnels sorted by ID
+func (c *Client) ListTunnels(ctx context.Context) ([]Tunnel, error) {
+	var response struct {
+		Tunnels []Tunnel `json:"tunnels"`
+	}
+	err := c.Do(ctx, "GET", apiV2+"/tunnels", nil, &response)
+	return response.Tunnels, err
+}
+
+func (c *Client) GetTunnel(ctx context.Context, id uint64) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "GET", fmt.Sprintf("%v/tunnels/%v", apiV2, id), nil, &ret)
+	return ret, err
+}
+
+// returns the new tunnel
+func (c *Client) CreateTunnel(ctx context.Context, request CreateTunnelRequest) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "POST", apiV2+"/tunnels", request, &ret)
+	return ret, err
+}
+
+// change fields of tunnel id that are not nil in patch, returns the tunnel
+// after the change
+func (c *Client) UpdateTunnel(ctx context.Context, id uint64, patch TunnelPatch) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "PATCH", fmt.Sprintf("%v/tunnels/%v", apiV2, id), patch, &ret)
+	return ret, err
+}
+
+// does nothing if it's already enabled
+func (c *Client) EnableTunnel(ctx context.Context, id uint64) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "POST", fmt.Sprintf("%v/tunnels/%v/enable", apiV2, id), nil, &ret)
+	return ret, err
+}
+
+// does nothing if it's already disabled
+func (c *Client) DisableTunnel(ctx context.Context, id uint64) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "POST", fmt.Sprintf("%v/tunnels/%v/disable", apiV2, id), nil, &ret)
+	return ret, err
+}
+
+func (c *Client) DeleteTunnel(ctx context.Context, id uint64) error {
+	return c.Do(ctx, "DELETE", fmt.Sprintf("%v/tunnels/%v", apiV2, id), nil, nil)
+}
+
+// capture client connections of tunnel id accepted after this as capture
+func (c *Client) SetCapture(ctx context.Context, id uint64, capture CaptureConfig) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "PUT", fmt.Sprintf("%v/tunnels/%v/capture", apiV2, id), capture, &ret)
+	return ret, err
+}
+
+// capture tunnel id as configured by logs in gpcore.toml again
+func (c *Client) ResetCapture(ctx context.Context, id uint64) (Tunnel, error) {
+	ret := Tunnel{}
+	err := c.Do(ctx, "DELETE", fmt.Sprintf("%v/tunnels/%v/capture", apiV2, id), nil, &ret)
+	return ret, err
+}
+
+// client connections of tunnel id, including draining ones, sorted by ID
+func (c *Client) ListConnections(ctx context.Context, id uint64) ([]ConnInfo, error) {
+	var response struct {
+		Connections []ConnInfo `json:"connections"`
+	}
+	err := c.Do(ctx, "GET", fmt.Sprintf("%v/tunnels/%v/connections", apiV2, id), nil, &response)
+	return response.Connections, err
+}
+
+// close client connection id and its connections to all dests
+func (c *Client) CloseConnection(ctx context.Context, id uint64) error {
+	return c.Do(ctx, "DELETE", fmt.Sprintf("%v/connections/%v", apiV2, id), nil, nil)
+}
+
+// connections of disabled, edited or deleted tunnels that are still running
+func (c *Client) ListDraining(ctx context.Context) ([]DrainInfo, error) {
+	var response struct {
+		Draining []DrainInfo `json:"draining"`
+	}
+	err := c.Do(ctx, "GET", apiV2+"/draining", nil, &response)
+	return response.Draining, err
+}
+
+// tokens sorted by ID, without secrets
+func (c *Client) ListTokens(ctx context.Context) ([]APIToken, error) {
+	var response struct {
+		Tokens []APIToken `json:"tokens"`
+	}
+	err := c.Do(ctx, "GET", apiV2+"/tokens", nil, &response)
+	return response.Tokens, err
+}
+
+// returns the new token and its secret, the secret can not be retrieved later
+func (c *Client) CreateToken(ctx context.Context, name string, scope Scope) (APIToken, string, error) {
+	request := createTokenRequest{Name: name, Scope: scope}
+	var response struct {
+		Token  APIToken `json:"token"`
+		Secret string   `json:"secret"`
+	}
+	err := c.Do(ctx, "POST", apiV2+"/tokens", request, &response)
+	return response.Token, response.Secret, err
+}
+
+func (c *Client) RevokeToken(ctx context.Context, id uint64) error {
+	return c.Do(ctx, "DELETE", fmt.Sprintf("%v/tokens/%v", apiV2, id), nil, nil)
+}
+
+// audit entries in [since, until), zero time means no limit
+func (c *Client) Audit(ctx context.Context, since time.Time, until time.Time) ([]AuditEntry, error) {
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339))
+	}
+	if !until.IsZero() {
+		query.Set("until", until.Format(time.RFC3339))
+	}
+	path := apiV2 + "/audit"
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	var response struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	err := c.Do(ctx, "GET", path, nil, &response)
+	return response.Entries, err
+}
+
+// log files of connections sorted by path
+func (c *Client) ListLogs(ctx context.Context) ([]LogFile, error) {
+	var response struct {
+		Logs []LogFile `json:"logs"`
+	}
+	err := c.Do(ctx, "GET", apiV2+"/logs", nil, &response)
+	return response.Logs, err
+}
+
+// content of log file at path(see LogFile.Path), it must be closed
+func (c *Client) OpenLog(ctx context.Context, path string) (io.ReadCloser, error) {
+	response, err := c.send(ctx, "GET", apiV2+"/logs/file?"+url.Values{"path": {path}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// capture of client connection conn of tunnel id as pcapng, with a TCP
+// connection for each dest, it must be closed
+func (c *Client) ExportPcapng(ctx context.Context, id uint64, conn uint64) (io.ReadCloser, error) {
+	response, err := c.send(ctx, "GET", fmt.Sprintf("%v/tunnels/%v/captures/%v.pcapng", apiV2, id, conn), nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (c *Client) About(ctx context.Context) (AboutInfo, error) {
+	ret := AboutInfo{}
+	err := c.Do(ctx, "GET", apiV2+"/about", nil, &ret)
+	return ret, err
+}
@@ -0,0 +1,202 @@
+// Package client is a Go client of the gpcore API(see API.md), it talks
+// to API v2 over the unix domain socket or TCP.
+//
+//	c := client.Default()
+//	t, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{
+//		Name:   "web",
+//		Source: "localhost:3300",
+//		Dest:   "192.168.10.1:80",
+//	})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// error responded by gpcore
+type Error struct {
+	Status  int    // HTTP status
+	Code    string // see Code* constants, empty if unknown
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v (%v)", e.Message, e.Status)
+	}
+	return fmt.Sprintf("%v (%v %v)", e.Message, e.Status, e.Code)
+}
+
+// Code of err if it's an *Error, otherwise empty
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// code of errors without ErrorBody, e.g. from v1 routes
+var statusCodes = map[int]string{
+	http.StatusBadRequest:   CodeInvalidArgument,
+	http.StatusUnauthorized: CodeUnauthenticated,
+	http.StatusForbidden:    CodePermissionDenied,
+	http.StatusNotFound:     CodeNotFound,
+}
+
+// safe for concurrent use, requests are cancelled with their contexts,
+// there is no timeout otherwise
+type Client struct {
+	http    *http.Client
+	baseURL string // without trailing slash
+	token   string // sent if not empty
+}
+
+// connect to gpcore listening on unix domain socket at path
+func NewUnix(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+		baseURL: "http://unix",
+	}
+}
+
+// connect to gpcore listening on TCP, e.g. http://localhost:7070,
+// http:// is assumed if there is no scheme
+func NewHTTP(baseURL string) *Client {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{
+		http:    &http.Client{},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// connect to gpcore listening on unix domain socket at socketPath,
+// authenticate with token if it's not empty
+func NewFromConfig(socketPath string, token string) *Client {
+	c := NewUnix(socketPath)
+	c.token = token
+	return c
+}
+
+// connect to gpcore running with default socket_path and data_dir, which
+// $GOPOLAR_SOCKET_PATH and $GOPOLAR_DATA_DIR override as they do for gpcore,
+// authenticate with the token file in data_dir if it's readable,
+// gpcore.toml is not read, use NewFromConfig() for other configs
+func Default() *Client {
+	socketPath := os.Getenv("GOPOLAR_SOCKET_PATH")
+	if socketPath == "" {
+		socketPath = "/tmp/gopolar.sock"
+	}
+	dataDir := os.Getenv("GOPOLAR_DATA_DIR")
+	if dataDir == "" {
+		dataDir = ".gopolar"
+		if hd, err := os.UserHomeDir(); err == nil {
+			dataDir = filepath.Join(hd, ".gopolar")
+		}
+	}
+	token := ""
+	if b, err := os.ReadFile(filepath.Join(dataDir, "token")); err == nil {
+		token = strings.TrimSpace(string(b))
+	}
+	return NewFromConfig(socketPath, token)
+}
+
+// authenticate with token instead, not safe to call during requests
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// send a request to path(e.g. /api/v2/tunnels) with JSON of body if it's
+// not nil, decode JSON response into out if it's not nil,
+// returns *Error if status is not 2xx
+func (c *Client) Do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	response, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if out == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response of %v %v: %w", method, path, err)
+	}
+	return nil
+}
+
+// the response with 2xx status, its body must be closed
+func (c *Client) send(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		return nil, responseError(response)
+	}
+	return response, nil
+}
+
+// decode error in ErrorBody, or v1 response
+func responseError(response *http.Response) error {
+	ret := &Error{
+		Status:  response.StatusCode,
+		Code:    statusCodes[response.StatusCode],
+		Message: http.StatusText(response.StatusCode),
+	}
+	b, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return ret
+	}
+	var body struct {
+		errorBody
+		ErrMsg string `json:"err_msg"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return ret
+	}
+	if body.Error.Code != "" {
+		ret.Code = body.Error.Code
+		ret.Message = body.Error.Message
+	} else if body.ErrMsg != "" {
+		ret.Message = body.ErrMsg
+	}
+	return ret
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// stream events published from now on, the channel is closed when ctx is
+// done, or the stream ends, e.g. gpcore shuts down or the receiver falls
+// too far behind, list tunnels again after subscribing again in that case
+func (c *Client) Events(ctx context.Context) (<-chan Event, error) {
+	return c.events(ctx, "/events")
+}
+
+// Events(), with tunnel.stats of all tunnels every 2 seconds in addition
+func (c *Client) EventsWithStats(ctx context.Context) (<-chan Event, error) {
+	return c.events(ctx, "/events?stats=true")
+}
+
+func (c *Client) events(ctx context.Context, path string) (<-chan Event, error) {
+	response, err := c.send(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok { // id, event, comments and blank lines
+				continue
+			}
+			e := Event{}
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				continue
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
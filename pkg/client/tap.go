@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// stream traffic of tunnel id from now on over WebSocket, the channel is
+// closed when ctx is done, or the stream ends, e.g. the tunnel is edited or
+// removed, or gpcore shuts down, frames the receiver is too slow for are
+// dropped and counted in TapFrame.Dropped
+func (c *Client) Tap(ctx context.Context, id uint64) (<-chan TapFrame, error) {
+	dialer := websocket.Dialer{}
+	if t, ok := c.http.Transport.(*http.Transport); ok {
+		dialer.NetDialContext = t.DialContext
+	}
+	url := "ws" + strings.TrimPrefix(c.baseURL, "http") + fmt.Sprintf("%v/tunnels/%v/tap", apiV2, id)
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	conn, response, err := dialer.DialContext(ctx, url, header)
+	if errors.Is(err, websocket.ErrBadHandshake) && response != nil {
+		defer response.Body.Close()
+		return nil, responseError(response)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan TapFrame)
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // stops reading below
+	go func() {
+		defer close(ch)
+		defer stop()
+		defer conn.Close()
+		for {
+			f := TapFrame{}
+			if err := conn.ReadJSON(&f); err != nil {
+				return
+			}
+			select {
+			case ch <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
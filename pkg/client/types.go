@@ -0,0 +1,200 @@
+package client
+
+import (
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+)
+
+// types in requests and responses, see API.md for more about their fields
+
+type Tunnel struct {
+	ID     uint64 `json:"id"`
+	Name   string `json:"name"`
+	Enable bool   `json:"enable"`
+	Source string `json:"source"` // e.g. localhost:xxxx
+	Dest   string `json:"dest"`   // e.g. 192.168.1.0:7878, localhost:7878
+	// why the tunnel is invalid or fails to run, it's disabled if not empty
+	Error   string         `json:"error,omitempty"`
+	Capture *CaptureConfig `json:"capture,omitempty"` // set at runtime, see SetCapture()
+	Stats   *TunnelStats   `json:"stats,omitempty"`
+}
+
+// traffic of a tunnel since gpcore started, kept while it's disabled,
+// reset when its source or dest is edited
+type TunnelStats struct {
+	ActiveConnections int64      `json:"active_connections"` // including draining ones
+	TotalConnections  uint64     `json:"total_connections"`
+	BytesSent         uint64     `json:"bytes_sent"` // client to dest
+	BytesReceived     uint64     `json:"bytes_received"`
+	SendRate          float64    `json:"send_rate"` // bytes per second over the last minute
+	ReceiveRate       float64    `json:"receive_rate"`
+	LastError         string     `json:"last_error,omitempty"` // of dialing dest
+	LastErrorTime     *time.Time `json:"last_error_time,omitempty"`
+	LastActivity      *time.Time `json:"last_activity,omitempty"` // last connection or data
+}
+
+// fields to change in a tunnel, nil fields are kept as they are
+type TunnelPatch struct {
+	Name   *string `json:"name"`
+	Source *string `json:"source"`
+	Dest   *string `json:"dest"`
+	Enable *bool   `json:"enable"`
+}
+
+type CreateTunnelRequest struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	Enable *bool  `json:"enable"` // default to tunnel_defaults.enable
+}
+
+// connections of a removed forward that are still running
+type DrainInfo struct {
+	Source      string    `json:"source"`
+	Dest        string    `json:"dest"`
+	Connections int       `json:"connections"`
+	Deadline    time.Time `json:"deadline"` // all of them are closed after this
+}
+
+// what an API token is allowed to do, each scope includes the ones before it
+type Scope string
+
+const (
+	ScopeRead    Scope = "read"    // list tunnels
+	ScopeOperate Scope = "operate" // start and stop tunnels
+	ScopeAdmin   Scope = "admin"   // create, edit and delete tunnels, manage tokens
+)
+
+// without its secret
+type APIToken struct {
+	ID      uint64    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   Scope     `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+type createTokenRequest struct {
+	Name  string `json:"name"`
+	Scope Scope  `json:"scope"`
+}
+
+// who made a change to tunnels
+type Caller struct {
+	Source  string  `json:"source"`             // api, reload, or local for calls in gpcore itself
+	Token   string  `json:"token,omitempty"`    // name of API token, "default" for the token file
+	TokenID uint64  `json:"token_id,omitempty"` // 0 for the token file
+	UID     *uint32 `json:"uid,omitempty"`      // caller on unix domain socket
+	Remote  string  `json:"remote,omitempty"`   // caller on TCP
+}
+
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"` // add, change, toggle, enable, disable, remove or capture
+	Caller   Caller    `json:"caller"`
+	TunnelID uint64    `json:"tunnel_id"` // 0 if add fails
+	Before   *Tunnel   `json:"before"`    // null for add
+	After    *Tunnel   `json:"after"`     // null for remove
+	Error    string    `json:"error,omitempty"`
+}
+
+type AboutInfo struct {
+	Version string `json:"version"`
+}
+
+// types of Event
+const (
+	EventTunnelCreated = "tunnel.created"
+	EventTunnelChanged = "tunnel.changed"
+	EventTunnelToggled = "tunnel.toggled" // enabled or disabled
+	EventTunnelRemoved = "tunnel.removed"
+	EventConnOpened    = "connection.opened"
+	EventConnClosed    = "connection.closed"
+	EventDestDown      = "dest.down" // fail to dial a dest that was up
+	EventDestUp        = "dest.up"   // dial a dest that was down successfully
+	EventError         = "error"     // an operation on a tunnel failed
+	// stats of all tunnels every 2 seconds, see EventsWithStats()
+	EventTunnelStats = "tunnel.stats"
+)
+
+type Event struct {
+	ID         uint64    `json:"id"` // increases by 1 for each event, tunnel.stats keeps the last one
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Op         string    `json:"op,omitempty"`         // error, operation that failed, see AuditEntry.Op
+	Tunnel     *Tunnel   `json:"tunnel,omitempty"`     // tunnel.*(but tunnel.stats) and error, the tunnel after the operation
+	Connection *ConnInfo `json:"connection,omitempty"` // connection.*
+	Source     string    `json:"source,omitempty"`     // dest.*
+	Dest       string    `json:"dest,omitempty"`       // dest.*
+	Error      string    `json:"error,omitempty"`      // dest.down and error
+	// tunnel.stats, tunnel ID -> its stats
+	Stats map[uint64]TunnelStats `json:"stats,omitempty"`
+}
+
+// a client connection to a tunnel source
+type ConnInfo struct {
+	ID            uint64    `json:"id"`     // unique while gpcore runs
+	Source        string    `json:"source"` // listening address, e.g. [::]:3300
+	Client        string    `json:"client"` // remote address of the client
+	Dests         []string  `json:"dests"`  // dests connected for this client
+	Started       time.Time `json:"started"`
+	BytesSent     uint64    `json:"bytes_sent"` // client to dests, counted once for all dests
+	BytesReceived uint64    `json:"bytes_received"`
+}
+
+// capture of a client connection to all its dests, see pkg/capture
+type LogFile struct {
+	// relative to log dir, e.g. [::]:3300/2024-02-18 09:54:10.727005-12.gpcap
+	Path       string `json:"path"`
+	Source     string `json:"source"`     // listening address of the tunnel
+	Connection uint64 `json:"connection"` // ID of the client connection, see ConnInfo
+	// a long capture is rotated into parts 0, 1, ...
+	Part       int       `json:"part"`
+	Compressed bool      `json:"compressed"` // gzipped, the path ends with .gz
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+}
+
+// capture of a tunnel set at runtime, overrides logs in gpcore.toml for it,
+// applies to client connections accepted after it's set
+type CaptureConfig struct {
+	Enable bool `json:"enable"`
+	// CIDRs(e.g. 10.0.0.0/8) or IPs of clients to capture, all if empty
+	Clients []string `json:"clients,omitempty"`
+	// send(client to dest) or recv to capture one direction, both if empty
+	Direction string `json:"direction,omitempty"`
+	// of data captured per connection to dest, 0 for no limit, later data
+	// is dropped from the capture
+	MaxBytes uint64 `json:"max_bytes,omitempty"`
+}
+
+// a chunk of traffic of a client connection, or its connection to a dest
+// being opened or closed, see Tap()
+type TapFrame struct {
+	Connection uint64       `json:"connection"` // see ConnInfo
+	Type       capture.Type `json:"type"`       // open, send(client to dest), recv or close
+	Time       time.Time    `json:"time"`
+	Dest       string       `json:"dest"`
+	Data       []byte       `json:"data,omitempty"`
+	// frames dropped before this one since the receiver fell behind
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// codes of Error
+const (
+	CodeInvalidArgument    = "invalid_argument"    // malformed request or tunnel
+	CodeUnauthenticated    = "unauthenticated"     // missing or invalid API token
+	CodePermissionDenied   = "permission_denied"   // not allowed by token scope or peer credentials
+	CodeNotFound           = "not_found"           // no such tunnel or token
+	CodeAlreadyExists      = "already_exists"      // tunnel with same source and dest exists
+	CodeFailedPrecondition = "failed_precondition" // e.g. source port is taken, audit is disabled
+	CodeInternal           = "internal"            // anything else
+)
+
+// body of errors responded by API v2
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
@@ -0,0 +1,136 @@
+// Package gopolar runs tunnels inside a Go program, e.g. integration tests,
+// without gpcore. There is no API server, no unix domain socket, and
+// nothing is read from or written to disk unless Options.LogDir is set.
+//
+//	m := gopolar.New(gopolar.Options{})
+//	defer m.Close(context.Background())
+//	id, err := m.Add("db", "localhost:15432", "127.0.0.1:5432")
+package gopolar
+
+import (
+	"context"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+)
+
+type (
+	Tunnel      = core.Tunnel
+	TunnelStats = core.TunnelStats
+	TunnelPatch = core.TunnelPatch
+	DrainInfo   = core.DrainInfo
+	Event       = core.Event
+	ConnInfo    = core.ConnInfo
+)
+
+// types of Event
+const (
+	EventTunnelCreated = core.EventTunnelCreated
+	EventTunnelChanged = core.EventTunnelChanged
+	EventTunnelToggled = core.EventTunnelToggled
+	EventTunnelRemoved = core.EventTunnelRemoved
+	EventConnOpened    = core.EventConnOpened
+	EventConnClosed    = core.EventConnClosed
+	EventDestDown      = core.EventDestDown
+	EventDestUp        = core.EventDestUp
+	EventError         = core.EventError
+)
+
+// codes of errors, see ErrorCode()
+const (
+	CodeInvalidArgument    = core.CodeInvalidArgument
+	CodeNotFound           = core.CodeNotFound
+	CodeAlreadyExists      = core.CodeAlreadyExists
+	CodeFailedPrecondition = core.CodeFailedPrecondition
+	CodeInternal           = core.CodeInternal
+)
+
+// code of an error returned by Manager, e.g. CodeAlreadyExists when adding
+// a tunnel whose source and dest are taken, CodeInternal if unknown
+func ErrorCode(err error) string {
+	return core.ErrorCode(err)
+}
+
+type Options struct {
+	// how long existing connections may keep running after their tunnel
+	// is disabled, edited or removed, 0 to close them immediately
+	DrainTimeout time.Duration
+	// write traffic of each connection here, empty to disable
+	LogDir string
+}
+
+// safe for concurrent use
+type Manager struct {
+	tm *core.TunnelManager
+}
+
+func New(opts Options) *Manager {
+	cfg := core.Config{
+		DoLogs:       opts.LogDir != "",
+		LogDir:       opts.LogDir,
+		DrainTimeout: opts.DrainTimeout,
+	}
+	return &Manager{tm: core.NewTunnelManager(cfg)}
+}
+
+// add an enabled tunnel from source(e.g. localhost:3300) to dest(e.g.
+// 192.168.10.1:80), returns its ID
+func (m *Manager) Add(name string, source string, dest string) (uint64, error) {
+	return m.tm.AddTunnel(Tunnel{
+		Name:   name,
+		Enable: true,
+		Source: source,
+		Dest:   dest,
+	})
+}
+
+func (m *Manager) Get(id uint64) (Tunnel, error) {
+	return m.tm.GetTunnel(id)
+}
+
+// sorted by ID
+func (m *Manager) List() []Tunnel {
+	return m.tm.GetTunnels()
+}
+
+// change fields of tunnel id that are not nil in p
+func (m *Manager) Update(id uint64, p TunnelPatch) error {
+	return m.tm.UpdateTunnel(id, p)
+}
+
+// does nothing if it's already enabled
+func (m *Manager) Enable(id uint64) error {
+	return m.tm.EnableTunnel(id, true)
+}
+
+// does nothing if it's already disabled
+func (m *Manager) Disable(id uint64) error {
+	return m.tm.EnableTunnel(id, false)
+}
+
+func (m *Manager) Remove(id uint64) error {
+	return m.tm.RemoveTunnel(id)
+}
+
+// traffic of tunnel id since New(), Tunnel.Stats of Get() and List()
+// is not set
+func (m *Manager) Stats(id uint64) (TunnelStats, error) {
+	return m.tm.GetStats(id)
+}
+
+// connections of disabled, edited or removed tunnels that are still running
+func (m *Manager) Draining() []DrainInfo {
+	return m.tm.GetDraining()
+}
+
+// receive events from now on until cancel is called, the channel is
+// closed if the receiver falls too far behind, or on Close()
+func (m *Manager) Subscribe() (events <-chan Event, cancel func()) {
+	return m.tm.Subscribe()
+}
+
+// stop all tunnels, and wait for their connections to finish until
+// DrainTimeout or ctx is done, the Manager can not be used after this
+func (m *Manager) Close(ctx context.Context) error {
+	return m.tm.Shutdown(ctx)
+}
@@ -0,0 +1,175 @@
+package gopolar_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/goverclock/gopolar/internal/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client of API v2 on unix domain socket
+type v2Client struct {
+	client http.Client
+	token  string
+}
+
+func newV2Client(cfg core.Config) *v2Client {
+	token, _ := os.ReadFile(cfg.TokenPath())
+	return &v2Client{
+		client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", cfg.SocketPath)
+				},
+			},
+		},
+		token: strings.TrimSpace(string(token)),
+	}
+}
+
+// returns status code and response decoded into out if not nil
+func (c *v2Client) do(method string, path string, body interface{}, out interface{}) (*http.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, "http://unix/api/v2"+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp, err
+}
+
+// resources should be created, patched and deleted with proper status codes
+func TestAPIV2Tunnels(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	c := newV2Client(cfg)
+
+	created := core.Tunnel{}
+	resp, err := c.do("POST", "/tunnels", core.CreateTunnelBodyV2{
+		Name:   "v2",
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	}, &created)
+	assert.Nil(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal("/api/v2/tunnels/1", resp.Header.Get("Location"))
+	assert.Equal(uint64(1), created.ID)
+	assert.True(created.Enable)
+
+	errBody := core.ErrorBody{}
+	resp, err = c.do("POST", "/tunnels", core.CreateTunnelBodyV2{
+		Name:   "v2dup",
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	}, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+	assert.Equal(core.CodeAlreadyExists, errBody.Error.Code)
+
+	resp, err = c.do("POST", "/tunnels", map[string]string{"name": "nodest"}, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(core.CodeInvalidArgument, errBody.Error.Code)
+
+	resp, err = c.do("GET", "/tunnels/2", nil, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	assert.Equal(core.CodeNotFound, errBody.Error.Code)
+	resp, err = c.do("GET", "/tunnels/abc", nil, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// only given fields change
+	patched := core.Tunnel{}
+	resp, err = c.do("PATCH", "/tunnels/1", map[string]interface{}{"dest": "localhost:8801", "enable": false}, &patched)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("v2", patched.Name)
+	assert.Equal("localhost:3300", patched.Source)
+	assert.Equal("localhost:8801", patched.Dest)
+	assert.False(patched.Enable)
+
+	// enable and disable are idempotent
+	for _, action := range []string{"enable", "enable", "disable", "disable"} {
+		got := core.Tunnel{}
+		resp, err = c.do("POST", "/tunnels/1/"+action, nil, &got)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal(action == "enable", got.Enable)
+	}
+
+	list := struct {
+		Tunnels []core.Tunnel `json:"tunnels"`
+	}{}
+	resp, err = c.do("GET", "/tunnels", nil, &list)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal([]core.Tunnel{patched}, list.Tunnels)
+
+	resp, err = c.do("DELETE", "/tunnels/1", nil, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp, err = c.do("DELETE", "/tunnels/1", nil, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+// errors of authentication should be in API v2 shape
+func TestAPIV2Auth(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	c := newV2Client(cfg)
+
+	created := core.CreateTokenResponse{}
+	resp, err := c.do("POST", "/tokens", core.CreateTokenBody{Name: "watcher", Scope: core.ScopeRead}, &created)
+	assert.Nil(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	reader := newV2Client(cfg)
+	reader.token = created.Secret
+	resp, err = reader.do("GET", "/tunnels", nil, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	errBody := core.ErrorBody{}
+	resp, err = reader.do("POST", "/tunnels/1/enable", nil, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.Equal(core.CodePermissionDenied, errBody.Error.Code)
+
+	resp, err = c.do("DELETE", "/tokens/1", nil, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp, err = reader.do("GET", "/tunnels", nil, &errBody)
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(core.CodeUnauthenticated, errBody.Error.Code)
+}
+
+func decodeJSON(r io.Reader, out interface{}) error {
+	return json.NewDecoder(r).Decode(out)
+}
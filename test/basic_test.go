@@ -1,11 +1,20 @@
 package gopolar_test
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/client"
 	"github.com/goverclock/gopolar/test/testutil"
 
 	"github.com/stretchr/testify/assert"
@@ -276,3 +285,402 @@ func TestCreateTunnelOnline(t *testing.T) {
 	// t.Logf("clnt3300-%v serv8800-%v serv9900-%v\n", clnt3300.TotRecv, serv8800.TotEcho, serv9900.TotEcho)
 	assert.Equal(clnt3300.TotRecv, serv8800.TotEcho+serv9900.TotEcho)
 }
+
+// client half-closes after sending a request,
+// then should still receive the response
+func TestHalfCloseClient(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+
+	_, err := tm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800halfclose",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+
+	prefix := "reply to: "
+	hserv8800 := testutil.NewHalfCloseServer(8800, prefix)
+	defer hserv8800.Quit()
+
+	conn, err := net.Dial("tcp", ":3300")
+	assert.Nil(err)
+	defer conn.Close()
+	msg := "request sent before FIN"
+	_, err = conn.Write([]byte(msg))
+	assert.Nil(err)
+	assert.Nil(conn.(*net.TCPConn).CloseWrite())
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply, err := io.ReadAll(conn) // server closes after replying
+	assert.Nil(err)
+	assert.Equal(prefix+msg, string(reply))
+}
+
+// server half-closes after sending a greeting,
+// then client should still be able to send data
+func TestHalfCloseServer(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+
+	_, err := tm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800greet",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+
+	greeting := "hello, send me something"
+	gserv8800 := testutil.NewGreetServer(8800, greeting)
+	defer gserv8800.Quit()
+
+	conn, err := net.Dial("tcp", ":3300")
+	assert.Nil(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply, err := io.ReadAll(conn) // returns on FIN from server
+	assert.Nil(err)
+	assert.Equal(greeting, string(reply))
+
+	msg := "sent after server FIN"
+	_, err = conn.Write([]byte(msg))
+	assert.Nil(err)
+	assert.Nil(conn.(*net.TCPConn).CloseWrite())
+
+	// wait for server to read until FIN
+	assert.Eventually(func() bool {
+		return gserv8800.Received() == msg
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// existing connection should keep working for a grace period
+// after its tunnel is deleted, while new connections are refused
+func TestDrainOnDelete(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+	dtm := core.NewTunnelManager(core.Config{
+		ReadSaved:    false,
+		DrainTimeout: time.Second,
+	})
+
+	id, err := dtm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800drain",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+
+	prefix := "draining"
+	serv8800 := testutil.NewEchoServer(8800, prefix)
+	defer serv8800.Quit()
+
+	clnt3300 := testutil.NewEchoClient(3300)
+	assert.Nil(clnt3300.Connect())
+	msg := "before delete\n"
+	assert.Nil(clnt3300.Send(msg))
+	assert.Equal(prefix+msg, clnt3300.Recv())
+
+	assert.Nil(dtm.RemoveTunnel(id))
+	draining := dtm.GetDraining()
+	assert.Equal(1, len(draining))
+	assert.Equal("localhost:8800", draining[0].Dest)
+	assert.Equal(1, draining[0].Connections)
+
+	// still forwarding during grace period
+	msg = "after delete\n"
+	assert.Nil(clnt3300.Send(msg))
+	assert.Equal(prefix+msg, clnt3300.Recv())
+
+	// no new connection
+	assert.NotNil(testutil.NewEchoClient(3300).Connect())
+
+	// closed after grace period
+	assert.Eventually(func() bool {
+		return len(dtm.GetDraining()) == 0
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.False(clnt3300.IsConnected())
+}
+
+// editing dest should not break existing connection,
+// new connections go to the new dest
+func TestDrainOnEdit(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+	dtm := core.NewTunnelManager(core.Config{
+		ReadSaved:    false,
+		DrainTimeout: time.Second,
+	})
+
+	id, err := dtm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800edit",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+	defer dtm.RemoveTunnel(id)
+
+	prefix1 := "old"
+	serv8800 := testutil.NewEchoServer(8800, prefix1)
+	defer serv8800.Quit()
+	prefix2 := "new"
+	serv9900 := testutil.NewEchoServer(9900, prefix2)
+	defer serv9900.Quit()
+
+	oldClnt := testutil.NewEchoClient(3300)
+	assert.Nil(oldClnt.Connect())
+	msg := "hello\n"
+	assert.Nil(oldClnt.Send(msg))
+	assert.Equal(prefix1+msg, oldClnt.Recv())
+
+	assert.Nil(dtm.ChangeTunnel(id, "3300to9900edit", "localhost:3300", "localhost:9900"))
+
+	// in-flight session keeps its dest
+	assert.Nil(oldClnt.Send(msg))
+	assert.Equal(prefix1+msg, oldClnt.Recv())
+
+	newClnt := testutil.NewEchoClient(3300)
+	assert.Nil(newClnt.Connect())
+	assert.Nil(newClnt.Send(msg))
+	assert.Equal(prefix2+msg, newClnt.Recv())
+	newClnt.Disconnect()
+}
+
+// connections still running when shutdown times out should be closed
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+	stm := core.NewTunnelManager(core.Config{
+		ReadSaved:    false,
+		DrainTimeout: time.Minute,
+	})
+
+	_, err := stm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800shutdown",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+
+	prefix := "shutdown"
+	serv8800 := testutil.NewEchoServer(8800, prefix)
+	defer serv8800.Quit()
+
+	clnt3300 := testutil.NewEchoClient(3300)
+	assert.Nil(clnt3300.Connect())
+	msg := "hello\n"
+	assert.Nil(clnt3300.Send(msg))
+	assert.Equal(prefix+msg, clnt3300.Recv())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(stm.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Eventually(func() bool {
+		return !clnt3300.IsConnected()
+	}, time.Second, 10*time.Millisecond)
+	assert.NotNil(testutil.NewEchoClient(3300).Connect())
+}
+
+// Run() should not serve once Shutdown() is called, even if it's called
+// before Run() starts serving
+func TestShutdownBeforeServing(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 20; i++ {
+		cfg := apiConfig(t)
+		cfg.ReadSaved = true // watches tunnels.toml as well
+		m := core.NewTunnelManager(cfg)
+		errc := make(chan error, 1)
+		if i == 0 {
+			assert.Nil(m.Shutdown(context.Background()))
+			go func() { errc <- m.Run() }()
+		} else {
+			go func() { errc <- m.Run() }()
+			time.Sleep(time.Duration(i%5) * time.Millisecond)
+			assert.Nil(m.Shutdown(context.Background()))
+		}
+		select {
+		case err := <-errc:
+			if err != nil {
+				assert.ErrorIs(err, http.ErrServerClosed)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("still serving after shutdown")
+		}
+		_, err := os.Stat(cfg.SocketPath)
+		assert.ErrorIs(err, os.ErrNotExist)
+	}
+}
+
+// invalid edits should be rejected and keep the tunnel running
+func TestDenyInvalidEdit(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+
+	id, err := tm.AddTunnel(core.Tunnel{
+		Name:   "3300to8800",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:8800",
+	})
+	assert.Nil(err)
+	_, err = tm.AddTunnel(core.Tunnel{
+		Name:   "3300to9900",
+		Enable: true,
+		Source: "localhost:3300",
+		Dest:   "localhost:9900",
+	})
+	assert.Nil(err)
+
+	assert.NotNil(tm.ChangeTunnel(id, "bad source", "localhost:nope", "localhost:8800"))
+	assert.NotNil(tm.ChangeTunnel(id, "same", "localhost:3300", "localhost:3300"))
+	assert.NotNil(tm.ChangeTunnel(id, "duplicate", "localhost:3300", "localhost:9900"))
+
+	tn := tm.GetTunnels()[0]
+	assert.Equal("3300to8800", tn.Name)
+	assert.Equal("localhost:8800", tn.Dest)
+	assert.True(tn.Enable)
+	assert.Empty(tn.Error)
+}
+
+// invalid entries of tunnels.toml should be loaded as disabled with an error,
+// without affecting the valid ones
+func TestLoadInvalidTunnels(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.ReadSaved = true
+	err := os.WriteFile(filepath.Join(cfg.DataDir, "tunnels.toml"), []byte(`
+[[tunnels]]
+ID = 1
+Name = 'bad'
+Enable = true
+Source = 'localhost:nope'
+Dest = 'localhost:8903'
+
+[[tunnels]]
+ID = 2
+Name = 'good'
+Enable = true
+Source = 'localhost:3402'
+Dest = 'localhost:8903'
+`), 0600)
+	assert.Nil(err)
+	runManager(t, cfg)
+	serv := testutil.NewEchoServer(8903, "hello")
+	defer serv.Quit()
+
+	var response struct {
+		Success bool `json:"success"`
+		Data    struct {
+			Tunnels []core.Tunnel `json:"tunnels"`
+		} `json:"data"`
+	}
+	err = client.NewFromConfig(cfg.SocketPath, cfg.Token()).Do(context.Background(), "GET", "/tunnels/list", nil, &response)
+	assert.Nil(err)
+	assert.True(response.Success)
+	if !assert.Len(response.Data.Tunnels, 2) {
+		return
+	}
+	bad, good := response.Data.Tunnels[0], response.Data.Tunnels[1]
+	assert.Equal("bad", bad.Name)
+	assert.False(bad.Enable)
+	assert.NotEmpty(bad.Error)
+	assert.Equal("good", good.Name)
+	assert.True(good.Enable)
+	assert.Empty(good.Error)
+
+	clnt := testutil.NewEchoClient(3402)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	clnt.Disconnect()
+}
+
+// a valid tunnel whose source port is taken when loaded should be kept
+// disabled until it's enabled again, but stay enabled in tunnels.toml, so
+// it starts after the next restart
+func TestLoadBusySource(t *testing.T) {
+	assert := assert.New(t)
+
+	busy, err := net.Listen("tcp", ":3407")
+	if !assert.Nil(err) {
+		return
+	}
+	cfg := apiConfig(t)
+	cfg.ReadSaved = true
+	tunnelsPath := filepath.Join(cfg.DataDir, "tunnels.toml")
+	err = os.WriteFile(tunnelsPath, []byte(`
+[[tunnels]]
+ID = 1
+Name = 'busy'
+Enable = true
+Source = 'localhost:3407'
+Dest = 'localhost:8909'
+`), 0600)
+	assert.Nil(err)
+	m := runManager(t, cfg)
+	serv := testutil.NewEchoServer(8909, "hello")
+	defer serv.Quit()
+
+	tn, err := m.GetTunnel(1)
+	assert.Nil(err)
+	assert.False(tn.Enable)
+	assert.NotEmpty(tn.Error)
+	savedEnable := func() bool {
+		saved, err := os.ReadFile(tunnelsPath)
+		assert.Nil(err)
+		return regexp.MustCompile(`(?i)enable\s*=\s*true`).Match(saved)
+	}
+	assert.True(savedEnable())
+	assert.Nil(m.ChangeTunnel(1, "renamed", tn.Source, tn.Dest)) // saved again
+	assert.True(savedEnable())
+
+	busy.Close()
+	assert.Nil(m.EnableTunnel(1, true))
+	clnt := testutil.NewEchoClient(3407)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	clnt.Disconnect()
+	assert.True(savedEnable())
+	assert.Nil(m.EnableTunnel(1, false))
+	assert.False(savedEnable())
+}
+
+// failing to create log files should disable logging of the connection,
+// instead of exiting or dropping the connection
+func TestUnwritableLogDir(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.DoLogs = true
+	// a regular file, so even root fails to create logs in it
+	cfg.LogDir = filepath.Join(cfg.DataDir, "logs")
+	assert.Nil(os.WriteFile(cfg.LogDir, nil, 0600))
+	m := runManager(t, cfg)
+	serv := testutil.NewEchoServer(8904, "hello")
+	defer serv.Quit()
+
+	_, err := m.AddTunnel(core.Tunnel{
+		Name:   "3403to8904",
+		Enable: true,
+		Source: "localhost:3403",
+		Dest:   "localhost:8904",
+	})
+	assert.Nil(err)
+	for _, msg := range []string{"foo\n", "bar\n"} {
+		clnt := testutil.NewEchoClient(3403)
+		assert.Nil(clnt.Connect())
+		assert.Nil(clnt.Send(msg))
+		assert.Equal("hello"+msg, clnt.Recv())
+		clnt.Disconnect()
+	}
+	info, err := os.Stat(cfg.LogDir)
+	assert.Nil(err)
+	assert.False(info.IsDir())
+}
@@ -0,0 +1,521 @@
+package gopolar_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/capture"
+	"github.com/goverclock/gopolar/pkg/client"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// frames written should be read back in order, truncated captures
+// should keep frames before the truncation
+func TestCaptureFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	h := capture.Header{
+		Connection: 7,
+		Source:     "[::]:3300",
+		Client:     "127.0.0.1:50000",
+		Local:      "127.0.0.1:3300",
+		Started:    time.Unix(1700000000, 123000).UTC(),
+	}
+	dest := "localhost:8800"
+	frames := []capture.Frame{
+		{Time: h.Started, Type: capture.Open, Dest: dest, Data: []byte("127.0.0.1:8800")},
+		{Time: h.Started.Add(time.Millisecond), Type: capture.Send, Dest: dest, Data: []byte("foo\n")},
+		{Time: h.Started.Add(2 * time.Millisecond), Type: capture.Recv, Dest: dest, Data: []byte("hellofoo\n")},
+		{Time: h.Started.Add(3 * time.Millisecond), Type: capture.Close, Dest: dest},
+	}
+	buf := &bytes.Buffer{}
+	w, err := capture.NewWriter(buf, h)
+	assert.Nil(err)
+	for _, f := range frames {
+		assert.Nil(w.WriteFrame(f))
+	}
+
+	r, err := capture.NewReader(bytes.NewReader(buf.Bytes()))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(h, r.Header())
+	got, err := capture.ReadAll(r)
+	assert.Nil(err)
+	if assert.Len(got, len(frames)) {
+		for i := range frames {
+			assert.True(frames[i].Time.Equal(got[i].Time))
+			got[i].Time = frames[i].Time
+		}
+		assert.Equal(frames, got)
+	}
+
+	// killed while writing the last frame
+	r, err = capture.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.Nil(err)
+	got, err = capture.ReadAll(r)
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	assert.Len(got, len(frames)-1)
+
+	_, err = capture.NewReader(strings.NewReader("not a capture"))
+	assert.ErrorIs(err, capture.ErrFormat)
+
+	text := &bytes.Buffer{}
+	r, _ = capture.NewReader(bytes.NewReader(buf.Bytes()))
+	assert.Nil(capture.WriteText(text, r))
+	assert.Contains(text.String(), "connection 7: 127.0.0.1:50000 -> 127.0.0.1:3300([::]:3300)\n")
+	assert.Contains(text.String(), " open  localhost:8800(127.0.0.1:8800)\n")
+	assert.Contains(text.String(), " send  localhost:8800 4 bytes\n00000000  66 6f 6f 0a")
+	assert.Contains(text.String(), " close localhost:8800\n")
+}
+
+// each client connection to a tunnel source should be captured in one
+// file, with traffic to all its dests
+func TestCaptureLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.DoLogs = true
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8897, "hello")
+	defer serv.Quit()
+	serv2 := testutil.NewEchoServer(8907, "world")
+	defer serv2.Quit()
+
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "capture", Source: "localhost:3397", Dest: "localhost:8897"})
+	assert.Nil(err)
+	_, err = c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "capture2", Source: "localhost:3397", Dest: "localhost:8907"})
+	assert.Nil(err)
+	clnt := testutil.NewEchoClient(3397)
+	assert.Nil(clnt.Connect())
+	for _, msg := range []string{"foo\n", "bar\n"} {
+		assert.Nil(clnt.Send(msg))
+		assert.ElementsMatch([]string{"hello" + msg, "world" + msg}, []string{clnt.Recv(), clnt.Recv()})
+	}
+	conns, err := c.ListConnections(ctx, tn.ID)
+	if !assert.Nil(err) || !assert.Len(conns, 1) {
+		return
+	}
+	assert.Equal([]string{"localhost:8897", "localhost:8907"}, conns[0].Dests)
+	clnt.Disconnect()
+
+	// close frames are written after the connection is closed
+	var frames []capture.Frame
+	var header capture.Header
+	assert.Eventually(func() bool {
+		logs, err := c.ListLogs(ctx)
+		if err != nil || len(logs) != 1 {
+			return false
+		}
+		assert.Equal(conns[0].ID, logs[0].Connection)
+		assert.Equal(conns[0].Source, logs[0].Source)
+		assert.True(strings.HasSuffix(logs[0].Path, capture.Ext))
+		rc, err := c.OpenLog(ctx, logs[0].Path)
+		if err != nil {
+			return false
+		}
+		defer rc.Close()
+		r, err := capture.NewReader(rc)
+		if err != nil {
+			return false
+		}
+		header = r.Header()
+		frames, err = capture.ReadAll(r)
+		closed := 0
+		for _, f := range frames {
+			if f.Type == capture.Close {
+				closed++
+			}
+		}
+		return err == nil && closed == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(conns[0].ID, header.Connection)
+	assert.Equal(conns[0].Client, header.Client)
+	if !assert.NotEmpty(frames) {
+		return
+	}
+	opened, sent, recv := map[string]string{}, map[string]string{}, map[string]string{}
+	for i, f := range frames {
+		if i > 0 {
+			assert.False(f.Time.Before(frames[i-1].Time))
+		}
+		switch f.Type {
+		case capture.Open:
+			opened[f.Dest] = string(f.Data)
+		case capture.Send:
+			sent[f.Dest] += string(f.Data)
+		case capture.Recv:
+			recv[f.Dest] += string(f.Data)
+		}
+		assert.Contains(opened, f.Dest, "frame before open")
+	}
+	assert.Equal(map[string]string{"localhost:8897": "127.0.0.1:8897", "localhost:8907": "127.0.0.1:8907"}, opened)
+	assert.Equal(map[string]string{"localhost:8897": "foo\nbar\n", "localhost:8907": "foo\nbar\n"}, sent)
+	assert.Equal(map[string]string{"localhost:8897": "hellofoo\nhellobar\n", "localhost:8907": "worldfoo\nworldbar\n"}, recv)
+
+	// a TCP connection for each dest
+	rc, err := c.ExportPcapng(ctx, tn.ID, conns[0].ID)
+	if !assert.Nil(err) {
+		return
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(err)
+	packets := parsePcapng(t, b)
+	syns := map[string]string{} // client -> dest of SYN
+	sent, recv = map[string]string{}, map[string]string{}
+	for _, p := range packets {
+		if p.flags&tcpSYN != 0 && p.flags&tcpACK == 0 {
+			syns[p.dst] = p.src
+		}
+		if p.src == conns[0].Client {
+			sent[p.dst] += string(p.payload)
+		} else {
+			recv[p.src] += string(p.payload)
+		}
+	}
+	assert.Equal(map[string]string{"127.0.0.1:8897": conns[0].Client, "127.0.0.1:8907": conns[0].Client}, syns)
+	if assert.NotEmpty(packets) {
+		assert.Equal(byte(tcpACK), packets[len(packets)-1].flags) // of FIN from dest
+	}
+	assert.Equal(map[string]string{"127.0.0.1:8897": "foo\nbar\n", "127.0.0.1:8907": "foo\nbar\n"}, sent)
+	assert.Equal(map[string]string{"127.0.0.1:8897": "hellofoo\nhellobar\n", "127.0.0.1:8907": "worldfoo\nworldbar\n"}, recv)
+
+	_, err = c.ExportPcapng(ctx, tn.ID, conns[0].ID+100)
+	assert.Equal(client.CodeNotFound, client.ErrorCode(err))
+}
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpACK = 0x10
+)
+
+type tcpPacket struct {
+	time     time.Time
+	src, dst string
+	seq, ack uint32
+	flags    byte
+	payload  []byte
+}
+
+// TCP packets in pcapng b of raw IP, checksums and sequence numbers of
+// each direction of each connection are checked
+func parsePcapng(t *testing.T, b []byte) []tcpPacket {
+	assert := assert.New(t)
+	le := binary.LittleEndian
+	be := binary.BigEndian
+	ret := []tcpPacket{}
+	nextSeq := map[string]uint32{} // src>dst -> next sequence number
+	for len(b) != 0 {
+		if !assert.GreaterOrEqual(len(b), 12) {
+			return ret
+		}
+		typ, total := le.Uint32(b), le.Uint32(b[4:])
+		if !assert.LessOrEqual(int(total), len(b)) || !assert.Equal(total, le.Uint32(b[total-4:])) {
+			return ret
+		}
+		body := b[8 : total-4]
+		b = b[total:]
+		switch typ {
+		case 0x0a0d0d0a:
+			assert.Equal(uint32(0x1a2b3c4d), le.Uint32(body))
+			continue
+		case 1:
+			assert.Equal(uint16(101), le.Uint16(body)) // raw IP
+			continue
+		}
+		if !assert.Equal(uint32(6), typ) {
+			return ret
+		}
+		ts := uint64(le.Uint32(body[4:]))<<32 | uint64(le.Uint32(body[8:]))
+		pkt := body[20 : 20+le.Uint32(body[12:])]
+
+		// IPv4 only, as the test runs on 127.0.0.1
+		if !assert.Equal(byte(0x45), pkt[0]) {
+			return ret
+		}
+		assert.Equal(uint16(0), inetChecksum(pkt[:20]))
+		assert.Equal(len(pkt), int(be.Uint16(pkt[2:])))
+		seg := pkt[20:]
+		pseudo := append(append([]byte{}, pkt[12:20]...), 0, 6)
+		pseudo = be.AppendUint16(pseudo, uint16(len(seg)))
+		assert.Equal(uint16(0), inetChecksum(append(pseudo, seg...)))
+
+		p := tcpPacket{
+			time:    time.Unix(0, int64(ts)),
+			src:     netip.AddrPortFrom(netip.AddrFrom4([4]byte(pkt[12:16])), be.Uint16(seg)).String(),
+			dst:     netip.AddrPortFrom(netip.AddrFrom4([4]byte(pkt[16:20])), be.Uint16(seg[2:])).String(),
+			seq:     be.Uint32(seg[4:]),
+			ack:     be.Uint32(seg[8:]),
+			flags:   seg[13],
+			payload: seg[20:],
+		}
+		out, in := p.src+">"+p.dst, p.dst+">"+p.src
+		if p.flags&tcpSYN == 0 {
+			assert.Equal(nextSeq[out], p.seq, "seq of %v", out)
+		}
+		if p.flags&tcpACK != 0 {
+			assert.Equal(nextSeq[in], p.ack, "ack of %v", out)
+		}
+		nextSeq[out] = p.seq + uint32(len(p.payload))
+		if p.flags&(tcpSYN|tcpFIN) != 0 {
+			nextSeq[out]++
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func inetChecksum(b []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// a long capture should be rotated into parts, compressed once closed,
+// and exported as one TCP connection
+func TestLogRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.DoLogs = true
+	cfg.LogRetention = core.LogRetention{MaxFileSize: 1024, Compress: true}
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8898, "hello")
+	defer serv.Quit()
+
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "rotate", Source: "localhost:3398", Dest: "localhost:8898"})
+	assert.Nil(err)
+	clnt := testutil.NewEchoClient(3398)
+	assert.Nil(clnt.Connect())
+	sent, echoed := "", ""
+	for i := 0; i < 5; i++ {
+		msg := strings.Repeat(fmt.Sprint(i), 500) + "\n"
+		assert.Nil(clnt.Send(msg))
+		assert.Equal("hello"+msg, clnt.Recv())
+		sent += msg
+		echoed += "hello" + msg
+	}
+	conns, err := c.ListConnections(ctx, tn.ID)
+	if !assert.Nil(err) || !assert.Len(conns, 1) {
+		return
+	}
+	clnt.Disconnect()
+
+	var logs []client.LogFile
+	assert.Eventually(func() bool {
+		logs, err = c.ListLogs(ctx)
+		if err != nil || len(logs) < 3 {
+			return false
+		}
+		for _, l := range logs {
+			if !l.Compressed {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+	for i, l := range logs {
+		assert.Equal(i, l.Part)
+		assert.Equal(conns[0].ID, l.Connection)
+		assert.True(strings.HasSuffix(l.Path, capture.Ext+".gz"))
+	}
+
+	// each part is a capture, read through gzip
+	recv := ""
+	for _, l := range logs {
+		rc, err := c.OpenLog(ctx, l.Path)
+		if !assert.Nil(err) {
+			return
+		}
+		r, err := capture.NewReader(rc)
+		if assert.Nil(err) {
+			assert.Equal(conns[0].ID, r.Header().Connection)
+			frames, err := capture.ReadAll(r)
+			assert.Nil(err)
+			for _, f := range frames {
+				if f.Type == capture.Recv {
+					recv += string(f.Data)
+				}
+			}
+		}
+		rc.Close()
+	}
+	assert.Equal(echoed, recv)
+
+	rc, err := c.ExportPcapng(ctx, tn.ID, conns[0].ID)
+	if !assert.Nil(err) {
+		return
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(err)
+	syns, pcapSent := 0, ""
+	for _, p := range parsePcapng(t, b) { // sequence numbers continue across parts
+		if p.flags&tcpSYN != 0 {
+			syns++
+		}
+		if p.src == conns[0].Client {
+			pcapSent += string(p.payload)
+		}
+	}
+	assert.Equal(2, syns)
+	assert.Equal(sent, pcapSent)
+}
+
+// logs of previous runs should be kept within retention limits, and
+// their connection IDs are not reused
+func TestLogRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.DoLogs = true
+	cfg.LogRetention = core.LogRetention{MaxAge: 24 * time.Hour, MaxTunnelSize: 1000, Interval: 50 * time.Millisecond}
+	logDir := filepath.Join(cfg.DataDir, "logs")
+	write := func(path string, size int, age time.Duration) {
+		path = filepath.Join(logDir, path)
+		assert.Nil(os.MkdirAll(filepath.Dir(path), 0700))
+		assert.Nil(os.WriteFile(path, make([]byte, size), 0600))
+		mtime := time.Now().Add(-age)
+		assert.Nil(os.Chtimes(path, mtime, mtime))
+	}
+	write("[::]:3300-localhost:8800/2024-02-18 09:54:10.727005-send", 10, 30*24*time.Hour) // older version
+	write("[::]:3300/2024-02-18 09:54:10.727005-41.gpcap", 10, time.Hour)
+	write("[::]:3301/2024-02-18 09:54:10.000000-1.gpcap", 400, 3*time.Hour)
+	write("[::]:3301/2024-02-18 09:54:11.000000-2.gpcap", 400, 2*time.Hour)
+	write("[::]:3301/2024-02-18 09:54:12.000000-3.gpcap", 400, time.Hour)
+
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	assert.Eventually(func() bool {
+		logs, err := c.ListLogs(ctx)
+		return err == nil && len(logs) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	logs, err := c.ListLogs(ctx)
+	assert.Nil(err)
+	paths := []string{}
+	for _, l := range logs {
+		paths = append(paths, l.Path)
+	}
+	assert.Equal([]string{
+		"[::]:3300/2024-02-18 09:54:10.727005-41.gpcap",
+		"[::]:3301/2024-02-18 09:54:11.000000-2.gpcap",
+		"[::]:3301/2024-02-18 09:54:12.000000-3.gpcap",
+	}, paths)
+	_, err = os.Stat(filepath.Join(logDir, "[::]:3300-localhost:8800/2024-02-18 09:54:10.727005-send"))
+	assert.ErrorIs(err, os.ErrNotExist)
+
+	serv := testutil.NewEchoServer(8899, "hello")
+	defer serv.Quit()
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "retention", Source: "localhost:3399", Dest: "localhost:8899"})
+	assert.Nil(err)
+	clnt := testutil.NewEchoClient(3399)
+	assert.Nil(clnt.Connect())
+	defer clnt.Disconnect()
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	conns, err := c.ListConnections(ctx, tn.ID)
+	if assert.Nil(err) && assert.Len(conns, 1) {
+		assert.Greater(conns[0].ID, uint64(41))
+	}
+}
+
+// capture set for a tunnel at runtime should override -log, and capture
+// only connections and data matching its filters
+func TestCaptureToggle(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8900, "hello")
+	defer serv.Quit()
+
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "toggle", Source: "localhost:3400", Dest: "localhost:8900"})
+	assert.Nil(err)
+	echo := func() {
+		clnt := testutil.NewEchoClient(3400)
+		assert.Nil(clnt.Connect())
+		assert.Nil(clnt.Send("foo\n"))
+		assert.Equal("hellofoo\n", clnt.Recv())
+		clnt.Disconnect()
+	}
+	echo() // not captured without -log
+
+	_, err = c.SetCapture(ctx, tn.ID, client.CaptureConfig{Enable: true, Clients: []string{"nope"}})
+	assert.Equal(client.CodeInvalidArgument, client.ErrorCode(err))
+	_, err = c.SetCapture(ctx, tn.ID, client.CaptureConfig{Enable: true, Direction: "both"})
+	assert.Equal(client.CodeInvalidArgument, client.ErrorCode(err))
+	_, err = c.SetCapture(ctx, 12345, client.CaptureConfig{Enable: true})
+	assert.Equal(client.CodeNotFound, client.ErrorCode(err))
+
+	got, err := c.SetCapture(ctx, tn.ID, client.CaptureConfig{Enable: true, Clients: []string{"10.0.0.0/8"}})
+	assert.Nil(err)
+	assert.Equal(&client.CaptureConfig{Enable: true, Clients: []string{"10.0.0.0/8"}}, got.Capture)
+	echo() // client not matched
+
+	_, err = c.SetCapture(ctx, tn.ID, client.CaptureConfig{Enable: true, Clients: []string{"127.0.0.1"}, Direction: "recv", MaxBytes: 6})
+	assert.Nil(err)
+	echo()
+
+	var logs []client.LogFile
+	var frames []capture.Frame
+	assert.Eventually(func() bool {
+		logs, err = c.ListLogs(ctx)
+		if err != nil || len(logs) == 0 {
+			return false
+		}
+		rc, err := c.OpenLog(ctx, logs[0].Path)
+		if err != nil {
+			return false
+		}
+		defer rc.Close()
+		r, err := capture.NewReader(rc)
+		if err != nil {
+			return false
+		}
+		frames, err = capture.ReadAll(r)
+		return err == nil && len(frames) != 0 && frames[len(frames)-1].Type == capture.Close
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Len(logs, 1)
+	types := []capture.Type{}
+	for _, f := range frames {
+		types = append(types, f.Type)
+	}
+	assert.Equal([]capture.Type{capture.Open, capture.Recv, capture.Close}, types)
+	if len(frames) == 3 {
+		assert.Equal("hellof", string(frames[1].Data))
+	}
+
+	got, err = c.ResetCapture(ctx, tn.ID)
+	assert.Nil(err)
+	assert.Nil(got.Capture)
+}
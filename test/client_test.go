@@ -0,0 +1,151 @@
+package gopolar_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/pkg/client"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// typed requests should work on both transports, errors carry codes
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.HTTPListen = "127.0.0.1:7390"
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+
+	disabled := false
+	created, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{
+		Name:   "sdk",
+		Source: "localhost:3391",
+		Dest:   "localhost:8891",
+		Enable: &disabled,
+	})
+	assert.Nil(err)
+	assert.False(created.Enable)
+	_, err = c.CreateTunnel(ctx, client.CreateTunnelRequest{Source: "localhost:3391", Dest: "localhost:8891"})
+	assert.Equal(client.CodeAlreadyExists, client.ErrorCode(err))
+	var cerr *client.Error
+	if assert.True(errors.As(err, &cerr)) {
+		assert.Equal(409, cerr.Status)
+	}
+
+	enabled, err := c.EnableTunnel(ctx, created.ID)
+	assert.Nil(err)
+	assert.True(enabled.Enable)
+	name := "sdk2"
+	patched, err := c.UpdateTunnel(ctx, created.ID, client.TunnelPatch{Name: &name})
+	assert.Nil(err)
+	assert.Equal("sdk2", patched.Name)
+	assert.True(patched.Enable)
+	got, err := c.GetTunnel(ctx, created.ID)
+	assert.Nil(err)
+	assert.Equal(patched, got)
+
+	// over TCP with the same token
+	token, err := os.ReadFile(cfg.TokenPath())
+	assert.Nil(err)
+	tc := client.NewHTTP(cfg.HTTPListen)
+	_, err = tc.ListTunnels(ctx)
+	assert.Equal(client.CodeUnauthenticated, client.ErrorCode(err))
+	tc.SetToken(strings.TrimSpace(string(token)))
+	list, err := tc.ListTunnels(ctx)
+	assert.Nil(err)
+	assert.Equal([]client.Tunnel{got}, list)
+	_, err = tc.Events(ctx)
+	assert.Nil(err)
+
+	_, secret, err := c.CreateToken(ctx, "watcher", client.ScopeRead)
+	assert.Nil(err)
+	tc.SetToken(secret)
+	_, err = tc.DisableTunnel(ctx, created.ID)
+	assert.Equal(client.CodePermissionDenied, client.ErrorCode(err))
+
+	assert.Nil(c.DeleteTunnel(ctx, created.ID))
+	_, err = c.GetTunnel(ctx, created.ID)
+	assert.Equal(client.CodeNotFound, client.ErrorCode(err))
+	entries, err := c.Audit(ctx, time.Time{}, time.Time{})
+	assert.Nil(err)
+	assert.Equal(5, len(entries))
+
+	timeout, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	_, err = c.About(timeout)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+}
+
+// types of client should be decoded from and encoded to the same JSON as
+// their counterparts in core
+func TestClientTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	pairs := [][2]interface{}{
+		{client.Tunnel{}, core.Tunnel{}},
+		{client.TunnelStats{}, core.TunnelStats{}},
+		{client.TunnelPatch{}, core.TunnelPatch{}},
+		{client.CreateTunnelRequest{}, core.CreateTunnelBodyV2{}},
+		{client.DrainInfo{}, core.DrainInfo{}},
+		{client.APIToken{}, core.APIToken{}},
+		{client.Caller{}, core.Caller{}},
+		{client.AuditEntry{}, core.AuditEntry{}},
+		{client.AboutInfo{}, core.AboutInfo{}},
+		{client.Event{}, core.Event{}},
+		{client.ConnInfo{}, core.ConnInfo{}},
+		{client.LogFile{}, core.LogFile{}},
+		{client.CaptureConfig{}, core.CaptureConfig{}},
+		{client.TapFrame{}, core.TapFrame{}},
+	}
+	for _, p := range pairs {
+		assert.Equal(jsonFields(reflect.TypeOf(p[1])), jsonFields(reflect.TypeOf(p[0])), "%T", p[0])
+	}
+
+	for k, v := range map[string]string{
+		client.EventTunnelCreated:     core.EventTunnelCreated,
+		client.EventTunnelChanged:     core.EventTunnelChanged,
+		client.EventTunnelToggled:     core.EventTunnelToggled,
+		client.EventTunnelRemoved:     core.EventTunnelRemoved,
+		client.EventConnOpened:        core.EventConnOpened,
+		client.EventConnClosed:        core.EventConnClosed,
+		client.EventDestDown:          core.EventDestDown,
+		client.EventDestUp:            core.EventDestUp,
+		client.EventError:             core.EventError,
+		client.CodeInvalidArgument:    core.CodeInvalidArgument,
+		client.CodeUnauthenticated:    core.CodeUnauthenticated,
+		client.CodePermissionDenied:   core.CodePermissionDenied,
+		client.CodeNotFound:           core.CodeNotFound,
+		client.CodeAlreadyExists:      core.CodeAlreadyExists,
+		client.CodeFailedPrecondition: core.CodeFailedPrecondition,
+		client.CodeInternal:           core.CodeInternal,
+		string(client.ScopeRead):      string(core.ScopeRead),
+		string(client.ScopeOperate):   string(core.ScopeOperate),
+		string(client.ScopeAdmin):     string(core.ScopeAdmin),
+	} {
+		assert.Equal(v, k)
+	}
+}
+
+// JSON keys of fields of struct type typ mapped to their types,
+// with types of nested structs by name
+func jsonFields(typ reflect.Type) map[string]string {
+	ret := make(map[string]string)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		ret[tag] = strings.NewReplacer("client.", "", "core.", "").Replace(f.Type.String())
+	}
+	return ret
+}
@@ -0,0 +1,355 @@
+package gopolar_test
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/internal/tui"
+	"github.com/goverclock/gopolar/pkg/client"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// environment variables override config file, missing keys use defaults
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "gpcore.toml")
+	err := os.WriteFile(path, []byte(`
+http_listen = "127.0.0.1:7171"
+socket_path = "/tmp/gopolar-test.sock"
+data_dir = "/tmp/gopolar-test"
+drain_timeout = "1m"
+
+[tunnel_defaults]
+enable = false
+
+[log_retention]
+max_age = "24h"
+max_total_size = "2GB"
+max_file_size = 4096
+`), 0600)
+	assert.Nil(err)
+	t.Setenv("GOPOLAR_SOCKET_PATH", "/tmp/gopolar-env.sock")
+	t.Setenv("GOPOLAR_LOG_RETENTION_MAX_TUNNEL_SIZE", "512KiB")
+
+	cfg, err := core.LoadConfig(path)
+	assert.Nil(err)
+	assert.Equal("127.0.0.1:7171", cfg.HTTPListen)
+	assert.Equal("/tmp/gopolar-env.sock", cfg.SocketPath)
+	assert.Equal("/tmp/gopolar-test", cfg.DataDir)
+	assert.Equal(time.Minute, cfg.DrainTimeout)
+	assert.False(cfg.TunnelDefaults.Enable)
+	assert.Equal(24*time.Hour, cfg.LogRetention.MaxAge)
+	assert.Equal(core.ByteSize(2<<30), cfg.LogRetention.MaxTotalSize)
+	assert.Equal(core.ByteSize(512<<10), cfg.LogRetention.MaxTunnelSize)
+	assert.Equal(core.ByteSize(4096), cfg.LogRetention.MaxFileSize)
+	assert.Equal(core.DefaultConfig.LogRetention.Interval, cfg.LogRetention.Interval)
+	assert.Equal(core.DefaultConfig.ReadSaved, cfg.ReadSaved)
+	assert.Equal(core.DefaultConfig.WebUIPath, cfg.WebUIPath)
+
+	// specified config file must exist
+	_, err = core.LoadConfig(filepath.Join(t.TempDir(), "notexist.toml"))
+	assert.NotNil(err)
+
+	t.Setenv("GOPOLAR_LOG_RETENTION_MAX_FILE_SIZE", "64 apples")
+	_, err = core.LoadConfig(path)
+	assert.ErrorContains(err, "invalid size")
+}
+
+// instances should not share socket, HTTP port, data directory or tunnels file
+func TestInstanceConfig(t *testing.T) {
+	assert := assert.New(t)
+	tempDataDir(t)
+
+	foo, err := core.LoadInstanceConfig("foo", "")
+	assert.Nil(err)
+	bar, err := core.LoadInstanceConfig("bar", "")
+	assert.Nil(err)
+	def, err := core.LoadInstanceConfig("", "")
+	assert.Nil(err)
+	assert.Equal("foo", foo.Instance)
+	for _, pair := range [][2]core.Config{{foo, bar}, {foo, def}, {bar, def}} {
+		assert.NotEqual(pair[0].SocketPath, pair[1].SocketPath)
+		assert.NotEqual(pair[0].HTTPListen, pair[1].HTTPListen)
+		assert.NotEqual(pair[0].DataDir, pair[1].DataDir)
+	}
+	assert.NotEqual(core.ConfigPath("foo"), core.ConfigPath("bar"))
+
+	// same instance always gets the same port
+	again, err := core.InstanceConfig("foo")
+	assert.Nil(err)
+	assert.Equal(foo.HTTPListen, again.HTTPListen)
+
+	_, err = core.InstanceConfig("../foo")
+	assert.NotNil(err)
+}
+
+// instances whose names derive the same port should still get different
+// ports, and keep them
+func TestInstancePortCollision(t *testing.T) {
+	assert := assert.New(t)
+	dataDir := tempDataDir(t)
+
+	// same as the port derived from name in core
+	derived := func(name string) int {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return 7071 + int(h.Sum32()%1000)
+	}
+	names := make(map[int]string)
+	var first, second string
+	for i := 0; second == ""; i++ {
+		name := fmt.Sprint("collide", i)
+		if other, ok := names[derived(name)]; ok {
+			first, second = other, name
+		}
+		names[derived(name)] = name
+	}
+
+	a, err := core.InstanceConfig(first)
+	assert.Nil(err)
+	b, err := core.InstanceConfig(second)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf(":%v", derived(first)), a.HTTPListen)
+	assert.NotEqual(a.HTTPListen, b.HTTPListen)
+
+	// recorded in data dir of the instance
+	saved, err := os.ReadFile(filepath.Join(dataDir, "instances", second, "http_port"))
+	assert.Nil(err)
+	assert.Equal(strings.TrimPrefix(b.HTTPListen, ":")+"\n", string(saved))
+	again, err := core.InstanceConfig(second)
+	assert.Nil(err)
+	assert.Equal(b.HTTPListen, again.HTTPListen)
+
+	// the port is kept even if the first one is gone
+	assert.Nil(os.RemoveAll(filepath.Join(dataDir, "instances", first)))
+	again, err = core.InstanceConfig(second)
+	assert.Nil(err)
+	assert.Equal(b.HTTPListen, again.HTTPListen)
+}
+
+// use a temp dir as data dir of the default instance until test ends,
+// instances are created in it, returns the dir
+func tempDataDir(t *testing.T) string {
+	def := core.DefaultConfig.DataDir
+	core.DefaultConfig.DataDir = t.TempDir()
+	t.Cleanup(func() { core.DefaultConfig.DataDir = def })
+	return core.DefaultConfig.DataDir
+}
+
+// config serving API only on socket in a temp data dir
+func apiConfig(t *testing.T) core.Config {
+	cfg := core.DefaultConfig
+	cfg.ReadSaved = false
+	cfg.DataDir = t.TempDir()
+	cfg.SocketPath = filepath.Join(cfg.DataDir, "gopolar.sock")
+	cfg.HTTPListen = ""
+	cfg.WebUIPath = ""
+	return cfg
+}
+
+// run a manager with cfg until test ends, returns when API is ready
+func runManager(t *testing.T, cfg core.Config) *core.TunnelManager {
+	os.Remove(cfg.SocketPath)
+	m := core.NewTunnelManager(cfg)
+	go m.Run()
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(cfg.SocketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return m
+}
+
+// API requests without the token in data dir should be rejected
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+
+	_, err := tui.NewCLIEndWithSocket(cfg.SocketPath).GetTunnelList()
+	assert.ErrorContains(err, "401")
+
+	info, err := os.Stat(cfg.TokenPath())
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	_, err = tui.NewCLIEndWithConfig(cfg).GetTunnelList()
+	assert.Nil(err)
+}
+
+// tokens should only access routes allowed by their scopes,
+// and persist across restarts until revoked
+func TestTokenScopes(t *testing.T) {
+	assert := assert.New(t)
+	clear() // frees localhost:3300
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	admin := tui.NewCLIEndWithConfig(cfg)
+	id, err := admin.CreateTunnel("scoped", "localhost:3300", "localhost:8800")
+	assert.Nil(err)
+
+	readToken, readSecret, err := admin.CreateToken("watcher", client.ScopeRead)
+	assert.Nil(err)
+	assert.Equal(client.ScopeRead, readToken.Scope)
+	_, opSecret, err := admin.CreateToken("operator", client.ScopeOperate)
+	assert.Nil(err)
+	_, _, err = admin.CreateToken("bad", client.Scope("root"))
+	assert.NotNil(err)
+
+	reader := tui.NewCLIEndWithSocket(cfg.SocketPath)
+	reader.SetToken(readSecret)
+	_, err = reader.GetTunnelList()
+	assert.Nil(err)
+	assert.ErrorContains(reader.ToggleTunnel(int64(id)), "403")
+	_, err = reader.GetTokenList()
+	assert.ErrorContains(err, "403")
+
+	operator := tui.NewCLIEndWithSocket(cfg.SocketPath)
+	operator.SetToken(opSecret)
+	assert.Nil(operator.ToggleTunnel(int64(id)))
+	assert.ErrorContains(operator.DeleteTunnel(int64(id)), "403")
+	_, err = operator.CreateTunnel("scoped2", "localhost:3301", "localhost:8801")
+	assert.ErrorContains(err, "403")
+
+	tokens, err := admin.GetTokenList()
+	assert.Nil(err)
+	assert.Equal(2, len(tokens))
+	assert.Nil(admin.DeleteToken(readToken.ID))
+	_, err = reader.GetTunnelList()
+	assert.ErrorContains(err, "401")
+
+	// tokens are kept after restart
+	cfg.SocketPath = filepath.Join(cfg.DataDir, "gopolar2.sock")
+	runManager(t, cfg)
+	operator = tui.NewCLIEndWithSocket(cfg.SocketPath)
+	operator.SetToken(opSecret)
+	_, err = operator.GetTunnelList()
+	assert.Nil(err)
+	reader = tui.NewCLIEndWithSocket(cfg.SocketPath)
+	reader.SetToken(readSecret)
+	_, err = reader.GetTunnelList()
+	assert.ErrorContains(err, "401")
+}
+
+// socket should be created with configured mode,
+// callers with other uids should be rejected
+func TestSocketPeerCred(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	cfg.SocketPath = fmt.Sprintf("/tmp/gopolar-peercred-%v.sock", os.Getpid())
+	cfg.SocketMode = 0666
+	runManager(t, cfg)
+	defer os.Remove(cfg.SocketPath)
+
+	info, err := os.Stat(cfg.SocketPath)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0666), info.Mode().Perm())
+	_, err = tui.NewCLIEndWithConfig(cfg).GetTunnelList()
+	assert.Nil(err)
+
+	if os.Getuid() != 0 || runtime.GOOS != "linux" {
+		t.Skip("switching to another user requires root on linux")
+	}
+	// run TestPeerCredHelper as nobody, binary must be reachable by nobody
+	dir, err := os.MkdirTemp("", "gopolar-peercred")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	assert.Nil(os.Chmod(dir, 0755))
+	bin := filepath.Join(dir, "test")
+	b, err := os.ReadFile(os.Args[0])
+	assert.Nil(err)
+	assert.Nil(os.WriteFile(bin, b, 0755))
+
+	cmd := exec.Command(bin, "-test.run=^TestPeerCredHelper$", "-test.v")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOPOLAR_PEERCRED_SOCKET="+cfg.SocketPath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	assert.Nil(err, string(out))
+	assert.Contains(string(out), "403")
+}
+
+// not a test, run by TestSocketPeerCred as another user
+func TestPeerCredHelper(t *testing.T) {
+	path := os.Getenv("GOPOLAR_PEERCRED_SOCKET")
+	if path == "" {
+		t.Skip("run by TestSocketPeerCred")
+	}
+	_, err := tui.NewCLIEndWithSocket(path).GetTunnelList()
+	t.Log(err)
+}
+
+// changes to tunnels should be recorded with caller and state,
+// and filtered by time
+func TestAudit(t *testing.T) {
+	assert := assert.New(t)
+	clear() // frees localhost:3300
+
+	cfg := apiConfig(t)
+	atm := runManager(t, cfg)
+	admin := tui.NewCLIEndWithConfig(cfg)
+
+	id, err := admin.CreateTunnel("audited", "localhost:3300", "localhost:8800")
+	assert.Nil(err)
+	assert.Nil(admin.EditTunnel(id, "audited2", "localhost:3300", "localhost:8801"))
+	assert.Nil(admin.ToggleTunnel(int64(id)))
+	_, err = admin.CreateTunnel("audited", "localhost:3300", "localhost:8801")
+	assert.NotNil(err) // duplicated, still recorded
+	time.Sleep(1100 * time.Millisecond)
+	mid := time.Now().Truncate(time.Second)
+	assert.Nil(atm.RemoveTunnel(id))
+
+	entries, err := admin.GetAudit(time.Time{}, time.Time{})
+	assert.Nil(err)
+	if !assert.Equal(5, len(entries)) {
+		return
+	}
+	ops := []string{}
+	for _, e := range entries {
+		ops = append(ops, e.Op)
+	}
+	assert.Equal([]string{"add", "change", "toggle", "add", "remove"}, ops)
+
+	add := entries[0]
+	assert.Equal("api", add.Caller.Source)
+	assert.Equal("default", add.Caller.Token)
+	if assert.NotNil(add.Caller.UID) {
+		assert.Equal(uint32(os.Getuid()), *add.Caller.UID)
+	}
+	assert.Nil(add.Before)
+	if assert.NotNil(add.After) {
+		assert.Equal("audited", add.After.Name)
+	}
+	change := entries[1]
+	assert.Equal("localhost:8800", change.Before.Dest)
+	assert.Equal("localhost:8801", change.After.Dest)
+	toggle := entries[2]
+	assert.True(toggle.Before.Enable)
+	assert.False(toggle.After.Enable)
+	assert.NotEmpty(entries[3].Error)
+	remove := entries[4]
+	assert.Equal("local", remove.Caller.Source)
+	assert.Equal(id, remove.TunnelID)
+	assert.Nil(remove.After)
+
+	entries, err = admin.GetAudit(mid, time.Time{})
+	assert.Nil(err)
+	assert.Equal(1, len(entries))
+	entries, err = admin.GetAudit(time.Time{}, mid)
+	assert.Nil(err)
+	assert.Equal(4, len(entries))
+}
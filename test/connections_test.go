@@ -0,0 +1,79 @@
+package gopolar_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/tui"
+	"github.com/goverclock/gopolar/pkg/client"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connections of a tunnel should be listed until they close, and can be
+// killed, including draining ones
+func TestConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8896, "hello")
+	defer serv.Quit()
+
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "conns", Source: "localhost:3396", Dest: "localhost:8896"})
+	assert.Nil(err)
+	conns, err := c.ListConnections(ctx, tn.ID)
+	assert.Nil(err)
+	assert.Empty(conns)
+	_, err = c.ListConnections(ctx, tn.ID+1)
+	assert.Equal(client.CodeNotFound, client.ErrorCode(err))
+
+	clnt1 := testutil.NewEchoClient(3396)
+	clnt2 := testutil.NewEchoClient(3396)
+	for _, clnt := range []*testutil.EchoClient{clnt1, clnt2} {
+		assert.Nil(clnt.Connect())
+		assert.Nil(clnt.Send("foo\n"))
+		assert.Equal("hellofoo\n", clnt.Recv())
+	}
+	defer clnt2.Disconnect()
+	conns, err = c.ListConnections(ctx, tn.ID)
+	assert.Nil(err)
+	if !assert.Len(conns, 2) {
+		return
+	}
+	assert.Less(conns[0].ID, conns[1].ID)
+	assert.Equal([]string{"localhost:8896"}, conns[0].Dests)
+	assert.Equal(uint64(4), conns[0].BytesSent)
+	assert.Equal(uint64(9), conns[0].BytesReceived)
+	assert.WithinDuration(time.Now(), conns[0].Started, 5*time.Second)
+
+	// the first client is closed by gpcore
+	events, cancel, err := tui.NewCLIEndWithConfig(cfg).Events()
+	if !assert.Nil(err) {
+		return
+	}
+	defer cancel()
+	assert.Nil(c.CloseConnection(ctx, conns[0].ID))
+	e := nextEvent(t, events, client.EventConnClosed)
+	assert.Equal(conns[0].ID, e.Connection.ID)
+	assert.Eventually(func() bool { return !clnt1.IsConnected() }, time.Second, 10*time.Millisecond)
+	assert.Equal(client.CodeNotFound, client.ErrorCode(c.CloseConnection(ctx, conns[0].ID)))
+
+	// draining connections are still listed
+	_, err = c.DisableTunnel(ctx, tn.ID)
+	assert.Nil(err)
+	left, err := c.ListConnections(ctx, tn.ID)
+	assert.Nil(err)
+	if assert.Len(left, 1) {
+		assert.Equal(conns[1].ID, left[0].ID)
+	}
+	assert.Nil(c.CloseConnection(ctx, conns[1].ID))
+	assert.Eventually(func() bool {
+		left, err := c.ListConnections(ctx, tn.ID)
+		return err == nil && len(left) == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,88 @@
+package gopolar_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goverclock/gopolar/pkg/gopolar"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tunnels should run in process, and release their ports on Close()
+func TestEmbed(t *testing.T) {
+	assert := assert.New(t)
+
+	m := gopolar.New(gopolar.Options{})
+	events, cancel := m.Subscribe()
+	defer cancel()
+
+	id, err := m.Add("embedded", "localhost:3392", "localhost:8892")
+	assert.Nil(err)
+	e := <-events
+	assert.Equal(gopolar.EventTunnelCreated, e.Type)
+	_, err = m.Add("embedded", "localhost:3392", "localhost:8892")
+	assert.Equal(gopolar.CodeAlreadyExists, gopolar.ErrorCode(err))
+
+	serv := testutil.NewEchoServer(8892, "hello")
+	defer serv.Quit()
+	clnt := testutil.NewEchoClient(3392)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+
+	assert.Nil(m.Disable(id))
+	got, err := m.Get(id)
+	assert.Nil(err)
+	assert.False(got.Enable)
+	assert.Nil(m.Enable(id))
+	assert.Equal(1, len(m.List()))
+
+	assert.Nil(m.Close(context.Background()))
+	_, ok := <-events
+	for ok {
+		_, ok = <-events
+	}
+	l, err := net.Listen("tcp", ":3392")
+	if assert.Nil(err) {
+		l.Close()
+	}
+}
+
+// files already in Options.LogDir should be kept, the caller may share it
+// with other programs or runs
+func TestEmbedKeepsLogDir(t *testing.T) {
+	assert := assert.New(t)
+
+	logDir := t.TempDir()
+	existing := []string{
+		filepath.Join(logDir, "notes.txt"),
+		filepath.Join(logDir, "earlier run", "output.log"),
+	}
+	for _, p := range existing {
+		assert.Nil(os.MkdirAll(filepath.Dir(p), 0700))
+		assert.Nil(os.WriteFile(p, []byte("keep me"), 0600))
+	}
+
+	m := gopolar.New(gopolar.Options{LogDir: logDir})
+	_, err := m.Add("embedded", "localhost:3404", "localhost:8905")
+	assert.Nil(err)
+	serv := testutil.NewEchoServer(8905, "hello")
+	defer serv.Quit()
+	clnt := testutil.NewEchoClient(3404)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	clnt.Disconnect()
+	assert.Nil(m.Close(context.Background()))
+
+	for _, p := range existing {
+		b, err := os.ReadFile(p)
+		assert.Nil(err)
+		assert.Equal("keep me", string(b))
+	}
+}
@@ -0,0 +1,154 @@
+package gopolar_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/internal/tui"
+	"github.com/goverclock/gopolar/pkg/client"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the next event of type typ, skipping other events
+func nextEvent(t *testing.T, events <-chan client.Event, typ string) client.Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("event stream closed, want %v", typ)
+			}
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no event of %v", typ)
+		}
+	}
+}
+
+// changes to tunnels, connections and health of dests should be streamed
+// from /events, until gpcore shuts down
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	etm := runManager(t, cfg)
+	admin := tui.NewCLIEndWithConfig(cfg)
+
+	_, _, err := tui.NewCLIEndWithSocket(cfg.SocketPath).Events()
+	assert.ErrorContains(err, "401")
+	events, cancel, err := admin.Events()
+	if !assert.Nil(err) {
+		return
+	}
+	defer cancel()
+
+	id, err := admin.CreateTunnel("evented", "localhost:3390", "localhost:8890")
+	assert.Nil(err)
+	e := nextEvent(t, events, core.EventTunnelCreated)
+	assert.Equal(id, e.Tunnel.ID)
+	assert.Equal("evented", e.Tunnel.Name)
+	_, err = admin.CreateTunnel("evented", "localhost:3390", "localhost:8890")
+	assert.NotNil(err)
+	e = nextEvent(t, events, core.EventError)
+	assert.Equal("add", e.Op)
+	assert.NotEmpty(e.Error)
+
+	serv := testutil.NewEchoServer(8890, "hello")
+	clnt := testutil.NewEchoClient(3390)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	e = nextEvent(t, events, core.EventConnOpened)
+	assert.Equal([]string{"localhost:8890"}, e.Connection.Dests)
+	client := e.Connection.Client
+	assert.NotEmpty(client)
+	clnt.Disconnect()
+	e = nextEvent(t, events, core.EventConnClosed)
+	assert.Equal(client, e.Connection.Client)
+
+	serv.Quit()
+	assert.Nil(clnt.Connect()) // accepted, then closed as dest is down
+	e = nextEvent(t, events, core.EventDestDown)
+	assert.Equal("localhost:8890", e.Dest)
+	assert.NotEmpty(e.Error)
+	clnt.Disconnect()
+	serv = testutil.NewEchoServer(8890, "hello")
+	defer serv.Quit()
+	assert.Nil(clnt.Connect())
+	e = nextEvent(t, events, core.EventDestUp)
+	assert.Equal("localhost:8890", e.Dest)
+	clnt.Disconnect()
+
+	assert.Nil(admin.ToggleTunnel(int64(id)))
+	e = nextEvent(t, events, core.EventTunnelToggled)
+	assert.False(e.Tunnel.Enable)
+	assert.Nil(admin.DeleteTunnel(int64(id)))
+	e = nextEvent(t, events, core.EventTunnelRemoved)
+	assert.Equal(id, e.Tunnel.ID)
+
+	etm.Shutdown(context.Background())
+	select {
+	case _, ok := <-events:
+		for ok {
+			_, ok = <-events
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("event stream is not closed on shutdown")
+	}
+}
+
+// stats of tunnels should be pushed only to subscribers asking for them
+func TestStatsEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	etm := runManager(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	events, err := c.EventsWithStats(ctx)
+	if !assert.Nil(err) {
+		return
+	}
+	plain, stop := etm.Subscribe()
+	defer stop()
+
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "stats", Source: "localhost:3405", Dest: "localhost:8906"})
+	assert.Nil(err)
+	serv := testutil.NewEchoServer(8906, "hello")
+	defer serv.Quit()
+	clnt := testutil.NewEchoClient(3405)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	clnt.Disconnect()
+
+	stats := client.TunnelStats{}
+	timeout := time.After(5 * time.Second)
+	for stats.ActiveConnections != 0 || stats.BytesReceived == 0 {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			if e.Type == client.EventTunnelStats {
+				stats = e.Stats[tn.ID]
+			}
+		case <-timeout:
+			t.Fatal("no tunnel.stats with traffic of the tunnel")
+		}
+	}
+	assert.Equal(uint64(1), stats.TotalConnections)
+	assert.Equal(uint64(4), stats.BytesSent)
+	assert.Equal(uint64(9), stats.BytesReceived)
+
+	for len(plain) != 0 {
+		assert.NotEqual(core.EventTunnelStats, (<-plain).Type)
+	}
+}
@@ -0,0 +1,126 @@
+package gopolar_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commands of gpctl should print tables, JSON or YAML, and exit with
+// codes of errors
+func TestGpctl(t *testing.T) {
+	assert := assert.New(t)
+
+	bin := filepath.Join(t.TempDir(), "gpctl")
+	build, err := exec.Command("go", "build", "-o", bin, "../cmd/gpctl").CombinedOutput()
+	if !assert.Nil(err, string(build)) {
+		return
+	}
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	token, err := os.ReadFile(cfg.TokenPath())
+	assert.Nil(err)
+	gpctl := func(stdin string, args ...string) (string, int) {
+		cmd := exec.Command(bin, args...)
+		cmd.Env = append(os.Environ(), "GOPOLAR_TOKEN="+strings.TrimSpace(string(token)))
+		cmd.Args = append(cmd.Args, "-socket", cfg.SocketPath)
+		cmd.Stdin = strings.NewReader(stdin)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return stdout.String(), exitErr.ExitCode()
+		}
+		assert.Nil(err)
+		return stdout.String(), 0
+	}
+
+	out, code := gpctl("", "create", "cli", "localhost:3393", "localhost:8893", "-disabled")
+	assert.Equal(0, code)
+	assert.Contains(out, "localhost:3393")
+	_, code = gpctl("", "create", "cli", "localhost:3393", "localhost:8893")
+	assert.Equal(5, code)
+	_, code = gpctl("", "create", "cli")
+	assert.Equal(2, code)
+	_, code = gpctl("", "enable", "12345")
+	assert.Equal(4, code)
+
+	out, code = gpctl("", "list", "-o", "json")
+	assert.Equal(0, code)
+	var list struct {
+		Tunnels []struct {
+			ID     uint64 `json:"id"`
+			Name   string `json:"name"`
+			Enable bool   `json:"enable"`
+		} `json:"tunnels"`
+	}
+	assert.Nil(json.Unmarshal([]byte(out), &list))
+	if assert.Len(list.Tunnels, 1) {
+		assert.Equal("cli", list.Tunnels[0].Name)
+		assert.False(list.Tunnels[0].Enable)
+	}
+	out, code = gpctl("", "list", "-o", "yaml")
+	assert.Equal(0, code)
+	assert.Contains(out, "name: cli")
+
+	// export, delete, then import it back
+	export, code := gpctl("", "export")
+	assert.Equal(0, code)
+	assert.Contains(export, "source: localhost:3393")
+	_, code = gpctl("", "delete", "1")
+	assert.Equal(0, code)
+	out, code = gpctl(export, "import", "-")
+	assert.Equal(0, code)
+	assert.Contains(out, "created")
+	out, code = gpctl(export, "import", "-")
+	assert.Equal(0, code)
+	assert.Contains(out, "exists")
+
+	out, code = gpctl("", "__ids")
+	assert.Equal(0, code)
+	assert.Regexp(`^\d+\n$`, out)
+	id := strings.TrimSpace(out)
+	out, code = gpctl("", "capture", id, "-direction", "send", "-clients", "127.0.0.1,10.0.0.0/8")
+	assert.Equal(0, code)
+	assert.Regexp(`true\s+127.0.0.1,10.0.0.0/8\s+send`, out)
+	_, code = gpctl("", "capture", id, "-direction", "both")
+	assert.Equal(6, code)
+	out, code = gpctl("", "capture", id, "-reset")
+	assert.Equal(0, code)
+	assert.Contains(out, "default")
+	_, code = gpctl("", "capture", id, "-off", "-reset")
+	assert.Equal(2, code)
+	out, code = gpctl("", "completion", "bash")
+	assert.Equal(0, code)
+	assert.Contains(out, "complete -F _gpctl gpctl")
+
+	// convert a capture from stdin
+	buf := &bytes.Buffer{}
+	w, err := capture.NewWriter(buf, capture.Header{Connection: 3, Client: "127.0.0.1:50000"})
+	assert.Nil(err)
+	assert.Nil(w.WriteFrame(capture.Frame{Type: capture.Open, Dest: "localhost:8893", Data: []byte("127.0.0.1:8893")}))
+	assert.Nil(w.WriteFrame(capture.Frame{Type: capture.Send, Dest: "localhost:8893", Data: []byte("foo")}))
+	out, code = gpctl(buf.String(), "convert", "-")
+	assert.Equal(0, code)
+	assert.Contains(out, "send  localhost:8893 3 bytes\n00000000  66 6f 6f")
+	out, code = gpctl(buf.String(), "convert", "-", "-o", "json")
+	assert.Equal(0, code)
+	assert.Contains(out, `"data": "Zm9v"`)
+	out, code = gpctl(buf.String(), "convert", "-", "-pcapng")
+	assert.Equal(0, code)
+	assert.True(strings.HasPrefix(out, "\x0a\x0d\x0d\x0a"))
+	_, code = gpctl("not a capture", "convert", "-")
+	assert.Equal(6, code)
+	_, code = gpctl("", "pcap", "1", "12345")
+	assert.Equal(4, code) // no such capture
+}
@@ -0,0 +1,203 @@
+package gopolar_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/tui"
+	"github.com/goverclock/gopolar/pkg/client"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// traffic of tunnels should be counted in /metrics, labeled by tunnel
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	admin := tui.NewCLIEndWithConfig(cfg)
+	c := newV2Client(cfg)
+	scrape := func() string {
+		req, err := http.NewRequest("GET", "http://unix/metrics", nil)
+		assert.Nil(err)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		resp, err := c.client.Do(req)
+		if !assert.Nil(err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(err)
+		return string(b)
+	}
+
+	_, err := admin.CreateTunnel("metered", "localhost:3394", "localhost:8894")
+	assert.Nil(err)
+	labels := `{dest="localhost:8894",name="metered",source="localhost:3394",tunnel_id="1"}`
+
+	clnt := testutil.NewEchoClient(3394)
+	assert.Nil(clnt.Connect()) // accepted, then closed as dest is down
+	var out string
+	assert.Eventually(func() bool {
+		out = scrape()
+		return strings.Contains(out, "gopolar_tunnel_dial_failures_total"+labels+" 1")
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(out, "gopolar_tunnel_connections_rejected_total"+labels+" 1")
+	clnt.Disconnect()
+
+	serv := testutil.NewEchoServer(8894, "hello")
+	defer serv.Quit()
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	assert.Contains(scrape(), "gopolar_tunnel_connections_active"+labels+" 1")
+	clnt.Disconnect()
+	assert.Eventually(func() bool {
+		out = scrape()
+		return strings.Contains(out, "gopolar_tunnel_connections_active"+labels+" 0")
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(out, "gopolar_tunnel_connections_accepted_total"+labels+" 1")
+	assert.Contains(out, "gopolar_tunnel_sent_bytes_total"+labels+" 4")
+	assert.Contains(out, "gopolar_tunnel_received_bytes_total"+labels+" 9")
+	assert.Contains(out, "gopolar_tunnel_connection_duration_seconds_count"+labels+" 1")
+
+	c.token = ""
+	req, _ := http.NewRequest("GET", "http://unix/metrics", nil)
+	resp, err := c.client.Do(req)
+	if assert.Nil(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+// tunnels in API responses should carry live stats, kept while disabled,
+// but not after removed
+func TestTunnelStats(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+
+	created, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "stats", Source: "localhost:3395", Dest: "localhost:8895"})
+	if !assert.Nil(err) || !assert.NotNil(created.Stats) {
+		return
+	}
+	assert.Equal(client.TunnelStats{}, *created.Stats)
+
+	clnt := testutil.NewEchoClient(3395)
+	assert.Nil(clnt.Connect()) // dest is down
+	assert.Eventually(func() bool {
+		got, err := c.GetTunnel(ctx, created.ID)
+		return err == nil && got.Stats.LastError != ""
+	}, time.Second, 10*time.Millisecond)
+	clnt.Disconnect()
+
+	serv := testutil.NewEchoServer(8895, "hello")
+	defer serv.Quit()
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	got, err := c.GetTunnel(ctx, created.ID)
+	assert.Nil(err)
+	assert.Equal(int64(1), got.Stats.ActiveConnections)
+	assert.Equal(uint64(1), got.Stats.TotalConnections)
+	assert.Equal(uint64(4), got.Stats.BytesSent)
+	assert.Equal(uint64(9), got.Stats.BytesReceived)
+	assert.InDelta(4.0/60, got.Stats.SendRate, 0.001)
+	assert.InDelta(9.0/60, got.Stats.ReceiveRate, 0.001)
+	assert.NotNil(got.Stats.LastActivity)
+	assert.NotNil(got.Stats.LastErrorTime)
+
+	clnt.Disconnect()
+	_, err = c.DisableTunnel(ctx, created.ID)
+	assert.Nil(err)
+	assert.Eventually(func() bool {
+		list, err := c.ListTunnels(ctx)
+		return err == nil && len(list) == 1 && list[0].Stats.ActiveConnections == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	list, err := c.ListTunnels(ctx)
+	if assert.Nil(err) && assert.Len(list, 1) {
+		assert.Equal(uint64(4), list[0].Stats.BytesSent)
+	}
+
+	// a recreated tunnel starts from zero, even if connections of the
+	// removed one are still draining
+	_, err = c.EnableTunnel(ctx, created.ID)
+	assert.Nil(err)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	assert.Nil(c.DeleteTunnel(ctx, created.ID))
+	recreated, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "stats", Source: "localhost:3395", Dest: "localhost:8895"})
+	if !assert.Nil(err) || !assert.NotNil(recreated.Stats) {
+		return
+	}
+	assert.Equal(client.TunnelStats{}, *recreated.Stats)
+	assert.Nil(clnt.Send("bar\n")) // to the removed tunnel
+	assert.Equal("hellobar\n", clnt.Recv())
+	clnt.Disconnect()
+	time.Sleep(100 * time.Millisecond)
+	got, err = c.GetTunnel(ctx, recreated.ID)
+	assert.Nil(err)
+	assert.Equal(client.TunnelStats{}, *got.Stats)
+}
+
+// reading stats while a tunnel is removed and re-created should not bring
+// back stats of the removed one
+func TestStatsReadDuringRecreate(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	ctx := context.Background()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8908, "hello")
+	defer serv.Quit()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.ListTunnels(ctx)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for i := 0; i < 10; i++ {
+		tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "recreated", Source: "localhost:3406", Dest: "localhost:8908"})
+		if !assert.Nil(err) {
+			return
+		}
+		clnt := testutil.NewEchoClient(3406)
+		assert.Nil(clnt.Connect())
+		assert.Nil(clnt.Send("foo\n"))
+		assert.Equal("hellofoo\n", clnt.Recv())
+		clnt.Disconnect()
+		var got client.Tunnel
+		assert.Eventually(func() bool {
+			got, err = c.GetTunnel(ctx, tn.ID)
+			return err == nil && got.Stats.ActiveConnections == 0
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(uint64(1), got.Stats.TotalConnections)
+		assert.Equal(uint64(4), got.Stats.BytesSent)
+		assert.Nil(c.DeleteTunnel(ctx, tn.ID))
+	}
+}
@@ -0,0 +1,75 @@
+package gopolar_test
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/goverclock/gopolar/internal/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// openapi.json should document exactly the routes served, and
+// types with the same fields as they are in JSON
+func TestOpenAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	otm := runManager(t, cfg)
+	c := newV2Client(cfg)
+	c.token = "" // public
+
+	doc := openAPIDoc{}
+	req, err := http.NewRequest("GET", "http://unix/openapi.json", nil)
+	assert.Nil(err)
+	resp, err := c.client.Do(req)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Nil(decodeJSON(resp.Body, &doc))
+
+	param := regexp.MustCompile(`\{([A-Za-z_]+)\}`)
+	documented := []string{}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			ginPath := param.ReplaceAllString(path, ":$1")
+			documented = append(documented, strings.ToUpper(method)+" "+ginPath)
+		}
+	}
+	served := []string{}
+	for _, r := range otm.Routes() {
+		served = append(served, r.Method+" "+r.Path)
+	}
+	sort.Strings(documented)
+	sort.Strings(served)
+	assert.Equal(served, documented)
+
+	for _, v := range []interface{}{core.Tunnel{}, core.CreateTunnelBody{}, core.EditTunnelBody{}, core.TunnelPatch{}} {
+		typ := reflect.TypeOf(v)
+		fields := []string{}
+		for i := 0; i < typ.NumField(); i++ {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			fields = append(fields, name)
+		}
+		props := []string{}
+		for p := range doc.Components.Schemas[typ.Name()].Properties {
+			props = append(props, p)
+		}
+		sort.Strings(fields)
+		sort.Strings(props)
+		assert.Equal(fields, props, typ.Name())
+	}
+}
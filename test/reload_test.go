@@ -0,0 +1,101 @@
+package gopolar_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/internal/core"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// changes to tunnels.toml should apply to running tunnels once the file
+// is written, a broken file should change nothing
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	clear()
+
+	cfg := apiConfig(t)
+	cfg.ReadSaved = true
+	cfg.DrainTimeout = 0
+	tunnelsPath := filepath.Join(cfg.DataDir, "tunnels.toml")
+	err := os.WriteFile(tunnelsPath, []byte(`
+[[tunnels]]
+ID = 1
+Name = 'keep'
+Enable = true
+Source = 'localhost:3300'
+Dest = 'localhost:8800'
+
+[[tunnels]]
+ID = 2
+Name = 'remove'
+Enable = true
+Source = 'localhost:3301'
+Dest = 'localhost:8801'
+`), 0600)
+	assert.Nil(err)
+	rtm := runManager(t, cfg)
+	assert.Equal(2, len(rtm.GetTunnels()))
+
+	for _, p := range []uint64{8800, 8801, 8802} {
+		serv := testutil.NewEchoServer(p, "serv"+fmt.Sprint(p))
+		defer serv.Quit()
+	}
+	clnt3300 := testutil.NewEchoClient(3300)
+	assert.Nil(clnt3300.Connect())
+	assert.Nil(clnt3300.Send("before\n"))
+	assert.Equal("serv8800before\n", clnt3300.Recv())
+
+	// broken file changes nothing, connections through tunnels stay open
+	before := rtm.GetTunnels()
+	assert.Nil(os.WriteFile(tunnelsPath, []byte("[[tunnels"), 0600))
+	assert.NotNil(rtm.Reload())
+	time.Sleep(500 * time.Millisecond) // let the watcher try as well
+	assert.Equal(before, rtm.GetTunnels())
+	assert.Nil(clnt3300.Send("after\n"))
+	assert.Equal("serv8800after\n", clnt3300.Recv())
+
+	// tunnel 1 edited, tunnel 2 removed, one created
+	err = os.WriteFile(tunnelsPath, []byte(`
+[[tunnels]]
+ID = 1
+Name = 'edited'
+Enable = true
+Source = 'localhost:3300'
+Dest = 'localhost:8802'
+
+[[tunnels]]
+Name = 'created'
+Enable = true
+Source = 'localhost:3302'
+Dest = 'localhost:8801'
+`), 0600)
+	assert.Nil(err)
+	assert.Eventually(func() bool {
+		list := rtm.GetTunnels()
+		return len(list) == 2 && list[0].Name == "edited" && list[1].Name == "created"
+	}, 3*time.Second, 50*time.Millisecond)
+	list := rtm.GetTunnels()
+	assert.Equal(core.Tunnel{ID: 1, Name: "edited", Enable: true, Source: "localhost:3300", Dest: "localhost:8802"}, list[0])
+	assert.True(list[1].Enable)
+
+	for port, want := range map[uint64]string{3300: "serv8802", 3302: "serv8801"} {
+		clnt := testutil.NewEchoClient(port)
+		assert.Nil(clnt.Connect())
+		assert.Nil(clnt.Send("msg\n"))
+		assert.Equal(want+"msg\n", clnt.Recv())
+		clnt.Disconnect()
+	}
+	assert.NotNil(testutil.NewEchoClient(3301).Connect())
+
+	// applied changes are saved
+	saved, err := os.ReadFile(tunnelsPath)
+	assert.Nil(err)
+	assert.Contains(string(saved), "edited")
+	assert.NotContains(string(saved), "remove")
+}
@@ -0,0 +1,91 @@
+package gopolar_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goverclock/gopolar/pkg/capture"
+	"github.com/goverclock/gopolar/pkg/client"
+	"github.com/goverclock/gopolar/test/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// next frame of a tap, fails the test if none arrives in time
+func nextFrame(t *testing.T, frames <-chan client.TapFrame) client.TapFrame {
+	select {
+	case f, ok := <-frames:
+		assert.True(t, ok, "tap closed")
+		return f
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "no frame")
+		return client.TapFrame{}
+	}
+}
+
+// traffic of a tunnel should be streamed to its taps in order, and taps
+// should end when the tunnel is edited
+func TestTap(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := apiConfig(t)
+	runManager(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := client.NewFromConfig(cfg.SocketPath, cfg.Token())
+	serv := testutil.NewEchoServer(8901, "hello")
+	defer serv.Quit()
+
+	_, err := c.Tap(ctx, 12345)
+	assert.Equal(client.CodeNotFound, client.ErrorCode(err))
+	tn, err := c.CreateTunnel(ctx, client.CreateTunnelRequest{Name: "tap", Source: "localhost:3401", Dest: "localhost:8901"})
+	assert.Nil(err)
+	err = c.Do(ctx, "GET", "/api/v2/tunnels/1/tap", nil, nil)
+	assert.Equal(client.CodeInvalidArgument, client.ErrorCode(err))
+
+	frames, err := c.Tap(ctx, tn.ID)
+	if !assert.Nil(err) {
+		return
+	}
+	clnt := testutil.NewEchoClient(3401)
+	assert.Nil(clnt.Connect())
+	assert.Nil(clnt.Send("foo\n"))
+	assert.Equal("hellofoo\n", clnt.Recv())
+	conns, err := c.ListConnections(ctx, tn.ID)
+	if !assert.Nil(err) || !assert.Len(conns, 1) {
+		return
+	}
+
+	f := nextFrame(t, frames)
+	assert.Equal(capture.Open, f.Type)
+	assert.Equal(conns[0].ID, f.Connection)
+	assert.Equal("localhost:8901", f.Dest)
+	f = nextFrame(t, frames)
+	assert.Equal(capture.Send, f.Type)
+	assert.Equal("foo\n", string(f.Data))
+	recv := ""
+	for len(recv) < len("hellofoo\n") {
+		f = nextFrame(t, frames)
+		if !assert.Equal(capture.Recv, f.Type) {
+			return
+		}
+		recv += string(f.Data)
+	}
+	assert.Equal("hellofoo\n", recv)
+	clnt.Disconnect()
+	f = nextFrame(t, frames)
+	assert.Equal(capture.Close, f.Type)
+	assert.Equal(conns[0].ID, f.Connection)
+
+	// edited tunnels may forward elsewhere, so taps end
+	dest := "localhost:8902"
+	_, err = c.UpdateTunnel(ctx, tn.ID, client.TunnelPatch{Dest: &dest})
+	assert.Nil(err)
+	select {
+	case _, ok := <-frames:
+		assert.False(ok)
+	case <-time.After(5 * time.Second):
+		assert.Fail("tap is not closed")
+	}
+}
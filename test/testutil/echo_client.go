@@ -69,7 +69,7 @@ func (ec *EchoClient) Send(msg string) error {
 		panic(ec.Name + "trying to Send() without new line")
 	}
 	if ec.conn == nil {
-		return fmt.Errorf(ec.Name + "trying to Send() without connection")
+		return errors.New(ec.Name + "trying to Send() without connection")
 	}
 	nw, err := ec.conn.Write([]byte(msg))
 	if err != nil {
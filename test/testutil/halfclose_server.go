@@ -0,0 +1,90 @@
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/goverclock/gopolar/internal/core"
+)
+
+type HalfCloseServer struct {
+	Name     string
+	Prefix   string
+	Greeting string
+
+	mu       sync.Mutex
+	received []byte
+	listener net.Listener
+}
+
+// setup a server that reads until client sends FIN,
+// then replies all data with a prefix and closes the connection
+func NewHalfCloseServer(port uint64, prefix string) *HalfCloseServer {
+	return newHalfCloseServer(port, prefix, "")
+}
+
+// setup a server that sends greeting and FIN immediately,
+// then reads until client sends FIN
+func NewGreetServer(port uint64, greeting string) *HalfCloseServer {
+	return newHalfCloseServer(port, "", greeting)
+}
+
+func newHalfCloseServer(port uint64, prefix string, greeting string) *HalfCloseServer {
+	p := ":" + fmt.Sprint(port)
+	listener, err := net.Listen("tcp", p)
+	ret := &HalfCloseServer{
+		Name:     "[h-serv" + p + "] ",
+		Prefix:   prefix,
+		Greeting: greeting,
+		listener: listener,
+	}
+	if err != nil {
+		core.Debugln(ret.Name+"failed to create listener, err:", err)
+		os.Exit(1)
+	}
+	core.Debugf(ret.Name+"listening on %s\n", listener.Addr())
+	go ret.run()
+	return ret
+}
+
+func (hs *HalfCloseServer) run() {
+	for {
+		conn, err := hs.listener.Accept()
+		if err != nil {
+			core.Debugf(hs.Name+"quit(err=%v)\n", err)
+			break
+		}
+		core.Debugln(hs.Name + "connected to " + conn.RemoteAddr().String())
+		go hs.handleConnection(conn.(*net.TCPConn))
+	}
+}
+
+func (hs *HalfCloseServer) Quit() {
+	hs.listener.Close()
+}
+
+// data received before client sent FIN
+func (hs *HalfCloseServer) Received() string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return string(hs.received)
+}
+
+func (hs *HalfCloseServer) handleConnection(conn *net.TCPConn) {
+	defer conn.Close()
+	if hs.Greeting != "" {
+		conn.Write([]byte(hs.Greeting))
+		conn.CloseWrite()
+	}
+	data, err := io.ReadAll(conn)
+	core.Debugf(hs.Name+"read %v bytes until FIN, err=%v\n", len(data), err)
+	hs.mu.Lock()
+	hs.received = append(hs.received, data...)
+	hs.mu.Unlock()
+	if hs.Greeting == "" {
+		conn.Write([]byte(hs.Prefix + string(data)))
+	}
+}
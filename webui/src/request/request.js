@@ -1,12 +1,26 @@
 import axios from "axios";
-import { ElMessage } from "element-plus";
+import { ElMessage, ElMessageBox } from "element-plus";
+
+const tokenKey = "gopolar-token";
+
+// ask user for the API token, it's in the token file under gpcore data dir
+function promptToken() {
+    return ElMessageBox.prompt("API token (see token file in gpcore data dir, e.g. ~/.gopolar/token)", "Authentication", {
+        confirmButtonText: "OK",
+        cancelButtonText: "Cancel",
+    }).then(({ value }) => {
+        localStorage.setItem(tokenKey, value.trim());
+    });
+}
 
 export default function request(options) {
     return new Promise((resolve, reject) => {
+        const token = localStorage.getItem(tokenKey);
         const instance = axios.create({
-            baseURL: "http://" + window.location.hostname + ":7070",
+            baseURL: import.meta.env.VITE_API_BASE || window.location.origin,
             headers: {
                 'Content-Type': 'application/json',
+                ...(token ? { 'Authorization': 'Bearer ' + token } : {}),
             },
             timeout: 100000,
             responseType: 'json',
@@ -18,8 +32,12 @@ export default function request(options) {
                 return response.data;
             },
             (err) => {
-                if (err.message) {
-                    ElMessage({ message: err.message, type: "error" });
+                if (err.response && err.response.status === 401) {
+                    return Promise.reject(err);
+                }
+                const msg = (err.response && err.response.data && err.response.data.err_msg) || err.message;
+                if (msg) {
+                    ElMessage({ message: msg, type: "error" });
                 }
                 return Promise.reject(err);
             }
@@ -35,6 +53,13 @@ export default function request(options) {
                 }
             })
             .catch((error) => {
+                if (error.response && error.response.status === 401) {
+                    localStorage.removeItem(tokenKey);
+                    promptToken()
+                        .then(() => request(options).then(resolve, reject))
+                        .catch(() => reject(error));
+                    return;
+                }
                 reject(error);
             });
     });